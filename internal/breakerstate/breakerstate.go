@@ -0,0 +1,91 @@
+// Package breakerstate shares circuit breaker trips and recoveries between
+// the replicas of a service, so that every replica opens its breaker for a
+// dependency soon after one of them finds it down.
+package breakerstate
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Event is a breaker state change published by a replica
+type Event struct {
+	Key    string    `json:"key"`    // Breaker key, e.g. "http:payments"
+	Open   bool      `json:"open"`   // True for a trip, false for a recovery
+	Origin string    `json:"origin"` // Replica that published the event
+	Time   time.Time `json:"time"`
+}
+
+// Backend carries events between replicas
+type Backend interface {
+	// Publish shares an event with every replica
+	Publish(ctx context.Context, event Event) error
+	// Subscribe delivers the events of every replica, including the
+	// subscriber's own, to handler until ctx is done. Backends that store
+	// state first deliver the latest event of every key.
+	Subscribe(ctx context.Context, handler func(Event)) error
+}
+
+// storageKey returns the path segment an event key is stored under, so that
+// keys such as "grpc:/billing.Invoices/Create" do not nest
+func storageKey(key string) string {
+	return url.PathEscape(key)
+}
+
+// MemoryBackend shares events between breakers in one process, for tests
+// and single-process setups
+type MemoryBackend struct {
+	mutex    sync.Mutex
+	latest   map[string]Event
+	handlers map[int]func(Event)
+	next     int
+}
+
+var _ Backend = (*MemoryBackend)(nil)
+
+// NewMemoryBackend creates an in-process backend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{latest: make(map[string]Event), handlers: make(map[int]func(Event))}
+}
+
+// Publish delivers an event to every subscriber before returning
+func (b *MemoryBackend) Publish(ctx context.Context, event Event) error {
+	b.mutex.Lock()
+	b.latest[event.Key] = event
+	handlers := make([]func(Event), 0, len(b.handlers))
+	for _, handler := range b.handlers {
+		handlers = append(handlers, handler)
+	}
+	b.mutex.Unlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+	return nil
+}
+
+// Subscribe delivers the latest event of every key and then every new event
+func (b *MemoryBackend) Subscribe(ctx context.Context, handler func(Event)) error {
+	b.mutex.Lock()
+	id := b.next
+	b.next++
+	b.handlers[id] = handler
+	latest := make([]Event, 0, len(b.latest))
+	for _, event := range b.latest {
+		latest = append(latest, event)
+	}
+	b.mutex.Unlock()
+
+	for _, event := range latest {
+		handler(event)
+	}
+	go func() {
+		<-ctx.Done()
+		b.mutex.Lock()
+		delete(b.handlers, id)
+		b.mutex.Unlock()
+	}()
+	return nil
+}
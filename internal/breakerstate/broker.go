@@ -0,0 +1,69 @@
+package breakerstate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pramithamj/microcomms/internal/mqclient"
+)
+
+// BrokerBackend shares events through a message broker topic. Every replica
+// consumes the topic in its own consumer group, so each one sees every
+// event. Nothing is stored: a replica that starts later only learns of
+// events published after it subscribed.
+type BrokerBackend struct {
+	broker  mqclient.Broker
+	topic   string
+	replica string
+}
+
+var _ Backend = (*BrokerBackend)(nil)
+
+// NewBrokerBackend creates a backend publishing to topic (default
+// "microcomms.breakers"); replica names this replica's consumer group
+func NewBrokerBackend(broker mqclient.Broker, topic, replica string) *BrokerBackend {
+	if topic == "" {
+		topic = "microcomms.breakers"
+	}
+	return &BrokerBackend{broker: broker, topic: topic, replica: replica}
+}
+
+// Publish sends an event to the topic
+func (b *BrokerBackend) Publish(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.broker.Publish(ctx, &mqclient.Message{
+		ID:        mqclient.NewMessageID(),
+		Topic:     b.topic,
+		Key:       event.Key,
+		Payload:   payload,
+		Timestamp: time.Now(),
+	})
+}
+
+// Subscribe consumes the topic until ctx is done
+func (b *BrokerBackend) Subscribe(ctx context.Context, handler func(Event)) error {
+	sub, err := b.broker.SubscribeWithOptions(b.topic, func(ctx context.Context, msg *mqclient.Message) error {
+		var event Event
+		if err := json.Unmarshal(msg.Payload, &event); err != nil {
+			// Redelivering a malformed event would not help
+			log.Printf("Dropping malformed breaker event %s: %v", msg.ID, err)
+			return nil
+		}
+		handler(event)
+		return nil
+	}, mqclient.SubscribeOptions{Group: "microcomms-breakers-" + b.replica})
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %v", b.topic, err)
+	}
+	go func() {
+		<-ctx.Done()
+		sub.Unsubscribe()
+	}()
+	return nil
+}
@@ -0,0 +1,115 @@
+package breakerstate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ConsulBackend stores the latest event of every breaker in the Consul KV
+// store under <prefix>/<key> and watches the prefix with blocking queries
+type ConsulBackend struct {
+	client   *api.Client
+	prefix   string
+	waitTime time.Duration
+}
+
+var _ Backend = (*ConsulBackend)(nil)
+
+// NewConsulBackend creates a backend for the Consul agent at addr, storing
+// events under prefix (default "microcomms/breakers")
+func NewConsulBackend(addr, prefix string) (*ConsulBackend, error) {
+	config := api.DefaultConfig()
+	if addr != "" {
+		config.Address = addr
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Consul client: %v", err)
+	}
+	if prefix == "" {
+		prefix = "microcomms/breakers"
+	}
+	return &ConsulBackend{client: client, prefix: strings.Trim(prefix, "/"), waitTime: 5 * time.Minute}, nil
+}
+
+// Publish stores an event as the latest of its breaker
+func (b *ConsulBackend) Publish(ctx context.Context, event Event) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	pair := &api.KVPair{Key: b.prefix + "/" + storageKey(event.Key), Value: value}
+	if _, err := b.client.KV().Put(pair, (&api.WriteOptions{}).WithContext(ctx)); err != nil {
+		return fmt.Errorf("failed to publish breaker event: %v", err)
+	}
+	return nil
+}
+
+// Subscribe delivers the stored events and then every change until ctx is
+// done. The first listing must succeed; later failures are retried.
+func (b *ConsulBackend) Subscribe(ctx context.Context, handler func(Event)) error {
+	seen := make(map[string]uint64)
+	index, err := b.poll(ctx, 0, seen, handler)
+	if err != nil {
+		return err
+	}
+	go func() {
+		backoff := time.Second
+		for ctx.Err() == nil {
+			next, err := b.poll(ctx, index, seen, handler)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("Failed to watch breaker events: %v", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(backoff):
+				}
+				if backoff < 30*time.Second {
+					backoff *= 2
+				}
+				continue
+			}
+			backoff = time.Second
+			// Consul may reset the index; start over rather than spin
+			if next < index {
+				next = 0
+			}
+			index = next
+		}
+	}()
+	return nil
+}
+
+// poll lists the prefix, blocking until it changes after index, and
+// delivers the events modified since they were last seen
+func (b *ConsulBackend) poll(ctx context.Context, index uint64, seen map[string]uint64, handler func(Event)) (uint64, error) {
+	opts := (&api.QueryOptions{WaitIndex: index, WaitTime: b.waitTime}).WithContext(ctx)
+	pairs, meta, err := b.client.KV().List(b.prefix+"/", opts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list breaker events: %v", err)
+	}
+	for _, pair := range pairs {
+		if seen[pair.Key] == pair.ModifyIndex {
+			continue
+		}
+		seen[pair.Key] = pair.ModifyIndex
+		var event Event
+		if err := json.Unmarshal(pair.Value, &event); err != nil {
+			log.Printf("Skipping malformed breaker event %s: %v", pair.Key, err)
+			continue
+		}
+		handler(event)
+	}
+	if meta.LastIndex == 0 {
+		return 1, nil
+	}
+	return meta.LastIndex, nil
+}
@@ -0,0 +1,92 @@
+package breakerstate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdBackend stores the latest event of every breaker in etcd under
+// <prefix>/<key> and watches the prefix
+type EtcdBackend struct {
+	client *clientv3.Client
+	prefix string
+}
+
+var _ Backend = (*EtcdBackend)(nil)
+
+// NewEtcdBackend creates a backend for the etcd cluster at endpoints,
+// storing events under prefix (default "/microcomms/breakers")
+func NewEtcdBackend(endpoints []string, prefix string) (*EtcdBackend, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("at least one etcd endpoint is required")
+	}
+	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create etcd client: %v", err)
+	}
+	if prefix == "" {
+		prefix = "/microcomms/breakers"
+	}
+	return &EtcdBackend{client: client, prefix: strings.TrimSuffix(prefix, "/")}, nil
+}
+
+// Publish stores an event as the latest of its breaker
+func (b *EtcdBackend) Publish(ctx context.Context, event Event) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if _, err := b.client.Put(ctx, b.prefix+"/"+storageKey(event.Key), string(value)); err != nil {
+		return fmt.Errorf("failed to publish breaker event: %v", err)
+	}
+	return nil
+}
+
+// Subscribe delivers the stored events and then every change until ctx is
+// done
+func (b *EtcdBackend) Subscribe(ctx context.Context, handler func(Event)) error {
+	resp, err := b.client.Get(ctx, b.prefix+"/", clientv3.WithPrefix())
+	if err != nil {
+		return fmt.Errorf("failed to list breaker events: %v", err)
+	}
+	for _, kv := range resp.Kvs {
+		b.deliver(kv.Key, kv.Value, handler)
+	}
+
+	watch := b.client.Watch(ctx, b.prefix+"/", clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1))
+	go func() {
+		for wresp := range watch {
+			if err := wresp.Err(); err != nil {
+				log.Printf("Failed to watch breaker events: %v", err)
+				continue
+			}
+			for _, ev := range wresp.Events {
+				if ev.Type == clientv3.EventTypePut {
+					b.deliver(ev.Kv.Key, ev.Kv.Value, handler)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// deliver decodes a stored event and passes it to handler
+func (b *EtcdBackend) deliver(key, value []byte, handler func(Event)) {
+	var event Event
+	if err := json.Unmarshal(value, &event); err != nil {
+		log.Printf("Skipping malformed breaker event %s: %v", key, err)
+		return
+	}
+	handler(event)
+}
+
+// Close closes the etcd client
+func (b *EtcdBackend) Close() error {
+	return b.client.Close()
+}
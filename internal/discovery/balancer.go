@@ -0,0 +1,293 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+)
+
+// WeightMetaKey is the instance metadata key read by the weighted balancer
+const WeightMetaKey = "weight"
+
+// BalancerStrategy names a load balancing strategy
+type BalancerStrategy string
+
+const (
+	RoundRobin       BalancerStrategy = "round_robin"       // Instances in turn
+	Random           BalancerStrategy = "random"            // Uniformly random instance
+	Weighted         BalancerStrategy = "weighted"          // Smooth weighted round-robin on the "weight" metadata
+	LeastOutstanding BalancerStrategy = "least_outstanding" // Instance with the fewest requests in flight
+	PowerOfTwo       BalancerStrategy = "p2c"               // Fewer in-flight requests of two random instances
+)
+
+// DoneFunc reports that a request to a picked instance has completed, with
+// the request's error if it failed. It must be called exactly once.
+type DoneFunc func(err error)
+
+// Balancer picks the instance of a service that receives a request
+type Balancer interface {
+	// Pick chooses one of instances, which must not be empty
+	Pick(ctx context.Context, instances []Instance) (Instance, DoneFunc, error)
+}
+
+// NewBalancer creates a balancer for a strategy. Each balancer keeps its
+// own state, so a service should use the same balancer for all requests.
+func NewBalancer(strategy BalancerStrategy) (Balancer, error) {
+	switch strategy {
+	case RoundRobin, "":
+		return &roundRobinBalancer{}, nil
+	case Random:
+		return &randomBalancer{}, nil
+	case Weighted:
+		return &weightedBalancer{current: make(map[string]int)}, nil
+	case LeastOutstanding:
+		return &leastOutstandingBalancer{outstanding: newOutstanding()}, nil
+	case PowerOfTwo:
+		return &p2cBalancer{outstanding: newOutstanding()}, nil
+	case ConsistentHash:
+		return &hashBalancer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy: %s", strategy)
+	}
+}
+
+// noopDone is the DoneFunc of balancers that do not track requests
+func noopDone(error) {}
+
+// roundRobinBalancer picks instances in turn
+type roundRobinBalancer struct {
+	mutex sync.Mutex
+	next  int
+}
+
+func (b *roundRobinBalancer) Pick(ctx context.Context, instances []Instance) (Instance, DoneFunc, error) {
+	if len(instances) == 0 {
+		return Instance{}, nil, fmt.Errorf("no instances to pick from")
+	}
+	b.mutex.Lock()
+	i := b.next % len(instances)
+	b.next++
+	b.mutex.Unlock()
+	return instances[i], noopDone, nil
+}
+
+// randomBalancer picks a uniformly random instance
+type randomBalancer struct{}
+
+func (b *randomBalancer) Pick(ctx context.Context, instances []Instance) (Instance, DoneFunc, error) {
+	if len(instances) == 0 {
+		return Instance{}, nil, fmt.Errorf("no instances to pick from")
+	}
+	return instances[rand.Intn(len(instances))], noopDone, nil
+}
+
+// weightedBalancer implements smooth weighted round-robin: every pick adds
+// each instance's weight to its current value, picks the highest current
+// value and subtracts the total weight from it. Instances without a valid
+// weight count as 1, and instances with weight 0 only receive requests when
+// every instance has weight 0.
+type weightedBalancer struct {
+	mutex   sync.Mutex
+	current map[string]int // Instance ID -> current value
+}
+
+// instanceWeight returns the weight of an instance from its metadata
+func instanceWeight(instance Instance) int {
+	weight, err := strconv.Atoi(instance.Meta[WeightMetaKey])
+	if err != nil || weight < 0 {
+		return 1
+	}
+	return weight
+}
+
+func (b *weightedBalancer) Pick(ctx context.Context, instances []Instance) (Instance, DoneFunc, error) {
+	if len(instances) == 0 {
+		return Instance{}, nil, fmt.Errorf("no instances to pick from")
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	weights := make([]int, len(instances))
+	total := 0
+	for i, instance := range instances {
+		weights[i] = instanceWeight(instance)
+		total += weights[i]
+	}
+	if total == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+		total = len(weights)
+	}
+
+	// Forget instances that are gone so the map does not grow unbounded
+	present := make(map[string]struct{}, len(instances))
+	best := -1
+	for i, instance := range instances {
+		present[instance.ID] = struct{}{}
+		if weights[i] == 0 {
+			continue
+		}
+		b.current[instance.ID] += weights[i]
+		if best < 0 || b.current[instance.ID] > b.current[instances[best].ID] {
+			best = i
+		}
+	}
+	for id := range b.current {
+		if _, ok := present[id]; !ok {
+			delete(b.current, id)
+		}
+	}
+	b.current[instances[best].ID] -= total
+	return instances[best], noopDone, nil
+}
+
+// outstanding counts the requests in flight per instance
+type outstanding struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+func newOutstanding() *outstanding {
+	return &outstanding{counts: make(map[string]int)}
+}
+
+// get returns the requests in flight to an instance; callers hold the mutex
+func (o *outstanding) get(id string) int {
+	return o.counts[id]
+}
+
+// start records a request to an instance and returns its DoneFunc; callers
+// hold the mutex
+func (o *outstanding) start(id string) DoneFunc {
+	o.counts[id]++
+	var once sync.Once
+	return func(error) {
+		once.Do(func() {
+			o.mutex.Lock()
+			defer o.mutex.Unlock()
+			if o.counts[id]--; o.counts[id] <= 0 {
+				delete(o.counts, id)
+			}
+		})
+	}
+}
+
+// leastOutstandingBalancer picks the instance with the fewest requests in
+// flight, the earliest in the list on ties
+type leastOutstandingBalancer struct {
+	outstanding *outstanding
+}
+
+func (b *leastOutstandingBalancer) Pick(ctx context.Context, instances []Instance) (Instance, DoneFunc, error) {
+	if len(instances) == 0 {
+		return Instance{}, nil, fmt.Errorf("no instances to pick from")
+	}
+
+	b.outstanding.mutex.Lock()
+	defer b.outstanding.mutex.Unlock()
+
+	best := 0
+	for i := 1; i < len(instances); i++ {
+		if b.outstanding.get(instances[i].ID) < b.outstanding.get(instances[best].ID) {
+			best = i
+		}
+	}
+	return instances[best], b.outstanding.start(instances[best].ID), nil
+}
+
+// p2cBalancer picks two distinct random instances and uses the one with
+// fewer requests in flight, which avoids herding onto a single idle
+// instance while staying close to least-outstanding
+type p2cBalancer struct {
+	outstanding *outstanding
+}
+
+func (b *p2cBalancer) Pick(ctx context.Context, instances []Instance) (Instance, DoneFunc, error) {
+	if len(instances) == 0 {
+		return Instance{}, nil, fmt.Errorf("no instances to pick from")
+	}
+
+	b.outstanding.mutex.Lock()
+	defer b.outstanding.mutex.Unlock()
+
+	best := 0
+	if len(instances) > 1 {
+		i := rand.Intn(len(instances))
+		j := rand.Intn(len(instances) - 1)
+		if j >= i {
+			j++
+		}
+		best = i
+		if b.outstanding.get(instances[j].ID) < b.outstanding.get(instances[i].ID) {
+			best = j
+		}
+	}
+	return instances[best], b.outstanding.start(instances[best].ID), nil
+}
+
+// Balancers holds one balancer per service, created on first use with the
+// service's configured strategy or the default one
+type Balancers struct {
+	defaultStrategy BalancerStrategy
+	strategies      map[string]BalancerStrategy
+
+	mutex     sync.Mutex
+	balancers map[string]Balancer
+}
+
+// NewBalancers creates the balancers for a default strategy and per-service
+// overrides, validating every strategy up front
+func NewBalancers(defaultStrategy BalancerStrategy, services map[string]BalancerStrategy) (*Balancers, error) {
+	if _, err := NewBalancer(defaultStrategy); err != nil {
+		return nil, err
+	}
+	strategies := make(map[string]BalancerStrategy, len(services))
+	for service, strategy := range services {
+		if _, err := NewBalancer(strategy); err != nil {
+			return nil, fmt.Errorf("invalid balancer for service '%s': %v", service, err)
+		}
+		strategies[service] = strategy
+	}
+	return &Balancers{
+		defaultStrategy: defaultStrategy,
+		strategies:      strategies,
+		balancers:       make(map[string]Balancer),
+	}, nil
+}
+
+// Set replaces the balancer of a service
+func (b *Balancers) Set(service string, balancer Balancer) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.balancers[service] = balancer
+}
+
+// For returns the balancer of a service
+func (b *Balancers) For(service string) Balancer {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if balancer, ok := b.balancers[service]; ok {
+		return balancer
+	}
+	strategy, ok := b.strategies[service]
+	if !ok {
+		strategy = b.defaultStrategy
+	}
+	// Strategies were validated by NewBalancers
+	balancer, _ := NewBalancer(strategy)
+	b.balancers[service] = balancer
+	return balancer
+}
+
+// Pick chooses one of a service's instances with the service's balancer
+func (b *Balancers) Pick(ctx context.Context, service string, instances []Instance) (Instance, DoneFunc, error) {
+	if len(instances) == 0 {
+		return Instance{}, nil, &NoInstancesError{Service: service}
+	}
+	return b.For(service).Pick(ctx, instances)
+}
@@ -1,20 +1,50 @@
 package discovery
 
 import (
+    "context"
     "fmt"
+    "log"
+    "sort"
+    "strings"
     "sync"
     "time"
     
     "github.com/hashicorp/consul/api"
 )
 
-// ConsulDiscovery implements service discovery using Consul
+// ConsulDiscovery implements service discovery using Consul. The first
+// lookup of a service starts a background watch using Consul blocking
+// queries, which keeps the cached entries current and pushes every change
+// to the service's subscribers, so requests never wait on Consul after the
+// initial load. While a watch cannot reach Consul, lookups of its service
+// return the watch's error; wrap the discovery in a StaleResolver to keep
+// serving the last-known instances instead. Watches without subscribers
+// that see no lookups for the idle timeout (default 10m) are stopped.
 type ConsulDiscovery struct {
     client        *api.Client
     serviceCache  map[string][]*api.ServiceEntry
     cacheMutex    sync.RWMutex
-    cacheExpiry   time.Duration
-    lastCacheTime map[string]time.Time
+    balancers     *Balancers
+    
+    watches     map[string]*consulWatch
+    waitTime    time.Duration // Maximum duration of a blocking query
+    idleTimeout time.Duration // Unused watches are stopped after this long
+    lastSweep   time.Time
+    closeOnce   sync.Once
+    closed      chan struct{}
+}
+
+// consulWatch tracks the blocking-query watch of one service query
+type consulWatch struct {
+    query       Query
+    key         string
+    ready       chan struct{} // Closed once the first query completed
+    err         error         // Error of the first query, if it failed
+    failure     error         // Error of the latest query while the watch is failing
+    index       uint64
+    subscribers map[chan []Instance]struct{}
+    lastUsed    time.Time          // Time of the latest lookup
+    cancel      context.CancelFunc // Stops the watch
 }
 
 // NewConsulDiscovery creates a new Consul discovery client
@@ -29,61 +59,375 @@ func NewConsulDiscovery(addr string) (*ConsulDiscovery, error) {
         return nil, fmt.Errorf("failed to create Consul client: %v", err)
     }
     
+    balancers, _ := NewBalancers(RoundRobin, nil)
     return &ConsulDiscovery{
         client:        client,
         serviceCache:  make(map[string][]*api.ServiceEntry),
-        cacheExpiry:   time.Second * 30, // Cache for 30 seconds
-        lastCacheTime: make(map[string]time.Time),
+        balancers:     balancers,
+        watches:       make(map[string]*consulWatch),
+        waitTime:      5 * time.Minute,
+        idleTimeout:   10 * time.Minute,
+        lastSweep:     time.Now(),
+        closed:        make(chan struct{}),
     }, nil
 }
 
-// FindService finds a service by name
+var (
+    _ Resolver = (*ConsulDiscovery)(nil)
+    _ Registry = (*ConsulDiscovery)(nil)
+    _ Watcher  = (*ConsulDiscovery)(nil)
+    _ QueryResolver = (*ConsulDiscovery)(nil)
+    _ CheckRegistry = (*ConsulDiscovery)(nil)
+)
+
+// SetBalancers replaces the balancers used by FindService (round-robin for
+// every service by default)
+func (c *ConsulDiscovery) SetBalancers(balancers *Balancers) {
+    c.cacheMutex.Lock()
+    defer c.cacheMutex.Unlock()
+    c.balancers = balancers
+}
+
+// SetWatchIdleTimeout changes how long a watch without subscribers is kept
+// after its latest lookup
+func (c *ConsulDiscovery) SetWatchIdleTimeout(timeout time.Duration) {
+    c.cacheMutex.Lock()
+    defer c.cacheMutex.Unlock()
+    c.idleTimeout = timeout
+}
+
+// FindService finds a service by name, returning the URL of the instance
+// picked by the service's balancer
 func (c *ConsulDiscovery) FindService(name string) (string, error) {
-    entries, err := c.getServiceEntries(name)
+    ctx := context.Background()
+    instances, err := c.Resolve(ctx, name)
     if err != nil {
         return "", err
     }
     
-    if len(entries) == 0 {
-        return "", fmt.Errorf("no instances of service '%s' found", name)
+    c.cacheMutex.RLock()
+    balancers := c.balancers
+    c.cacheMutex.RUnlock()
+    
+    instance, done, err := balancers.Pick(ctx, name, instances)
+    if err != nil {
+        return "", err
+    }
+    // The caller's request is not tracked beyond the pick
+    done(nil)
+    return instance.URL(), nil
+}
+
+// Resolve returns the passing instances of a service
+func (c *ConsulDiscovery) Resolve(ctx context.Context, name string) ([]Instance, error) {
+    return c.ResolveQuery(ctx, Query{Service: name})
+}
+
+// ResolveQuery returns the passing instances matching a query. Tags,
+// datacenter and namespace are part of the Consul query, so each
+// combination is watched separately; metadata and version are matched on
+// the results.
+func (c *ConsulDiscovery) ResolveQuery(ctx context.Context, q Query) ([]Instance, error) {
+    entries, err := c.getServiceEntries(ctx, q)
+    if err != nil {
+        return nil, err
     }
     
-    // For simplicity, return the first instance
-    // In a real implementation, we could implement load balancing here
-    instance := entries[0]
-    return fmt.Sprintf("http://%s:%d", instance.Service.Address, instance.Service.Port), nil
+    local := q
+    local.Tags, local.Datacenter = nil, ""
+    instances, err := FilterInstances(instancesFromEntries(entries), local)
+    if err != nil {
+        return nil, err
+    }
+    if len(instances) == 0 {
+        return nil, &NoInstancesError{Service: q.Service}
+    }
+    return instances, nil
+}
+
+// instanceFromEntry converts a Consul health entry to an Instance, falling
+// back to the node address when the service does not advertise its own
+func instanceFromEntry(entry *api.ServiceEntry) Instance {
+    address := entry.Service.Address
+    if address == "" && entry.Node != nil {
+        address = entry.Node.Address
+    }
+    return Instance{
+        ID:      entry.Service.ID,
+        Service: entry.Service.Service,
+        Address: address,
+        Port:    entry.Service.Port,
+        Tags:    entry.Service.Tags,
+        Meta:    entry.Service.Meta,
+    }
 }
 
-// getServiceEntries gets service entries, using cache if available
-func (c *ConsulDiscovery) getServiceEntries(name string) ([]*api.ServiceEntry, error) {
+// getServiceEntries returns the cached entries of a query, starting its
+// watch and waiting for the first query, or until ctx is done, on first use
+func (c *ConsulDiscovery) getServiceEntries(ctx context.Context, q Query) ([]*api.ServiceEntry, error) {
+    w := c.watch(q)
+    select {
+    case <-w.ready:
+    case <-ctx.Done():
+        return nil, fmt.Errorf("failed to query Consul for service '%s': %v", q.Service, ctx.Err())
+    }
+    
     c.cacheMutex.RLock()
-    entries, exists := c.serviceCache[name]
-    lastCacheTime := c.lastCacheTime[name]
-    c.cacheMutex.RUnlock()
+    defer c.cacheMutex.RUnlock()
+    if w.err != nil {
+        return nil, w.err
+    }
+    if w.failure != nil {
+        return nil, w.failure
+    }
+    return c.serviceCache[w.key], nil
+}
+
+// watch returns the watch of a query, starting it if needed. A watch whose
+// first query failed is replaced so that the next lookup retries.
+func (c *ConsulDiscovery) watch(q Query) *consulWatch {
+    key := consulQueryKey(q)
+    c.cacheMutex.Lock()
+    defer c.cacheMutex.Unlock()
     
-    // Return from cache if it's still valid
-    if exists && time.Since(lastCacheTime) < c.cacheExpiry {
-        return entries, nil
+    now := time.Now()
+    c.sweep(now)
+    if w, ok := c.watches[key]; ok {
+        select {
+        case <-w.ready:
+            if w.err == nil {
+                w.lastUsed = now
+                return w
+            }
+        default:
+            w.lastUsed = now
+            return w
+        }
+    }
+    
+    ctx, cancel := context.WithCancel(context.Background())
+    w := &consulWatch{
+        query:       q,
+        key:         key,
+        ready:       make(chan struct{}),
+        subscribers: make(map[chan []Instance]struct{}),
+        lastUsed:    now,
+        cancel:      cancel,
+    }
+    c.watches[key] = w
+    go c.runWatch(ctx, w)
+    return w
+}
+
+// sweep stops idle watches, at most twice per idle timeout; callers hold
+// the cache mutex
+func (c *ConsulDiscovery) sweep(now time.Time) {
+    if now.Sub(c.lastSweep) < c.idleTimeout/2 {
+        return
     }
+    c.lastSweep = now
+    for _, w := range c.watches {
+        if c.idle(w, now) {
+            c.stop(w)
+        }
+    }
+}
+
+// idle reports whether a watch has no subscribers and no recent lookups;
+// callers hold the cache mutex
+func (c *ConsulDiscovery) idle(w *consulWatch, now time.Time) bool {
+    return len(w.subscribers) == 0 && now.Sub(w.lastUsed) > c.idleTimeout
+}
+
+// stop cancels a watch and drops its entries; callers hold the cache mutex
+func (c *ConsulDiscovery) stop(w *consulWatch) {
+    w.cancel()
+    if c.watches[w.key] == w {
+        delete(c.watches, w.key)
+        delete(c.serviceCache, w.key)
+    }
+}
+
+// consulQueryKey identifies the parts of a query that Consul evaluates
+func consulQueryKey(q Query) string {
+    tags := append([]string(nil), q.Tags...)
+    sort.Strings(tags)
+    return strings.Join([]string{q.Service, strings.Join(tags, ","), q.Datacenter, q.Namespace}, "|")
+}
+
+// runWatch issues blocking queries for a service until the client is
+// closed or the watch is stopped, updating the cache and notifying
+// subscribers on every change. A watch that became idle stops itself once
+// its blocking query returns.
+func (c *ConsulDiscovery) runWatch(ctx context.Context, w *consulWatch) {
+    name := w.query.Service
+    defer w.cancel()
+    go func() {
+        select {
+        case <-c.closed:
+            w.cancel()
+        case <-ctx.Done():
+        }
+    }()
     
-    // Otherwise query Consul
+    backoff := time.Second
+    first := true
+    for {
+        opts := (&api.QueryOptions{
+            Datacenter: w.query.Datacenter,
+            Namespace:  w.query.Namespace,
+            WaitIndex:  w.index,
+            WaitTime:   c.waitTime,
+        }).WithContext(ctx)
+        entries, meta, err := c.client.Health().ServiceMultipleTags(name, w.query.Tags, true, opts)
+        if ctx.Err() != nil {
+            if first {
+                c.finishFirst(w, nil, fmt.Errorf("consul discovery is closed"))
+            }
+            return
+        }
+        if err != nil {
+            if first {
+                c.finishFirst(w, nil, fmt.Errorf("failed to query Consul for service '%s': %v", name, err))
+                return
+            }
+            log.Printf("Consul watch for service '%s' failed, retrying in %s: %v", name, backoff, err)
+            c.cacheMutex.Lock()
+            w.failure = fmt.Errorf("failed to query Consul for service '%s': %v", name, err)
+            c.cacheMutex.Unlock()
+            select {
+            case <-time.After(backoff):
+            case <-ctx.Done():
+                return
+            }
+            if backoff *= 2; backoff > 30*time.Second {
+                backoff = 30 * time.Second
+            }
+            continue
+        }
+        backoff = time.Second
+        if w.failure != nil {
+            c.cacheMutex.Lock()
+            w.failure = nil
+            c.cacheMutex.Unlock()
+        }
+        
+        // Consul indexes can go backwards, for example after a snapshot
+        // restore; start over from zero when that happens. An index of 0
+        // would not block, so it is raised to 1.
+        index := meta.LastIndex
+        changed := index != w.index
+        if index < w.index {
+            index = 0
+        } else if index == 0 {
+            index = 1
+        }
+        w.index = index
+        if first {
+            c.finishFirst(w, entries, nil)
+            first = false
+            continue
+        }
+        if changed {
+            c.update(w, entries)
+        }
+        
+        c.cacheMutex.Lock()
+        idle := c.idle(w, time.Now())
+        if idle {
+            c.stop(w)
+        }
+        c.cacheMutex.Unlock()
+        if idle {
+            return
+        }
+    }
+}
+
+// finishFirst stores the result of the first query and releases the
+// lookups waiting for it
+func (c *ConsulDiscovery) finishFirst(w *consulWatch, entries []*api.ServiceEntry, err error) {
+    c.cacheMutex.Lock()
+    if err == nil {
+        c.serviceCache[w.key] = entries
+    } else {
+        w.err = err
+    }
+    c.cacheMutex.Unlock()
+    close(w.ready)
+}
+
+// update replaces the cached entries of a service and pushes the new
+// instances to its subscribers
+func (c *ConsulDiscovery) update(w *consulWatch, entries []*api.ServiceEntry) {
     c.cacheMutex.Lock()
     defer c.cacheMutex.Unlock()
     
-    // Check again after acquiring the lock
-    if entries, exists := c.serviceCache[name]; exists && time.Since(c.lastCacheTime[name]) < c.cacheExpiry {
-        return entries, nil
+    c.serviceCache[w.key] = entries
+    instances := instancesFromEntries(entries)
+    for ch := range w.subscribers {
+        notify(ch, instances)
     }
-    
-    entries, _, err := c.client.Health().Service(name, "", true, nil)
-    if err != nil {
-        return nil, fmt.Errorf("failed to query Consul for service '%s': %v", name, err)
+}
+
+// notify delivers instances to a subscriber channel with a buffer of one,
+// replacing an update the subscriber has not received yet
+func notify(ch chan []Instance, instances []Instance) {
+    select {
+    case <-ch:
+    default:
+    }
+    ch <- append([]Instance(nil), instances...)
+}
+
+// instancesFromEntries converts Consul health entries to instances
+func instancesFromEntries(entries []*api.ServiceEntry) []Instance {
+    instances := make([]Instance, 0, len(entries))
+    for _, entry := range entries {
+        instances = append(instances, instanceFromEntry(entry))
+    }
+    return instances
+}
+
+// Watch returns a channel that receives the passing instances of a service
+// immediately and again whenever they change. A subscriber that falls behind
+// only receives the latest instances. The channel is closed when ctx is
+// done or the client is closed.
+func (c *ConsulDiscovery) Watch(ctx context.Context, name string) (<-chan []Instance, error) {
+    w := c.watch(Query{Service: name})
+    select {
+    case <-w.ready:
+    case <-ctx.Done():
+        return nil, ctx.Err()
     }
     
-    c.serviceCache[name] = entries
-    c.lastCacheTime[name] = time.Now()
+    ch := make(chan []Instance, 1)
+    c.cacheMutex.Lock()
+    if w.err != nil {
+        c.cacheMutex.Unlock()
+        return nil, w.err
+    }
+    w.subscribers[ch] = struct{}{}
+    notify(ch, instancesFromEntries(c.serviceCache[w.key]))
+    c.cacheMutex.Unlock()
     
-    return entries, nil
+    go func() {
+        select {
+        case <-ctx.Done():
+        case <-c.closed:
+        }
+        c.cacheMutex.Lock()
+        delete(w.subscribers, ch)
+        close(ch)
+        c.cacheMutex.Unlock()
+    }()
+    return ch, nil
+}
+
+// Close stops all watches and closes the subscriber channels
+func (c *ConsulDiscovery) Close() error {
+    c.closeOnce.Do(func() { close(c.closed) })
+    return nil
 }
 
 // RegisterService registers a service with Consul
@@ -106,4 +450,72 @@ func (c *ConsulDiscovery) RegisterService(name, address string, port int) error
 // DeregisterService deregisters a service from Consul
 func (c *ConsulDiscovery) DeregisterService(serviceID string) error {
     return c.client.Agent().ServiceDeregister(serviceID)
+}
+
+// Register registers an instance with the local Consul agent, with the same
+// HTTP health check as RegisterService
+func (c *ConsulDiscovery) Register(ctx context.Context, instance Instance) error {
+    return c.RegisterWithCheck(ctx, instance, HealthCheck{Type: CheckHTTP})
+}
+
+// RegisterWithCheck registers an instance with the local Consul agent and
+// the given health check, whose Consul check ID is CheckID(instance ID)
+func (c *ConsulDiscovery) RegisterWithCheck(ctx context.Context, instance Instance, check HealthCheck) error {
+    id := instance.ID
+    if id == "" {
+        id = fmt.Sprintf("%s-%s-%d", instance.Service, instance.Address, instance.Port)
+    }
+    instance.ID = id
+    service := &api.AgentServiceRegistration{
+        ID:      id,
+        Name:    instance.Service,
+        Address: instance.Address,
+        Port:    instance.Port,
+        Tags:    instance.Tags,
+        Meta:    instance.Meta,
+    }
+    
+    if check.Type != CheckNone {
+        check = check.withDefaults(instance)
+        agentCheck := &api.AgentServiceCheck{
+            CheckID: CheckID(id),
+            Name:    fmt.Sprintf("%s %s check", instance.Service, check.Type),
+        }
+        switch check.Type {
+        case CheckHTTP:
+            agentCheck.HTTP = check.Target
+        case CheckGRPC:
+            agentCheck.GRPC = check.Target
+        case CheckTCP:
+            agentCheck.TCP = check.Target
+        case CheckTTL:
+            agentCheck.TTL = check.TTL.String()
+        default:
+            return fmt.Errorf("unknown health check type: %s", check.Type)
+        }
+        if check.Type != CheckTTL {
+            agentCheck.Interval = check.Interval.String()
+            agentCheck.Timeout = check.Timeout.String()
+        }
+        if check.DeregisterCriticalAfter > 0 {
+            agentCheck.DeregisterCriticalServiceAfter = check.DeregisterCriticalAfter.String()
+        }
+        service.Check = agentCheck
+    }
+    
+    return c.client.Agent().ServiceRegisterOpts(service, api.ServiceRegisterOpts{}.WithContext(ctx))
+}
+
+// UpdateTTL reports the status of an instance's TTL check to the agent
+func (c *ConsulDiscovery) UpdateTTL(ctx context.Context, id string, healthy bool, output string) error {
+    status := api.HealthPassing
+    if !healthy {
+        status = api.HealthCritical
+    }
+    return c.client.Agent().UpdateTTLOpts(CheckID(id), output, status, (&api.QueryOptions{}).WithContext(ctx))
+}
+
+// Deregister deregisters an instance from the local Consul agent
+func (c *ConsulDiscovery) Deregister(ctx context.Context, id string) error {
+    return c.client.Agent().ServiceDeregisterOpts(id, (&api.QueryOptions{}).WithContext(ctx))
 }
\ No newline at end of file
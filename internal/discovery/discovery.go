@@ -1,22 +1,62 @@
 package discovery
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"net"
+	"strconv"
 )
 
-// DiscoverService finds the service in the registry
-func DiscoverService(serviceName string) (string, error) {
-	// This is a placeholder. You can use Consul, Etcd, or Kubernetes DNS.
-	// Assuming the service is found at http://localhost:8080
-	return fmt.Sprintf("http://localhost:8080/%s", serviceName), nil
+// Instance is a single reachable instance of a service
+type Instance struct {
+	ID      string            `json:"id,omitempty"`
+	Service string            `json:"service,omitempty"`
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Tags    []string          `json:"tags,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
 }
 
-// ServiceResolver resolves the service URL dynamically
-func ServiceResolver(serviceName string) string {
-	url, err := DiscoverService(serviceName)
-	if err != nil {
-		log.Fatalf("Failed to resolve service: %v", err)
-	}
-	return url
+// HostPort returns the instance address as host:port
+func (i Instance) HostPort() string {
+	return net.JoinHostPort(i.Address, strconv.Itoa(i.Port))
+}
+
+// URL returns the base HTTP URL of the instance
+func (i Instance) URL() string {
+	return fmt.Sprintf("http://%s", i.HostPort())
+}
+
+// Resolver looks up the instances of a service
+type Resolver interface {
+	// Resolve returns the healthy instances of a service
+	Resolve(ctx context.Context, service string) ([]Instance, error)
+}
+
+// Registry registers service instances so that a Resolver can find them
+type Registry interface {
+	// Register adds or updates an instance of a service
+	Register(ctx context.Context, instance Instance) error
+	// Deregister removes an instance by ID
+	Deregister(ctx context.Context, id string) error
+}
+
+// Watcher pushes the instances of a service as they change
+type Watcher interface {
+	// Watch returns a channel that receives the current instances of a
+	// service and then every change, until ctx is done
+	Watch(ctx context.Context, service string) (<-chan []Instance, error)
+}
+
+// ErrWatchNotSupported is returned by Watch when the backend cannot watch
+var ErrWatchNotSupported = errors.New("discovery backend does not support watches")
+
+// NoInstancesError is returned when a service has no known instances
+type NoInstancesError struct {
+	Service string
+}
+
+func (e *NoInstancesError) Error() string {
+	return fmt.Sprintf("no instances of service '%s' found", e.Service)
 }
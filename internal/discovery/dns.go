@@ -0,0 +1,251 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSConfig holds configuration for DNS service discovery
+type DNSConfig struct {
+	Server      string        // DNS server as host:port (default first nameserver in /etc/resolv.conf)
+	Domain      string        // Suffix appended to service names, e.g. "default.svc.cluster.local"
+	PortName    string        // When set, SRV records are looked up at _<PortName>._<Protocol>.<name>
+	Protocol    string        // SRV protocol label used with PortName (default tcp)
+	DefaultPort int           // Port for instances found through A/AAAA records (default 80)
+	Timeout     time.Duration // Timeout of a single DNS exchange (default 2s)
+}
+
+// DNSResolver resolves services through DNS. A service name is first looked
+// up as an SRV record, which gives both addresses and ports, as published by
+// Consul DNS or for the named ports of Kubernetes headless services. When
+// there is no SRV record the name is resolved through A and AAAA records and
+// every address gets the default port, which covers plain headless services.
+//
+// Answers are cached for the smallest TTL among the records that produced
+// them. SRV priority and weight are exposed through the "priority" and
+// "weight" instance metadata, and instances are ordered by priority.
+type DNSResolver struct {
+	config    DNSConfig
+	client    *dns.Client
+	tcpClient *dns.Client // Used again when a UDP answer is truncated
+
+	mutex sync.Mutex
+	cache map[string]dnsCacheEntry
+}
+
+// dnsCacheEntry is a resolved service and when it expires
+type dnsCacheEntry struct {
+	instances []Instance
+	expires   time.Time
+}
+
+var _ Resolver = (*DNSResolver)(nil)
+
+// NewDNSResolver creates a new DNS resolver
+func NewDNSResolver(config DNSConfig) (*DNSResolver, error) {
+	if config.Server == "" {
+		clientConfig, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil || len(clientConfig.Servers) == 0 {
+			return nil, fmt.Errorf("no DNS server configured and none found in /etc/resolv.conf")
+		}
+		config.Server = net.JoinHostPort(clientConfig.Servers[0], clientConfig.Port)
+	}
+	if config.Protocol == "" {
+		config.Protocol = "tcp"
+	}
+	if config.DefaultPort <= 0 {
+		config.DefaultPort = 80
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 2 * time.Second
+	}
+
+	return &DNSResolver{
+		config:    config,
+		client:    &dns.Client{Timeout: config.Timeout},
+		tcpClient: &dns.Client{Net: "tcp", Timeout: config.Timeout},
+		cache:     make(map[string]dnsCacheEntry),
+	}, nil
+}
+
+// Resolve returns the instances of a service, from the cache while the
+// records' TTL has not expired
+func (r *DNSResolver) Resolve(ctx context.Context, service string) ([]Instance, error) {
+	r.mutex.Lock()
+	entry, ok := r.cache[service]
+	r.mutex.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return append([]Instance(nil), entry.instances...), nil
+	}
+
+	instances, ttl, err := r.lookup(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, &NoInstancesError{Service: service}
+	}
+
+	r.mutex.Lock()
+	r.cache[service] = dnsCacheEntry{
+		instances: instances,
+		expires:   time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	r.mutex.Unlock()
+	return append([]Instance(nil), instances...), nil
+}
+
+// fqdn returns the fully qualified DNS name of a service
+func (r *DNSResolver) fqdn(service string) string {
+	name := service
+	if r.config.Domain != "" && !strings.HasSuffix(name, ".") {
+		name = name + "." + strings.Trim(r.config.Domain, ".")
+	}
+	return dns.Fqdn(name)
+}
+
+// lookup queries SRV records for a service, falling back to A and AAAA
+// records. It returns the instances and the smallest TTL of the records.
+func (r *DNSResolver) lookup(ctx context.Context, service string) ([]Instance, uint32, error) {
+	name := r.fqdn(service)
+	srvName := name
+	if r.config.PortName != "" {
+		srvName = fmt.Sprintf("_%s._%s.%s", r.config.PortName, r.config.Protocol, name)
+	}
+
+	srv, err := r.exchange(ctx, srvName, dns.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var records []*dns.SRV
+	for _, rr := range srv.Answer {
+		if record, ok := rr.(*dns.SRV); ok {
+			records = append(records, record)
+		}
+	}
+	if len(records) > 0 {
+		return r.fromSRV(ctx, service, records, srv.Extra)
+	}
+
+	var instances []Instance
+	ttl := uint32(0)
+	first := true
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		resp, err := r.exchange(ctx, name, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, rr := range resp.Answer {
+			addr := addressOf(rr)
+			if addr == "" {
+				continue
+			}
+			if first || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				first = false
+			}
+			instances = append(instances, Instance{
+				ID:      fmt.Sprintf("%s-%s-%d", service, addr, r.config.DefaultPort),
+				Service: service,
+				Address: addr,
+				Port:    r.config.DefaultPort,
+			})
+		}
+	}
+	return instances, ttl, nil
+}
+
+// fromSRV turns SRV records into instances, resolving each target from the
+// additional section of the response or with a separate A/AAAA query
+func (r *DNSResolver) fromSRV(ctx context.Context, service string, records []*dns.SRV, extra []dns.RR) ([]Instance, uint32, error) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Priority < records[j].Priority
+	})
+
+	glue := make(map[string][]dns.RR)
+	for _, rr := range extra {
+		if addressOf(rr) != "" {
+			name := strings.ToLower(rr.Header().Name)
+			glue[name] = append(glue[name], rr)
+		}
+	}
+
+	var instances []Instance
+	ttl := records[0].Hdr.Ttl
+	for _, record := range records {
+		if record.Hdr.Ttl < ttl {
+			ttl = record.Hdr.Ttl
+		}
+		target := strings.ToLower(record.Target)
+		addrs := glue[target]
+		if len(addrs) == 0 {
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				resp, err := r.exchange(ctx, record.Target, qtype)
+				if err != nil {
+					return nil, 0, err
+				}
+				addrs = append(addrs, resp.Answer...)
+			}
+		}
+		for _, rr := range addrs {
+			addr := addressOf(rr)
+			if addr == "" {
+				continue
+			}
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+			instances = append(instances, Instance{
+				ID:      fmt.Sprintf("%s-%s-%d", service, addr, record.Port),
+				Service: service,
+				Address: addr,
+				Port:    int(record.Port),
+				Meta: map[string]string{
+					"priority": strconv.Itoa(int(record.Priority)),
+					"weight":   strconv.Itoa(int(record.Weight)),
+				},
+			})
+		}
+	}
+	return instances, ttl, nil
+}
+
+// exchange sends a single query, treating NXDOMAIN as an empty answer. A
+// truncated UDP answer, as sent for services with many instances, is
+// queried again over TCP.
+func (r *DNSResolver) exchange(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(name, qtype)
+	resp, _, err := r.client.ExchangeContext(ctx, query, r.config.Server)
+	if err == nil && resp.Truncated {
+		resp, _, err = r.tcpClient.ExchangeContext(ctx, query, r.config.Server)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DNS query for %s failed: %v", name, err)
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		return resp, nil
+	default:
+		return nil, fmt.Errorf("DNS query for %s failed: %s", name, dns.RcodeToString[resp.Rcode])
+	}
+}
+
+// addressOf returns the IP address of an A or AAAA record
+func addressOf(rr dns.RR) string {
+	switch record := rr.(type) {
+	case *dns.A:
+		return record.A.String()
+	case *dns.AAAA:
+		return record.AAAA.String()
+	}
+	return ""
+}
@@ -0,0 +1,355 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdConfig holds configuration for etcd service discovery
+type EtcdConfig struct {
+	Endpoints   []string      // etcd client endpoints
+	Prefix      string        // Key prefix for registrations (default /microcomms/services)
+	TTL         time.Duration // Lease TTL of registrations (default 10s)
+	DialTimeout time.Duration // Timeout for connecting to etcd (default 5s)
+}
+
+// EtcdDiscovery implements service registration and discovery using etcd.
+// Each instance is stored as JSON under <prefix>/<service>/<id>, attached to
+// a lease that is kept alive for as long as the instance is registered, so
+// instances of a crashed process disappear once their lease expires.
+// Resolved services are cached and kept current by a prefix watch.
+type EtcdDiscovery struct {
+	client *clientv3.Client
+	config EtcdConfig
+
+	mutex         sync.Mutex
+	registrations map[string]*etcdRegistration // instance ID -> keepalive
+	services      map[string]*etcdService
+	closed        bool
+}
+
+// etcdRegistration is the keepalive goroutine of a registered instance
+type etcdRegistration struct {
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once the lease has been revoked
+}
+
+// etcdService is the watched view of one service
+type etcdService struct {
+	instances map[string]Instance // key -> instance
+	ready     chan struct{}       // Closed once the initial load completed
+	err       error               // Error of the initial load, if any
+	cancel    context.CancelFunc
+}
+
+var (
+	_ Resolver = (*EtcdDiscovery)(nil)
+	_ Registry = (*EtcdDiscovery)(nil)
+)
+
+// NewEtcdDiscovery creates a new etcd discovery client
+func NewEtcdDiscovery(config EtcdConfig) (*EtcdDiscovery, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, fmt.Errorf("at least one etcd endpoint is required")
+	}
+	if config.Prefix == "" {
+		config.Prefix = "/microcomms/services"
+	}
+	if config.TTL <= 0 {
+		config.TTL = 10 * time.Second
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   config.Endpoints,
+		DialTimeout: config.DialTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create etcd client: %v", err)
+	}
+
+	return &EtcdDiscovery{
+		client:        client,
+		config:        config,
+		registrations: make(map[string]*etcdRegistration),
+		services:      make(map[string]*etcdService),
+	}, nil
+}
+
+// serviceKey returns the key prefix holding the instances of a service
+func (e *EtcdDiscovery) serviceKey(service string) string {
+	return path.Join(e.config.Prefix, service) + "/"
+}
+
+// Register stores the instance under a lease and keeps the lease alive
+// until Deregister or Close. If the lease is lost, for example after a long
+// partition from etcd, the instance is registered again under a new lease.
+func (e *EtcdDiscovery) Register(ctx context.Context, instance Instance) error {
+	if instance.Service == "" {
+		return fmt.Errorf("instance service name is required")
+	}
+	if instance.ID == "" {
+		instance.ID = fmt.Sprintf("%s-%s-%d", instance.Service, instance.Address, instance.Port)
+	}
+	value, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	key := e.serviceKey(instance.Service) + instance.ID
+
+	keepAlive, err := e.putWithLease(ctx, key, string(value))
+	if err != nil {
+		return fmt.Errorf("failed to register '%s' with etcd: %v", instance.ID, err)
+	}
+
+	regCtx, cancel := context.WithCancel(context.Background())
+	e.mutex.Lock()
+	if e.closed {
+		e.mutex.Unlock()
+		cancel()
+		return fmt.Errorf("etcd discovery is closed")
+	}
+	if previous, ok := e.registrations[instance.ID]; ok {
+		previous.cancel()
+	}
+	reg := &etcdRegistration{cancel: cancel, done: make(chan struct{})}
+	e.registrations[instance.ID] = reg
+	e.mutex.Unlock()
+
+	go func() {
+		defer close(reg.done)
+		e.keepAlive(regCtx, key, string(value), keepAlive)
+	}()
+	return nil
+}
+
+// putWithLease grants a new lease and stores key under it
+func (e *EtcdDiscovery) putWithLease(ctx context.Context, key, value string) (clientv3.LeaseID, error) {
+	ttl := int64(e.config.TTL.Seconds())
+	if ttl < 1 {
+		ttl = 1
+	}
+	lease, err := e.client.Grant(ctx, ttl)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := e.client.Put(ctx, key, value, clientv3.WithLease(lease.ID)); err != nil {
+		return 0, err
+	}
+	return lease.ID, nil
+}
+
+// keepAlive renews the registration lease, re-registering if it is lost,
+// and revokes it once the registration is cancelled
+func (e *EtcdDiscovery) keepAlive(ctx context.Context, key, value string, lease clientv3.LeaseID) {
+	for {
+		responses, err := e.client.KeepAlive(ctx, lease)
+		if err == nil {
+			for range responses {
+			}
+		}
+
+		if ctx.Err() != nil {
+			revokeCtx, cancel := context.WithTimeout(context.Background(), e.config.DialTimeout)
+			e.client.Revoke(revokeCtx, lease)
+			cancel()
+			return
+		}
+
+		log.Printf("Lost etcd lease for %s, registering again", key)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			putCtx, cancel := context.WithTimeout(ctx, e.config.DialTimeout)
+			lease, err = e.putWithLease(putCtx, key, value)
+			cancel()
+			if err == nil {
+				break
+			}
+			log.Printf("Failed to register %s with etcd again: %v", key, err)
+		}
+	}
+}
+
+// Deregister stops keeping the instance's lease alive and revokes it, which
+// deletes the registration. It returns once the lease is revoked or ctx is
+// done.
+func (e *EtcdDiscovery) Deregister(ctx context.Context, id string) error {
+	e.mutex.Lock()
+	reg, ok := e.registrations[id]
+	delete(e.registrations, id)
+	e.mutex.Unlock()
+
+	if ok {
+		reg.cancel()
+		select {
+		case <-reg.done:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("failed to deregister '%s' from etcd: %v", id, ctx.Err())
+		}
+	}
+
+	// Not registered by this process: delete the key directly
+	resp, err := e.client.Get(ctx, e.config.Prefix+"/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return fmt.Errorf("failed to deregister '%s' from etcd: %v", id, err)
+	}
+	for _, kv := range resp.Kvs {
+		if path.Base(string(kv.Key)) == id {
+			if _, err := e.client.Delete(ctx, string(kv.Key)); err != nil {
+				return fmt.Errorf("failed to deregister '%s' from etcd: %v", id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Resolve returns the registered instances of a service. The first call for
+// a service loads its instances and starts a watch that keeps them current.
+func (e *EtcdDiscovery) Resolve(ctx context.Context, name string) ([]Instance, error) {
+	e.mutex.Lock()
+	if e.closed {
+		e.mutex.Unlock()
+		return nil, fmt.Errorf("etcd discovery is closed")
+	}
+	svc, ok := e.services[name]
+	if !ok {
+		svc = &etcdService{
+			instances: make(map[string]Instance),
+			ready:     make(chan struct{}),
+		}
+		e.services[name] = svc
+		go e.watchService(name, svc)
+	}
+	e.mutex.Unlock()
+
+	select {
+	case <-svc.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if svc.err != nil {
+		if e.services[name] == svc {
+			delete(e.services, name)
+		}
+		return nil, svc.err
+	}
+	instances := make([]Instance, 0, len(svc.instances))
+	for _, instance := range svc.instances {
+		instances = append(instances, instance)
+	}
+	if len(instances) == 0 {
+		return nil, &NoInstancesError{Service: name}
+	}
+	sortInstances(instances)
+	return instances, nil
+}
+
+// sortInstances orders instances by ID so that results do not depend on map
+// iteration order
+func sortInstances(instances []Instance) {
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].ID < instances[j].ID
+	})
+}
+
+// watchService loads the instances of a service and applies changes from a
+// prefix watch starting right after the loaded revision
+func (e *EtcdDiscovery) watchService(name string, svc *etcdService) {
+	prefix := e.serviceKey(name)
+
+	loadCtx, cancel := context.WithTimeout(context.Background(), e.config.DialTimeout)
+	resp, err := e.client.Get(loadCtx, prefix, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		e.mutex.Lock()
+		svc.err = fmt.Errorf("failed to query etcd for service '%s': %v", name, err)
+		e.mutex.Unlock()
+		close(svc.ready)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.mutex.Lock()
+	for _, kv := range resp.Kvs {
+		var instance Instance
+		if err := json.Unmarshal(kv.Value, &instance); err == nil {
+			svc.instances[string(kv.Key)] = instance
+		}
+	}
+	svc.cancel = cancel
+	e.mutex.Unlock()
+	close(svc.ready)
+
+	revision := resp.Header.Revision + 1
+	for watchResp := range e.client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(revision)) {
+		if err := watchResp.Err(); err != nil {
+			log.Printf("etcd watch for service '%s' failed: %v", name, err)
+			break
+		}
+		e.mutex.Lock()
+		for _, event := range watchResp.Events {
+			key := string(event.Kv.Key)
+			switch event.Type {
+			case clientv3.EventTypePut:
+				var instance Instance
+				if err := json.Unmarshal(event.Kv.Value, &instance); err == nil {
+					svc.instances[key] = instance
+				}
+			case clientv3.EventTypeDelete:
+				delete(svc.instances, key)
+			}
+		}
+		e.mutex.Unlock()
+	}
+
+	// The watch was closed, compacted or interrupted: forget the service so
+	// that the next Resolve loads it again
+	cancel()
+	e.mutex.Lock()
+	if e.services[name] == svc {
+		delete(e.services, name)
+	}
+	e.mutex.Unlock()
+}
+
+// Close deregisters every instance registered by this client, stops the
+// watches and closes the etcd connection
+func (e *EtcdDiscovery) Close() error {
+	e.mutex.Lock()
+	e.closed = true
+	registrations := e.registrations
+	e.registrations = make(map[string]*etcdRegistration)
+	for _, svc := range e.services {
+		if svc.cancel != nil {
+			svc.cancel()
+		}
+	}
+	e.mutex.Unlock()
+
+	for _, reg := range registrations {
+		reg.cancel()
+	}
+	// Revocations are bounded by the dial timeout
+	for _, reg := range registrations {
+		<-reg.done
+	}
+	return e.client.Close()
+}
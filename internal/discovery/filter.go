@@ -0,0 +1,241 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Metadata keys read by instance filtering
+const (
+	VersionMetaKey    = "version"
+	DatacenterMetaKey = "datacenter"
+	ZoneMetaKey       = "zone"
+)
+
+// Query selects the instances of a service
+type Query struct {
+	Service    string
+	Tags       []string          // Instances must have all of these tags
+	Meta       map[string]string // Instances must have these metadata values
+	Datacenter string            // Datacenter to query (Consul) or match against the "datacenter" metadata
+	Namespace  string            // Namespace to query, for registries that have them
+	Version    string            // Constraint on the "version" metadata, e.g. ">=1.2, <2"
+}
+
+// QueryResolver is a Resolver that can evaluate queries itself
+type QueryResolver interface {
+	Resolver
+	// ResolveQuery returns the healthy instances matching a query
+	ResolveQuery(ctx context.Context, q Query) ([]Instance, error)
+}
+
+// ResolveQuery resolves a query with r, evaluating the filters on the
+// resolved instances when r cannot evaluate them itself
+func ResolveQuery(ctx context.Context, r Resolver, q Query) ([]Instance, error) {
+	if qr, ok := r.(QueryResolver); ok {
+		return qr.ResolveQuery(ctx, q)
+	}
+	instances, err := r.Resolve(ctx, q.Service)
+	if err != nil {
+		return nil, err
+	}
+	instances, err = FilterInstances(instances, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, &NoInstancesError{Service: q.Service}
+	}
+	return instances, nil
+}
+
+// FilterInstances returns the instances matching the tags, metadata,
+// datacenter and version of a query. Namespaces are left to the registry.
+func FilterInstances(instances []Instance, q Query) ([]Instance, error) {
+	var constraints []versionConstraint
+	if q.Version != "" {
+		var err error
+		if constraints, err = parseVersionConstraints(q.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	filtered := make([]Instance, 0, len(instances))
+	for _, instance := range instances {
+		if matchesQuery(instance, q, constraints) {
+			filtered = append(filtered, instance)
+		}
+	}
+	return filtered, nil
+}
+
+// matchesQuery reports whether an instance passes the filters of a query
+func matchesQuery(instance Instance, q Query, constraints []versionConstraint) bool {
+	for _, tag := range q.Tags {
+		found := false
+		for _, t := range instance.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range q.Meta {
+		if instance.Meta[k] != v {
+			return false
+		}
+	}
+	if q.Datacenter != "" && instance.Meta[DatacenterMetaKey] != q.Datacenter {
+		return false
+	}
+	if len(constraints) > 0 {
+		version, ok := parseVersion(instance.Meta[VersionMetaKey])
+		if !ok {
+			return false
+		}
+		for _, c := range constraints {
+			if !c.matches(version) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// versionConstraint is a single comparison such as ">=1.2"
+type versionConstraint struct {
+	op      string
+	version [3]int
+}
+
+// parseVersionConstraints parses comma-separated constraints using the
+// operators =, !=, >, >=, < and <=; a bare version means =
+func parseVersionConstraints(s string) ([]versionConstraint, error) {
+	var constraints []versionConstraint
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		op := "="
+		for _, candidate := range []string{">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(part, candidate) {
+				op = candidate
+				part = strings.TrimSpace(part[len(candidate):])
+				break
+			}
+		}
+		version, ok := parseVersion(part)
+		if !ok {
+			return nil, fmt.Errorf("invalid version constraint '%s'", s)
+		}
+		constraints = append(constraints, versionConstraint{op: op, version: version})
+	}
+	return constraints, nil
+}
+
+// parseVersion parses "1", "1.2" or "v1.2.3", ignoring any pre-release or
+// build suffix
+func parseVersion(s string) ([3]int, bool) {
+	var version [3]int
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if s == "" || len(parts) > 3 {
+		return version, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return version, false
+		}
+		version[i] = n
+	}
+	return version, true
+}
+
+// matches reports whether a version satisfies the constraint
+func (c versionConstraint) matches(version [3]int) bool {
+	cmp := 0
+	for i := range version {
+		if version[i] != c.version[i] {
+			if version[i] < c.version[i] {
+				cmp = -1
+			} else {
+				cmp = 1
+			}
+			break
+		}
+	}
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case "!=":
+		return cmp != 0
+	default:
+		return cmp == 0
+	}
+}
+
+// ZoneConfig holds configuration for zone-aware routing
+type ZoneConfig struct {
+	Zone    string // Zone of this process; zone-aware routing is off when empty
+	MetaKey string // Instance metadata key holding the zone (default "zone")
+	// SpilloverPercent is the share of a zone's instances that must be
+	// healthy to keep traffic in the zone (default 50)
+	SpilloverPercent int
+	// MinInstances is the number of healthy instances the zone needs to keep
+	// traffic in the zone (default 1)
+	MinInstances int
+}
+
+// PreferZone keeps traffic in the caller's zone while the zone has enough
+// healthy capacity. all are the instances known to discovery and healthy
+// the subset currently fit for traffic, e.g. after outlier ejection. When
+// fewer than MinInstances or SpilloverPercent of the zone's instances are
+// healthy, every healthy instance is returned so that traffic spills over
+// to other zones.
+func (z ZoneConfig) PreferZone(all, healthy []Instance) []Instance {
+	if z.Zone == "" {
+		return healthy
+	}
+	key := z.MetaKey
+	if key == "" {
+		key = ZoneMetaKey
+	}
+	spillover := z.SpilloverPercent
+	if spillover <= 0 {
+		spillover = 50
+	}
+	minInstances := z.MinInstances
+	if minInstances <= 0 {
+		minInstances = 1
+	}
+
+	zoneTotal := 0
+	for _, instance := range all {
+		if instance.Meta[key] == z.Zone {
+			zoneTotal++
+		}
+	}
+	var local []Instance
+	for _, instance := range healthy {
+		if instance.Meta[key] == z.Zone {
+			local = append(local, instance)
+		}
+	}
+	if len(local) < minInstances || len(local)*100 < spillover*zoneTotal {
+		return healthy
+	}
+	return local
+}
@@ -0,0 +1,129 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ConsistentHash routes requests with the same hash key to the same instance
+const ConsistentHash BalancerStrategy = "consistent_hash"
+
+// ringReplicas is the number of points each unit of instance weight gets on
+// the hash ring; more points spread keys more evenly
+const ringReplicas = 100
+
+type hashKeyContextKey struct{}
+
+// WithHashKey returns a context carrying the key that the consistent-hash
+// balancer routes on, such as a user or tenant ID
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyContextKey{}, key)
+}
+
+// HashKeyFromContext returns the hash key carried by ctx, if any
+func HashKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(hashKeyContextKey{}).(string)
+	return key, ok && key != ""
+}
+
+// hashBalancer places instances on a hash ring with ringReplicas points per
+// unit of weight (see WeightMetaKey) and sends each key to the first
+// instance clockwise from the key's hash. When an instance joins or leaves,
+// only the keys on its arcs of the ring move. Requests without a hash key
+// are balanced round-robin.
+type hashBalancer struct {
+	fallback roundRobinBalancer
+
+	mutex     sync.Mutex
+	signature string // Instance IDs and weights the ring was built from
+	ring      []ringPoint
+}
+
+// ringPoint is a point on the hash ring owned by an instance
+type ringPoint struct {
+	hash uint64
+	id   string
+}
+
+func (b *hashBalancer) Pick(ctx context.Context, instances []Instance) (Instance, DoneFunc, error) {
+	if len(instances) == 0 {
+		return Instance{}, nil, fmt.Errorf("no instances to pick from")
+	}
+	key, ok := HashKeyFromContext(ctx)
+	if !ok {
+		return b.fallback.Pick(ctx, instances)
+	}
+
+	b.mutex.Lock()
+	ring := b.ringFor(instances)
+	b.mutex.Unlock()
+	if len(ring) == 0 {
+		return b.fallback.Pick(ctx, instances)
+	}
+
+	h := hashString(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	for _, instance := range instances {
+		if instance.ID == ring[i].id {
+			return instance, noopDone, nil
+		}
+	}
+	return Instance{}, nil, fmt.Errorf("hash ring out of sync with instances")
+}
+
+// ringFor returns the ring for instances, rebuilding it when the set of
+// instances or their weights changed; callers hold the mutex
+func (b *hashBalancer) ringFor(instances []Instance) []ringPoint {
+	parts := make([]string, len(instances))
+	for i, instance := range instances {
+		parts[i] = instance.ID + "=" + strconv.Itoa(instanceWeight(instance))
+	}
+	sort.Strings(parts)
+	signature := strings.Join(parts, ",")
+	if signature == b.signature && b.ring != nil {
+		return b.ring
+	}
+
+	ring := make([]ringPoint, 0, len(instances)*ringReplicas)
+	for _, instance := range instances {
+		points := instanceWeight(instance) * ringReplicas
+		for r := 0; r < points; r++ {
+			ring = append(ring, ringPoint{
+				hash: hashString(instance.ID + "#" + strconv.Itoa(r)),
+				id:   instance.ID,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].id < ring[j].id
+	})
+
+	b.signature = signature
+	b.ring = ring
+	return ring
+}
+
+// hashString hashes s with FNV-1a followed by a 64-bit finalizer, so that
+// similar strings such as consecutive replica names spread over the ring
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
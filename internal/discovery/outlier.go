@@ -0,0 +1,251 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// OutlierConfig holds configuration for passive outlier detection
+type OutlierConfig struct {
+	Consecutive5xx           int           // 5xx responses in a row that eject an instance (default 5)
+	ConsecutiveGatewayErrors int           // 502/503/504 or connection errors in a row that eject an instance (default 3)
+	LatencyFactor            float64       // Eject instances slower than this multiple of the median latency (default 3, negative disables)
+	LatencyMinRequests       int           // Requests an instance needs before its latency is judged (default 20)
+	BaseEjectionTime         time.Duration // First ejection time, doubled on every further ejection (default 30s)
+	MaxEjectionTime          time.Duration // Upper bound of the ejection time (default 5m)
+	MaxEjectionPercent       int           // Most instances of a service that may be ejected at once (default 50)
+}
+
+// Outcome is the result of one request to an instance
+type Outcome struct {
+	StatusCode int           // HTTP status code, 0 if no response was received
+	Err        error         // Transport error, if any
+	Latency    time.Duration // Time until the response or error
+}
+
+// OutlierDetector tracks the outcomes of real traffic per instance and
+// temporarily ejects instances that misbehave: after consecutive 5xx
+// responses, after consecutive gateway errors (502, 503, 504 or no response
+// at all), or when their latency is far above the median of their peers.
+// Each ejection of an instance lasts twice as long as the previous one, up
+// to MaxEjectionTime; an instance that stays healthy for MaxEjectionTime
+// after returning starts over at BaseEjectionTime.
+type OutlierDetector struct {
+	config    OutlierConfig
+	ejections metric.Int64Counter
+
+	mutex     sync.Mutex
+	instances map[string]*instanceStats
+}
+
+// instanceStats is the traffic history of one instance
+type instanceStats struct {
+	service        string
+	consecutive5xx int
+	consecutiveGW  int
+	latency        float64 // Moving average in seconds
+	requests       int
+	ejectedUntil   time.Time
+	ejectedAt      time.Time
+	ejections      int // Ejections so far, drives the ejection time
+}
+
+// latencyWeight is the weight of a new sample in the latency moving average
+const latencyWeight = 0.1
+
+// NewOutlierDetector creates an outlier detector
+func NewOutlierDetector(config OutlierConfig) (*OutlierDetector, error) {
+	if config.Consecutive5xx <= 0 {
+		config.Consecutive5xx = 5
+	}
+	if config.ConsecutiveGatewayErrors <= 0 {
+		config.ConsecutiveGatewayErrors = 3
+	}
+	if config.LatencyFactor == 0 {
+		config.LatencyFactor = 3
+	}
+	if config.LatencyMinRequests <= 0 {
+		config.LatencyMinRequests = 20
+	}
+	if config.BaseEjectionTime <= 0 {
+		config.BaseEjectionTime = 30 * time.Second
+	}
+	if config.MaxEjectionTime <= 0 {
+		config.MaxEjectionTime = 5 * time.Minute
+	}
+	if config.MaxEjectionPercent <= 0 {
+		config.MaxEjectionPercent = 50
+	}
+
+	counter, err := otel.Meter("github.com/pramithamj/microcomms").Int64Counter(
+		"microcomms.discovery.ejections",
+		metric.WithDescription("Instances ejected from load balancing by outlier detection"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &OutlierDetector{
+		config:    config,
+		ejections: counter,
+		instances: make(map[string]*instanceStats),
+	}, nil
+}
+
+// Report records the outcome of a request to an instance
+func (d *OutlierDetector) Report(instance Instance, outcome Outcome) {
+	// A request cancelled by the caller says nothing about the instance
+	if errors.Is(outcome.Err, context.Canceled) {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	stats, ok := d.instances[instance.ID]
+	if !ok {
+		stats = &instanceStats{service: instance.Service}
+		d.instances[instance.ID] = stats
+	}
+	now := time.Now()
+	if stats.ejections > 0 && stats.ejectedUntil.Before(now) && now.Sub(stats.ejectedUntil) > d.config.MaxEjectionTime {
+		stats.ejections = 0
+	}
+
+	gateway := outcome.Err != nil || outcome.StatusCode == http.StatusBadGateway ||
+		outcome.StatusCode == http.StatusServiceUnavailable || outcome.StatusCode == http.StatusGatewayTimeout
+	if gateway {
+		stats.consecutiveGW++
+	} else {
+		stats.consecutiveGW = 0
+	}
+	if outcome.StatusCode >= 500 {
+		stats.consecutive5xx++
+	} else if outcome.Err == nil {
+		stats.consecutive5xx = 0
+	}
+
+	if outcome.Err == nil {
+		sample := outcome.Latency.Seconds()
+		if stats.requests == 0 {
+			stats.latency = sample
+		} else {
+			stats.latency += latencyWeight * (sample - stats.latency)
+		}
+		stats.requests++
+	}
+
+	if stats.ejectedUntil.After(now) {
+		return
+	}
+	switch {
+	case stats.consecutiveGW >= d.config.ConsecutiveGatewayErrors:
+		d.eject(instance.ID, stats, "consecutive_gateway_errors", now)
+	case stats.consecutive5xx >= d.config.Consecutive5xx:
+		d.eject(instance.ID, stats, "consecutive_5xx", now)
+	case d.latencyOutlier(instance.ID, stats):
+		d.eject(instance.ID, stats, "latency", now)
+	}
+}
+
+// latencyOutlier reports whether an instance is much slower than the median
+// of the other instances of its service; callers hold the mutex
+func (d *OutlierDetector) latencyOutlier(id string, stats *instanceStats) bool {
+	if d.config.LatencyFactor < 0 || stats.requests < d.config.LatencyMinRequests {
+		return false
+	}
+	var peers []float64
+	for peerID, peer := range d.instances {
+		if peerID != id && peer.service == stats.service && peer.requests >= d.config.LatencyMinRequests {
+			peers = append(peers, peer.latency)
+		}
+	}
+	// With a single peer there is no telling which of the two is the outlier
+	if len(peers) < 2 {
+		return false
+	}
+	sort.Float64s(peers)
+	median := peers[len(peers)/2]
+	if len(peers)%2 == 0 {
+		median = (peers[len(peers)/2-1] + peers[len(peers)/2]) / 2
+	}
+	return stats.latency > d.config.LatencyFactor*median
+}
+
+// eject removes an instance from load balancing for its next ejection time;
+// callers hold the mutex
+func (d *OutlierDetector) eject(id string, stats *instanceStats, reason string, now time.Time) {
+	duration := d.config.MaxEjectionTime
+	if stats.ejections < 32 && d.config.BaseEjectionTime<<stats.ejections < duration {
+		duration = d.config.BaseEjectionTime << stats.ejections
+	}
+	stats.ejections++
+	stats.ejectedAt = now
+	stats.ejectedUntil = now.Add(duration)
+	stats.consecutive5xx = 0
+	stats.consecutiveGW = 0
+	// Judge the instance's latency afresh when it returns
+	stats.requests = 0
+
+	log.Printf("Ejecting instance %s of service '%s' for %s: %s", id, stats.service, duration, reason)
+	d.ejections.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("service", stats.service),
+		attribute.String("instance", id),
+		attribute.String("reason", reason),
+	))
+}
+
+// Ejected reports whether an instance is currently ejected
+func (d *OutlierDetector) Ejected(id string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	stats, ok := d.instances[id]
+	return ok && stats.ejectedUntil.After(time.Now())
+}
+
+// Filter returns instances without the ejected ones. At most
+// MaxEjectionPercent of the instances are left out, the most recently
+// ejected first, so that a widespread failure does not empty the set.
+func (d *OutlierDetector) Filter(instances []Instance) []Instance {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	var ejected []int
+	for i, instance := range instances {
+		if stats, ok := d.instances[instance.ID]; ok && stats.ejectedUntil.After(now) {
+			ejected = append(ejected, i)
+		}
+	}
+	if len(ejected) == 0 {
+		return instances
+	}
+
+	allowed := len(instances) * d.config.MaxEjectionPercent / 100
+	if len(ejected) > allowed {
+		sort.Slice(ejected, func(a, b int) bool {
+			return d.instances[instances[ejected[a]].ID].ejectedAt.After(d.instances[instances[ejected[b]].ID].ejectedAt)
+		})
+		ejected = ejected[:allowed]
+	}
+	skip := make(map[int]struct{}, len(ejected))
+	for _, i := range ejected {
+		skip[i] = struct{}{}
+	}
+
+	filtered := make([]Instance, 0, len(instances)-len(skip))
+	for i, instance := range instances {
+		if _, ok := skip[i]; !ok {
+			filtered = append(filtered, instance)
+		}
+	}
+	return filtered
+}
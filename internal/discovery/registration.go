@@ -0,0 +1,244 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// CheckType names the kind of health check a registry runs for an instance
+type CheckType string
+
+const (
+	CheckNone CheckType = ""     // No health check
+	CheckHTTP CheckType = "http" // HTTP GET expecting a 2xx response
+	CheckGRPC CheckType = "grpc" // gRPC health checking protocol
+	CheckTCP  CheckType = "tcp"  // TCP connect
+	CheckTTL  CheckType = "ttl"  // Heartbeats sent by the instance itself
+)
+
+// HealthCheck configures how a registry checks an instance
+type HealthCheck struct {
+	Type CheckType
+	// Target is the URL for HTTP checks (default <instance URL>/health) and
+	// host:port for TCP and gRPC checks (default the instance address);
+	// gRPC targets may name a service as host:port/service
+	Target   string
+	Interval time.Duration // Time between checks (default 10s)
+	Timeout  time.Duration // Timeout of a single check (default 1s)
+	TTL      time.Duration // Time without a heartbeat before a TTL check fails (default 15s)
+	// DeregisterCriticalAfter makes the registry remove an instance whose
+	// check has been critical for this long
+	DeregisterCriticalAfter time.Duration
+}
+
+// withDefaults fills in the defaults of a check for an instance
+func (c HealthCheck) withDefaults(instance Instance) HealthCheck {
+	if c.Target == "" {
+		switch c.Type {
+		case CheckHTTP:
+			c.Target = fmt.Sprintf("%s/health", instance.URL())
+		case CheckGRPC, CheckTCP:
+			c.Target = instance.HostPort()
+		}
+	}
+	if c.Interval <= 0 {
+		c.Interval = 10 * time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = time.Second
+	}
+	if c.TTL <= 0 {
+		c.TTL = 15 * time.Second
+	}
+	return c
+}
+
+// CheckID returns the ID of the health check registered for an instance
+func CheckID(instanceID string) string {
+	return "service:" + instanceID
+}
+
+// CheckRegistry is a Registry that runs health checks for the instances it
+// registers
+type CheckRegistry interface {
+	Registry
+	// RegisterWithCheck registers an instance with a health check
+	RegisterWithCheck(ctx context.Context, instance Instance, check HealthCheck) error
+	// UpdateTTL reports the status of an instance's TTL check
+	UpdateTTL(ctx context.Context, id string, healthy bool, output string) error
+}
+
+// RegistrationOptions configures a self-registration
+type RegistrationOptions struct {
+	Check HealthCheck
+	// DeregisterOnSignal deregisters the instance on SIGTERM or SIGINT. The
+	// signal is raised again afterwards so the process still terminates;
+	// applications with their own signal handling should cancel the
+	// registration context instead.
+	DeregisterOnSignal bool
+}
+
+// Registration is the handle of a registered instance. It keeps the
+// instance's TTL check passing and deregisters the instance when the
+// registration context is cancelled, on a signal if configured, or when
+// Deregister is called.
+type Registration struct {
+	registry Registry
+	instance Instance
+	check    HealthCheck
+
+	mutex   sync.Mutex
+	healthy bool
+	output  string
+
+	cancel context.CancelFunc
+	once   sync.Once
+	err    error
+	done   chan struct{}
+}
+
+// Register registers an instance with registry and returns its handle. A
+// health check other than CheckNone requires a CheckRegistry. With a TTL
+// check a heartbeat is sent every third of the TTL.
+func Register(ctx context.Context, registry Registry, instance Instance, opts RegistrationOptions) (*Registration, error) {
+	if instance.Service == "" {
+		return nil, fmt.Errorf("instance service name is required")
+	}
+	if instance.ID == "" {
+		instance.ID = fmt.Sprintf("%s-%s-%d", instance.Service, instance.Address, instance.Port)
+	}
+
+	check := opts.Check.withDefaults(instance)
+	if opts.Check.Type == CheckNone {
+		if err := registry.Register(ctx, instance); err != nil {
+			return nil, err
+		}
+	} else {
+		checkRegistry, ok := registry.(CheckRegistry)
+		if !ok {
+			return nil, fmt.Errorf("registry does not support health checks")
+		}
+		if err := checkRegistry.RegisterWithCheck(ctx, instance, opts.Check); err != nil {
+			return nil, err
+		}
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	r := &Registration{
+		registry: registry,
+		instance: instance,
+		check:    check,
+		healthy:  true,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	if opts.Check.Type == CheckTTL {
+		// Pass the check right away rather than waiting for the first tick
+		r.heartbeat(ctx)
+		go r.runHeartbeats(runCtx)
+	}
+
+	var signals chan os.Signal
+	if opts.DeregisterOnSignal {
+		signals = make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	}
+	go func() {
+		var received os.Signal
+		select {
+		case <-ctx.Done():
+		case received = <-signals:
+		case <-runCtx.Done():
+		}
+		if signals != nil {
+			signal.Stop(signals)
+		}
+		deregisterCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		r.deregister(deregisterCtx, received)
+		cancel()
+	}()
+	return r, nil
+}
+
+// Instance returns the registered instance
+func (r *Registration) Instance() Instance {
+	return r.instance
+}
+
+// SetHealth sets the status reported by the TTL heartbeats, so that an
+// instance can take itself out of rotation without deregistering
+func (r *Registration) SetHealth(healthy bool, output string) {
+	r.mutex.Lock()
+	r.healthy, r.output = healthy, output
+	r.mutex.Unlock()
+	if r.check.Type == CheckTTL {
+		ctx, cancel := context.WithTimeout(context.Background(), r.check.Timeout)
+		r.heartbeat(ctx)
+		cancel()
+	}
+}
+
+// runHeartbeats keeps a TTL check updated until the registration ends
+func (r *Registration) runHeartbeats(ctx context.Context) {
+	ticker := time.NewTicker(r.check.TTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hbCtx, cancel := context.WithTimeout(ctx, r.check.TTL/3)
+			r.heartbeat(hbCtx)
+			cancel()
+		}
+	}
+}
+
+// heartbeat reports the current status to the TTL check
+func (r *Registration) heartbeat(ctx context.Context) {
+	r.mutex.Lock()
+	healthy, output := r.healthy, r.output
+	r.mutex.Unlock()
+	if err := r.registry.(CheckRegistry).UpdateTTL(ctx, r.instance.ID, healthy, output); err != nil && ctx.Err() == nil {
+		log.Printf("Failed to update TTL check of %s: %v", r.instance.ID, err)
+	}
+}
+
+// Deregister stops the heartbeats and removes the instance from the
+// registry. It is safe to call more than once; later calls return the
+// result of the first.
+func (r *Registration) Deregister(ctx context.Context) error {
+	return r.deregister(ctx, nil)
+}
+
+// deregister removes the instance once. A received signal is raised again
+// before Done is closed, so that a process waiting on Done still has its
+// handlers installed when the signal arrives.
+func (r *Registration) deregister(ctx context.Context, received os.Signal) error {
+	r.once.Do(func() {
+		r.cancel()
+		r.err = r.registry.Deregister(ctx, r.instance.ID)
+		if r.err != nil {
+			log.Printf("Failed to deregister %s: %v", r.instance.ID, r.err)
+		}
+		if received != nil {
+			if p, err := os.FindProcess(os.Getpid()); err == nil {
+				p.Signal(received)
+			}
+		}
+		close(r.done)
+	})
+	<-r.done
+	return r.err
+}
+
+// Done returns a channel that is closed once the instance is deregistered
+func (r *Registration) Done() <-chan struct{} {
+	return r.done
+}
@@ -0,0 +1,316 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// StaleConfig holds configuration for serving last-known instances
+type StaleConfig struct {
+	// MaxStale is how long after the last successful lookup of a service its
+	// last-known instances are still served when lookups fail
+	MaxStale time.Duration
+	// SnapshotPath, when set, is a JSON file the last-known instances are
+	// written to whenever they change and loaded from on startup
+	SnapshotPath string
+}
+
+// StaleResolver wraps a Resolver and keeps serving the last-known instances
+// of a service for up to MaxStale when the registry cannot be reached. A
+// registry that answers with no instances is trusted and is not papered
+// over. Stale answers are logged when a service turns stale, counted in the
+// microcomms.discovery.stale_resolutions metric and reported by Stale.
+//
+// Instances are remembered per service and, for queries a QueryResolver
+// evaluates itself, per query, since those answers are already filtered.
+//
+// Instances loaded from the snapshot are treated as seen at startup, so a
+// process that starts while the registry is down can still reach services
+// for MaxStale.
+type StaleResolver struct {
+	resolver Resolver
+	config   StaleConfig
+	stale    metric.Int64Counter
+
+	mutex   sync.Mutex
+	entries map[string]*staleEntry // By service or staleKey of a query
+}
+
+// staleEntry holds the last-known instances of a service
+type staleEntry struct {
+	Service   string     `json:"service,omitempty"` // Set for entries of a query
+	Instances []Instance `json:"instances"`
+	Updated   time.Time  `json:"updated"`
+	stale     bool
+}
+
+var (
+	_ QueryResolver = (*StaleResolver)(nil)
+	_ Watcher       = (*StaleResolver)(nil)
+	_ io.Closer     = (*StaleResolver)(nil)
+)
+
+// NewStaleResolver wraps resolver, loading the snapshot if one is configured
+// and exists
+func NewStaleResolver(resolver Resolver, config StaleConfig) (*StaleResolver, error) {
+	counter, err := otel.Meter("github.com/pramithamj/microcomms").Int64Counter(
+		"microcomms.discovery.stale_resolutions",
+		metric.WithDescription("Service lookups answered with last-known instances because the registry was unreachable"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &StaleResolver{
+		resolver: resolver,
+		config:   config,
+		stale:    counter,
+		entries:  make(map[string]*staleEntry),
+	}
+	if config.SnapshotPath != "" {
+		if err := r.loadSnapshot(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Resolve returns the instances from the wrapped resolver, or the last-known
+// instances if it fails and they are no older than MaxStale
+func (r *StaleResolver) Resolve(ctx context.Context, service string) ([]Instance, error) {
+	instances, err := r.resolver.Resolve(ctx, service)
+	if err == nil {
+		r.remember(Query{Service: service}, instances)
+		return instances, nil
+	}
+	return r.fallback(ctx, Query{Service: service}, err)
+}
+
+// ResolveQuery resolves a query with the wrapped resolver. When that fails,
+// the last-known answer to the same query is used, or else the query's tag,
+// metadata and version filters are applied to the last-known instances of
+// the service.
+func (r *StaleResolver) ResolveQuery(ctx context.Context, q Query) ([]Instance, error) {
+	qr, ok := r.resolver.(QueryResolver)
+	if !ok {
+		// Remember every instance so that all queries of the service can
+		// fall back on them
+		instances, err := r.resolver.Resolve(ctx, q.Service)
+		if err != nil {
+			return r.fallback(ctx, q, err)
+		}
+		r.remember(Query{Service: q.Service}, instances)
+		if instances, err = FilterInstances(instances, q); err != nil {
+			return nil, err
+		}
+		if len(instances) == 0 {
+			return nil, &NoInstancesError{Service: q.Service}
+		}
+		return instances, nil
+	}
+
+	instances, err := qr.ResolveQuery(ctx, q)
+	if err == nil {
+		r.remember(q, instances)
+		return instances, nil
+	}
+	return r.fallback(ctx, q, err)
+}
+
+// staleKey identifies the entry a query's answer is remembered under: the
+// service name for a plain lookup, or the service and its filters
+func staleKey(q Query) string {
+	filters := url.Values{}
+	if len(q.Tags) > 0 {
+		tags := append([]string(nil), q.Tags...)
+		sort.Strings(tags)
+		filters["tag"] = tags
+	}
+	for k, v := range q.Meta {
+		filters.Set("meta."+k, v)
+	}
+	if q.Datacenter != "" {
+		filters.Set("dc", q.Datacenter)
+	}
+	if q.Namespace != "" {
+		filters.Set("ns", q.Namespace)
+	}
+	if q.Version != "" {
+		filters.Set("version", q.Version)
+	}
+	if len(filters) == 0 {
+		return q.Service
+	}
+	return q.Service + "?" + filters.Encode()
+}
+
+// fallback answers a failed lookup with last-known instances if they are
+// recent enough, or returns err
+func (r *StaleResolver) fallback(ctx context.Context, q Query, err error) ([]Instance, error) {
+	var noInstances *NoInstancesError
+	if errors.As(err, &noInstances) || ctx.Err() != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	entry, ok := r.entries[staleKey(q)]
+	if !ok || !r.usable(entry) {
+		entry, ok = r.entries[q.Service]
+	}
+	if !ok || !r.usable(entry) {
+		r.mutex.Unlock()
+		return nil, err
+	}
+	if !entry.stale {
+		entry.stale = true
+		log.Printf("Serving last-known instances of service '%s' from %s ago: %v",
+			q.Service, time.Since(entry.Updated).Round(time.Second), err)
+	}
+	last := entry.Instances
+	r.mutex.Unlock()
+
+	// The registry evaluated datacenter and namespace, which the
+	// last-known instances do not record
+	q.Datacenter, q.Namespace = "", ""
+	instances, filterErr := FilterInstances(last, q)
+	if filterErr != nil {
+		return nil, filterErr
+	}
+	if len(instances) == 0 {
+		return nil, err
+	}
+	r.stale.Add(ctx, 1, metric.WithAttributes(attribute.String("service", q.Service)))
+	return instances, nil
+}
+
+// usable reports whether an entry can answer a failed lookup; callers hold
+// the mutex
+func (r *StaleResolver) usable(entry *staleEntry) bool {
+	return len(entry.Instances) > 0 && time.Since(entry.Updated) <= r.config.MaxStale
+}
+
+// remember records the instances of a successful lookup, writing the
+// snapshot if they changed
+func (r *StaleResolver) remember(q Query, instances []Instance) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key := staleKey(q)
+	entry, ok := r.entries[key]
+	if !ok {
+		entry = &staleEntry{}
+		if key != q.Service {
+			entry.Service = q.Service
+		}
+		r.entries[key] = entry
+	}
+	if entry.stale {
+		log.Printf("Service '%s' resolved from the registry again", q.Service)
+	}
+	changed := !reflect.DeepEqual(entry.Instances, instances)
+	entry.Instances = append([]Instance(nil), instances...)
+	entry.Updated = time.Now()
+	entry.stale = false
+
+	if changed && r.config.SnapshotPath != "" {
+		if err := r.writeSnapshot(); err != nil {
+			log.Printf("Failed to write discovery snapshot: %v", err)
+		}
+	}
+}
+
+// Stale reports whether the last lookup of a service, or of a query of it,
+// was answered with last-known instances, and how old the oldest are
+func (r *StaleResolver) Stale(service string) (bool, time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var stale bool
+	var age time.Duration
+	for key, entry := range r.entries {
+		if key != service && entry.Service != service || !entry.stale {
+			continue
+		}
+		stale = true
+		if a := time.Since(entry.Updated); a > age {
+			age = a
+		}
+	}
+	return stale, age
+}
+
+// Watch passes through to the wrapped resolver if it supports watches
+func (r *StaleResolver) Watch(ctx context.Context, service string) (<-chan []Instance, error) {
+	watcher, ok := r.resolver.(Watcher)
+	if !ok {
+		return nil, ErrWatchNotSupported
+	}
+	return watcher.Watch(ctx, service)
+}
+
+// Close closes the wrapped resolver if it can be closed, such as the
+// Consul watches or etcd client behind it
+func (r *StaleResolver) Close() error {
+	if closer, ok := r.resolver.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// loadSnapshot reads the last-known instances from the snapshot file
+func (r *StaleResolver) loadSnapshot() error {
+	data, err := os.ReadFile(r.config.SnapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read discovery snapshot %s: %v", r.config.SnapshotPath, err)
+	}
+	entries := make(map[string]*staleEntry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("failed to parse discovery snapshot %s: %v", r.config.SnapshotPath, err)
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		entry.Updated = now
+	}
+	r.entries = entries
+	return nil
+}
+
+// writeSnapshot atomically replaces the snapshot file; callers hold the mutex
+func (r *StaleResolver) writeSnapshot() error {
+	data, err := json.Marshal(r.entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.config.SnapshotPath), ".discovery-snapshot-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.config.SnapshotPath)
+}
@@ -0,0 +1,192 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// StaticResolver resolves services from a fixed in-memory table. It is meant
+// for local development and tests, where services run at known addresses.
+// Instances can also be added at runtime through the Registry methods.
+type StaticResolver struct {
+	services map[string][]Instance
+	mutex    sync.RWMutex
+}
+
+var (
+	_ Resolver = (*StaticResolver)(nil)
+	_ Registry = (*StaticResolver)(nil)
+)
+
+// NewStaticResolver creates a resolver from a table of service name to
+// "host:port" addresses
+func NewStaticResolver(services map[string][]string) (*StaticResolver, error) {
+	r := &StaticResolver{services: make(map[string][]Instance)}
+	for name, addrs := range services {
+		for _, addr := range addrs {
+			instance, err := ParseInstance(name, addr)
+			if err != nil {
+				return nil, err
+			}
+			r.services[name] = append(r.services[name], instance)
+		}
+	}
+	return r, nil
+}
+
+// ParseInstance creates an instance of service from a "host:port" address
+func ParseInstance(service, addr string) (Instance, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Instance{}, fmt.Errorf("invalid address '%s' for service '%s': %v", addr, service, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return Instance{}, fmt.Errorf("invalid port in address '%s' for service '%s'", addr, service)
+	}
+	return Instance{
+		ID:      fmt.Sprintf("%s-%s-%d", service, host, port),
+		Service: service,
+		Address: host,
+		Port:    port,
+	}, nil
+}
+
+// Resolve returns the instances of a service
+func (r *StaticResolver) Resolve(ctx context.Context, service string) ([]Instance, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	instances := r.services[service]
+	if len(instances) == 0 {
+		return nil, &NoInstancesError{Service: service}
+	}
+	return append([]Instance(nil), instances...), nil
+}
+
+// Register adds an instance, replacing any instance with the same ID
+func (r *StaticResolver) Register(ctx context.Context, instance Instance) error {
+	if instance.Service == "" {
+		return fmt.Errorf("instance service name is required")
+	}
+	if instance.ID == "" {
+		instance.ID = fmt.Sprintf("%s-%s-%d", instance.Service, instance.Address, instance.Port)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	instances := r.services[instance.Service]
+	for i, existing := range instances {
+		if existing.ID == instance.ID {
+			instances[i] = instance
+			return nil
+		}
+	}
+	r.services[instance.Service] = append(instances, instance)
+	return nil
+}
+
+// Deregister removes an instance by ID
+func (r *StaticResolver) Deregister(ctx context.Context, id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for name, instances := range r.services {
+		for i, instance := range instances {
+			if instance.ID == id {
+				r.services[name] = append(instances[:i:i], instances[i+1:]...)
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// FileResolver resolves services from a JSON file mapping service names to
+// instances, for example:
+//
+//	{"payments": [{"address": "127.0.0.1", "port": 8081, "tags": ["v2"]}]}
+//
+// The file is re-read when its modification time changes, so local
+// topologies can be edited without restarting the process.
+type FileResolver struct {
+	path          string
+	checkInterval time.Duration
+	modTime       time.Time
+	lastCheck     time.Time
+	services      map[string][]Instance
+	mutex         sync.Mutex
+}
+
+var _ Resolver = (*FileResolver)(nil)
+
+// NewFileResolver loads the service table from path
+func NewFileResolver(path string) (*FileResolver, error) {
+	r := &FileResolver{
+		path:          path,
+		checkInterval: time.Second,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Resolve returns the instances of a service from the current file contents
+func (r *FileResolver) Resolve(ctx context.Context, service string) ([]Instance, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.lastCheck) >= r.checkInterval {
+		if err := r.reload(); err != nil {
+			// Keep serving the last good table if the file is mid-edit
+			r.lastCheck = time.Now()
+		}
+	}
+
+	instances := r.services[service]
+	if len(instances) == 0 {
+		return nil, &NoInstancesError{Service: service}
+	}
+	return append([]Instance(nil), instances...), nil
+}
+
+// reload re-reads the file if it changed since it was last loaded
+func (r *FileResolver) reload() error {
+	r.lastCheck = time.Now()
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return fmt.Errorf("failed to read discovery file %s: %v", r.path, err)
+	}
+	if r.services != nil && info.ModTime().Equal(r.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("failed to read discovery file %s: %v", r.path, err)
+	}
+	var services map[string][]Instance
+	if err := json.Unmarshal(data, &services); err != nil {
+		return fmt.Errorf("failed to parse discovery file %s: %v", r.path, err)
+	}
+	for name, instances := range services {
+		for i := range instances {
+			instances[i].Service = name
+			if instances[i].ID == "" {
+				instances[i].ID = fmt.Sprintf("%s-%s-%d", name, instances[i].Address, instances[i].Port)
+			}
+		}
+	}
+
+	r.services = services
+	r.modTime = info.ModTime()
+	return nil
+}
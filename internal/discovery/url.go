@@ -0,0 +1,200 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ServiceURL is a URL that names a service in a registry instead of a host,
+// such as "consul://payments/v1/charges?currency=EUR". Instances are reached
+// over HTTP, or over HTTPS when the scheme carries a "+https" suffix, as in
+// "consul+https://payments/v1/charges".
+type ServiceURL struct {
+	Scheme  string // Registry scheme, e.g. "consul"; empty for a bare "service/path"
+	Service string
+	Secure  bool   // Reach instances over HTTPS
+	Rest    string // Escaped path, query and fragment
+}
+
+// ParseServiceURL parses a service URL or a bare "service/path" target
+func ParseServiceURL(raw string) (ServiceURL, error) {
+	i := strings.Index(raw, "://")
+	if i < 0 {
+		// A bare target has no scheme for url.Parse to find
+		raw = "//" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ServiceURL{}, fmt.Errorf("invalid service URL '%s': %v", raw, err)
+	}
+	if u.Host == "" || u.User != nil {
+		return ServiceURL{}, fmt.Errorf("invalid service URL '%s': missing service name", raw)
+	}
+
+	s := ServiceURL{Scheme: strings.ToLower(u.Scheme), Service: u.Host}
+	if strings.HasSuffix(s.Scheme, "+https") {
+		s.Scheme, s.Secure = strings.TrimSuffix(s.Scheme, "+https"), true
+	}
+	s.Rest = u.EscapedPath()
+	if u.RawQuery != "" || u.ForceQuery {
+		s.Rest += "?" + u.RawQuery
+	}
+	if u.Fragment != "" {
+		s.Rest += "#" + u.EscapedFragment()
+	}
+	return s, nil
+}
+
+// InstanceURL returns the URL of the same resource on an instance
+func (s ServiceURL) InstanceURL(instance Instance) string {
+	scheme := "http"
+	if s.Secure {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, instance.HostPort(), s.Rest)
+}
+
+// IsHTTPURL reports whether a target is a plain http(s) URL that needs no
+// resolution
+func IsHTTPURL(target string) bool {
+	lower := strings.ToLower(target)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// URLResolver resolves service URLs with the Resolver registered for their
+// scheme. The resolver registered for the empty scheme handles bare
+// "service/path" targets. Plain http(s) URLs are returned unchanged.
+type URLResolver struct {
+	balancers *Balancers
+
+	mutex     sync.Mutex
+	resolvers map[string]Resolver
+	factories map[string]func() (Resolver, error)
+	created   []Resolver // Made by factories, and so closed by Close
+	closed    bool
+}
+
+// NewURLResolver creates a URL resolver that picks instances with
+// balancers, or round-robin when balancers is nil
+func NewURLResolver(balancers *Balancers) (*URLResolver, error) {
+	if balancers == nil {
+		var err error
+		if balancers, err = NewBalancers(RoundRobin, nil); err != nil {
+			return nil, err
+		}
+	}
+	return &URLResolver{
+		balancers: balancers,
+		resolvers: make(map[string]Resolver),
+		factories: make(map[string]func() (Resolver, error)),
+	}, nil
+}
+
+// Handle registers the resolver for a scheme
+func (u *URLResolver) Handle(scheme string, r Resolver) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.resolvers[strings.ToLower(scheme)] = r
+	delete(u.factories, strings.ToLower(scheme))
+}
+
+// HandleFunc registers a function that creates the resolver for a scheme on
+// first use, so that registries which are never addressed are never
+// contacted. A failed creation is retried on the next lookup.
+func (u *URLResolver) HandleFunc(scheme string, factory func() (Resolver, error)) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	delete(u.resolvers, strings.ToLower(scheme))
+	u.factories[strings.ToLower(scheme)] = factory
+}
+
+// Resolver returns the resolver for a scheme
+func (u *URLResolver) Resolver(scheme string) (Resolver, error) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.closed {
+		return nil, fmt.Errorf("URL resolver is closed")
+	}
+	scheme = strings.ToLower(scheme)
+	if r, ok := u.resolvers[scheme]; ok {
+		return r, nil
+	}
+	factory, ok := u.factories[scheme]
+	if !ok {
+		if scheme == "" {
+			return nil, fmt.Errorf("no default resolver for targets without a scheme")
+		}
+		return nil, fmt.Errorf("unsupported URL scheme '%s'", scheme)
+	}
+	r, err := factory()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resolver for scheme '%s': %v", scheme, err)
+	}
+	u.resolvers[scheme] = r
+	u.created = append(u.created, r)
+	delete(u.factories, scheme)
+	return r, nil
+}
+
+// Close closes the resolvers created by HandleFunc factories. Resolvers
+// registered with Handle belong to the caller and are left open.
+func (u *URLResolver) Close() error {
+	u.mutex.Lock()
+	created := u.created
+	u.created = nil
+	u.closed = true
+	u.mutex.Unlock()
+
+	var firstErr error
+	for _, r := range created {
+		if closer, ok := r.(io.Closer); ok {
+			if err := closer.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Lookup parses a target and returns its resolver. For plain http(s) URLs
+// the returned resolver is nil.
+func (u *URLResolver) Lookup(target string) (ServiceURL, Resolver, error) {
+	if IsHTTPURL(target) {
+		return ServiceURL{}, nil, nil
+	}
+	s, err := ParseServiceURL(target)
+	if err != nil {
+		return ServiceURL{}, nil, err
+	}
+	r, err := u.Resolver(s.Scheme)
+	if err != nil {
+		return ServiceURL{}, nil, err
+	}
+	return s, r, nil
+}
+
+// ResolveURL returns the concrete URL of a target on one instance of its
+// service. The returned DoneFunc must be called once the request completes.
+func (u *URLResolver) ResolveURL(ctx context.Context, target string) (string, DoneFunc, error) {
+	s, r, err := u.Lookup(target)
+	if err != nil {
+		return "", nil, err
+	}
+	if r == nil {
+		return target, func(error) {}, nil
+	}
+	instances, err := r.Resolve(ctx, s.Service)
+	if err != nil {
+		return "", nil, err
+	}
+	instance, done, err := u.balancers.Pick(ctx, s.Service, instances)
+	if err != nil {
+		return "", nil, err
+	}
+	return s.InstanceURL(instance), done, nil
+}
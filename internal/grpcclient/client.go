@@ -21,6 +21,11 @@ func NewClient(target string) (*Client, error) {
 	return &Client{conn: conn}, nil
 }
 
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
 // CallExample makes a sample gRPC call
 func (c *Client) CallExample(ctx context.Context, serviceMethod string) (string, error) {
 	// This is where you can add your gRPC method call logic
@@ -0,0 +1,144 @@
+package grpcclient
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pramithamj/microcomms/internal/discovery"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+)
+
+// DiscoveryScheme is the target scheme handled by the discovery resolver,
+// as in "discovery:///payments"
+const DiscoveryScheme = "discovery"
+
+// discoveryBuilder builds gRPC resolvers backed by a discovery.Resolver
+type discoveryBuilder struct {
+	resolver discovery.Resolver
+	refresh  time.Duration
+}
+
+// NewResolverBuilder returns a gRPC resolver builder for DiscoveryScheme
+// targets. The service named by the target is resolved through r when the
+// connection starts, every refresh interval and whenever gRPC asks for a
+// re-resolution, for example after a connection to an instance fails.
+func NewResolverBuilder(r discovery.Resolver, refresh time.Duration) resolver.Builder {
+	if refresh <= 0 {
+		refresh = 30 * time.Second
+	}
+	return &discoveryBuilder{resolver: r, refresh: refresh}
+}
+
+// Build starts resolving the target's service
+func (b *discoveryBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	service := target.Endpoint()
+	if service == "" {
+		return nil, fmt.Errorf("missing service name in target %s", target.URL.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &discoveryResolver{
+		resolver: b.resolver,
+		service:  service,
+		cc:       cc,
+		refresh:  b.refresh,
+		now:      make(chan struct{}, 1),
+		cancel:   cancel,
+	}
+	r.wg.Add(1)
+	go r.watch(ctx)
+	return r, nil
+}
+
+// Scheme returns DiscoveryScheme
+func (b *discoveryBuilder) Scheme() string {
+	return DiscoveryScheme
+}
+
+// discoveryResolver keeps a gRPC connection's addresses in sync with
+// service discovery
+type discoveryResolver struct {
+	resolver discovery.Resolver
+	service  string
+	cc       resolver.ClientConn
+	refresh  time.Duration
+	now      chan struct{}
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// watch resolves the service until the resolver is closed
+func (r *discoveryResolver) watch(ctx context.Context) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+
+	for {
+		r.update(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.now:
+		}
+	}
+}
+
+// update pushes the current instances of the service to gRPC
+func (r *discoveryResolver) update(ctx context.Context) {
+	instances, err := r.resolver.Resolve(ctx, r.service)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Failed to resolve gRPC service %s: %v", r.service, err)
+			r.cc.ReportError(err)
+		}
+		return
+	}
+
+	addresses := make([]resolver.Address, 0, len(instances))
+	for _, instance := range instances {
+		addresses = append(addresses, resolver.Address{Addr: instance.HostPort()})
+	}
+	if err := r.cc.UpdateState(resolver.State{Addresses: addresses}); err != nil {
+		log.Printf("Failed to update gRPC addresses for %s: %v", r.service, err)
+	}
+}
+
+// ResolveNow triggers an immediate re-resolution
+func (r *discoveryResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.now <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops resolving
+func (r *discoveryResolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// NewDiscoveryClient creates a client for a service whose instances are
+// found through service discovery. Calls are balanced round-robin across
+// the instances, and the connection is established lazily.
+func NewDiscoveryClient(service string, r discovery.Resolver) (*Client, error) {
+	conn, err := grpc.NewClient(DiscoveryScheme+":///"+service,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(NewResolverBuilder(r, 0)),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"round_robin": {}}]}`),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %v", err)
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Conn returns the underlying connection, for use with generated stubs
+func (c *Client) Conn() *grpc.ClientConn {
+	return c.conn
+}
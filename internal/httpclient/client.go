@@ -1,7 +1,8 @@
 package httpclient
 
 import (
-	"errors"
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"time"
@@ -30,24 +31,57 @@ func NewClient(config Config) *Client {
 	return &Client{config: config}
 }
 
+// StatusError is returned for responses with a 5xx status code
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server error: %d", e.StatusCode)
+}
+
+// AttemptFunc observes one attempt of a request: the response or error
+// and the time the attempt took, excluding retry backoff
+type AttemptFunc func(resp *http.Response, err error, latency time.Duration)
+
 // Get makes an HTTP GET request with retries
 func (c *Client) Get(url string) (*http.Response, error) {
+	return c.GetWithAttempts(context.Background(), url, nil)
+}
+
+// GetWithAttempts makes an HTTP GET request with retries, passing the
+// outcome of every attempt to attempt if it is not nil. It stops retrying
+// and aborts the attempt in flight once ctx is done.
+func (c *Client) GetWithAttempts(ctx context.Context, url string, attempt AttemptFunc) (*http.Response, error) {
 	var lastErr error
 	for i := 0; i < c.config.RetryAttempts; i++ {
-		resp, err := c.doRequest(url)
+		start := time.Now()
+		resp, err := c.doRequest(ctx, url)
+		if attempt != nil {
+			attempt(resp, err, time.Since(start))
+		}
 		if err == nil {
 			return resp, nil
 		}
 		lastErr = err
+		if ctx.Err() != nil {
+			return nil, lastErr
+		}
 		log.Printf("Request failed: %v, retrying... (%d/%d)", err, i+1, c.config.RetryAttempts)
-		time.Sleep(time.Duration(rand.Intn(500)) * time.Millisecond) // Exponential backoff can be added here
+		backoff := time.NewTimer(time.Duration(rand.Intn(500)) * time.Millisecond) // Exponential backoff can be added here
+		select {
+		case <-backoff.C:
+		case <-ctx.Done():
+			backoff.Stop()
+			return nil, lastErr
+		}
 	}
 	return nil, lastErr
 }
 
 // doRequest handles the actual HTTP request
-func (c *Client) doRequest(url string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
+func (c *Client) doRequest(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -57,7 +91,8 @@ func (c *Client) doRequest(url string) (*http.Response, error) {
 		return nil, err
 	}
 	if resp.StatusCode >= 500 {
-		return nil, errors.New("server error")
+		resp.Body.Close()
+		return nil, &StatusError{StatusCode: resp.StatusCode}
 	}
 	return resp, nil
 }
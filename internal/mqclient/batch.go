@@ -0,0 +1,172 @@
+package mqclient
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// runBatch collects queued messages into batches of up to batchSize, flushing
+// a partial batch once batchWait has passed since its first message
+func (s *Subscription) runBatch() {
+	batch := make([]*Message, 0, s.options.batchSize)
+	timer := time.NewTimer(s.options.batchWait)
+	timer.Stop()
+
+	flush := func() {
+		timer.Stop()
+		if len(batch) > 0 {
+			s.deliverBatch(batch)
+			batch = make([]*Message, 0, s.options.batchSize)
+		}
+	}
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.messages:
+			if len(batch) == 0 {
+				timer.Reset(s.options.batchWait)
+			}
+			batch = append(batch, msg)
+			if len(batch) >= s.options.batchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// deliverBatch runs the batch handler, acking the messages that succeeded and
+// redelivering the failed ones as a smaller batch until MaxDeliveries
+func (s *Subscription) deliverBatch(batch []*Message) {
+	for len(batch) > 0 {
+		for _, msg := range batch {
+			msg.Deliveries++
+		}
+
+		err := s.batchHandler(context.Background(), batch)
+		var batchErr *BatchError
+		partial := errors.As(err, &batchErr)
+
+		var retry []*Message
+		for i, msg := range batch {
+			msgErr := err
+			if partial {
+				msgErr = batchErr.Failed(i)
+			}
+			if msgErr == nil {
+				s.finish(msg, nil)
+				continue
+			}
+			if s.brokerRedelivery {
+				s.finish(msg, msgErr)
+				continue
+			}
+			if msg.Deliveries >= s.options.MaxDeliveries {
+				log.Printf("Message %s on topic %s dropped after %d deliveries: %v", msg.ID, s.topic, msg.Deliveries, msgErr)
+				s.finish(msg, msgErr)
+				continue
+			}
+			retry = append(retry, msg)
+		}
+
+		select {
+		case <-s.done:
+			for _, msg := range retry {
+				s.finish(msg, ErrSubscriptionClosed)
+			}
+			return
+		default:
+		}
+		batch = retry
+	}
+}
+
+// DeduplicateBatch wraps a batch handler so that messages whose key was
+// already processed successfully are acked without being handed to the
+// handler again. Messages repeating a key within the same batch share the
+// outcome of its first occurrence.
+func DeduplicateBatch(handler BatchHandler, cfg DedupConfig) BatchHandler {
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryDedupStore(10000, time.Hour)
+	}
+	if cfg.KeyFunc == nil {
+		cfg.KeyFunc = MessageIDKey
+	}
+
+	return func(ctx context.Context, msgs []*Message) error {
+		result := NewBatchError()
+		first := make(map[string]int) // key -> index in msgs of its first occurrence
+		attempts := make(map[string]int)
+		var pending []*Message
+		var pendingIndex []int // index in msgs of each pending message
+
+		for i, msg := range msgs {
+			key := cfg.KeyFunc(msg)
+			if key != "" {
+				if _, ok := first[key]; ok {
+					continue
+				}
+				first[key] = i
+				record, err := cfg.Store.Get(key)
+				if err != nil {
+					result.Add(i, err)
+					continue
+				}
+				if record != nil && record.Status == DedupProcessed {
+					continue
+				}
+				attempts[key] = 1
+				if record != nil {
+					attempts[key] = record.Attempts + 1
+				}
+			}
+			pending = append(pending, msg)
+			pendingIndex = append(pendingIndex, i)
+		}
+
+		if len(pending) > 0 {
+			err := handler(ctx, pending)
+			var batchErr *BatchError
+			partial := errors.As(err, &batchErr)
+			for j, msg := range pending {
+				msgErr := err
+				if partial {
+					msgErr = batchErr.Failed(j)
+				}
+				if msgErr != nil {
+					result.Add(pendingIndex[j], msgErr)
+				}
+
+				key := cfg.KeyFunc(msg)
+				if key == "" {
+					continue
+				}
+				outcome := DedupRecord{Status: DedupProcessed, Attempts: attempts[key], UpdatedAt: time.Now()}
+				if msgErr != nil {
+					outcome.Status = DedupFailed
+					outcome.Error = msgErr.Error()
+				}
+				if err := cfg.Store.Put(key, outcome); err != nil && msgErr == nil {
+					result.Add(pendingIndex[j], err)
+				}
+			}
+		}
+
+		// Repeated keys follow the outcome of their first occurrence
+		for i, msg := range msgs {
+			key := cfg.KeyFunc(msg)
+			if key == "" || first[key] == i {
+				continue
+			}
+			if err := result.Failed(first[key]); err != nil {
+				result.Add(i, err)
+			}
+		}
+		return result.orNil()
+	}
+}
@@ -0,0 +1,126 @@
+package mqclient
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Broker is a messaging backend that MQClient publishes to and consumes from
+type Broker interface {
+	// Publish sends a single message to its topic
+	Publish(ctx context.Context, msg *Message) error
+	// PublishBatch sends messages in one round trip where the backend allows
+	// it. Per-message failures are reported as a *BatchError.
+	PublishBatch(ctx context.Context, msgs []*Message) error
+	// SubscribeWithOptions consumes messages from topic one at a time
+	SubscribeWithOptions(topic string, handler Handler, opts SubscribeOptions) (*Subscription, error)
+	// SubscribeBatch consumes messages from topic in batches
+	SubscribeBatch(topic string, handler BatchHandler, opts BatchOptions) (*Subscription, error)
+	// Close releases the backend connection and stops its subscriptions
+	Close() error
+}
+
+var _ Broker = (*MessageQueue)(nil)
+
+// BatchHandler processes a batch of delivered messages. Returning nil acks
+// every message; returning a *BatchError nacks only the messages it lists;
+// any other error nacks the whole batch.
+type BatchHandler func(ctx context.Context, msgs []*Message) error
+
+// BatchOptions configures a batching subscription
+type BatchOptions struct {
+	MaxSize       int           // Largest batch handed to the handler (default 100)
+	MaxWait       time.Duration // Longest time to wait for a batch to fill (default 100ms)
+	MaxDeliveries int           // Deliveries before a nacked message is dropped (default 3)
+	Dedup         *DedupConfig  // Skip messages that were already processed
+	Group         string        // Consumer group sharing the topic, for brokers that support groups
+}
+
+// subscribeOptions returns the subscription options for a batching consumer
+func (o BatchOptions) subscribeOptions() SubscribeOptions {
+	if o.MaxSize <= 0 {
+		o.MaxSize = 100
+	}
+	if o.MaxWait <= 0 {
+		o.MaxWait = 100 * time.Millisecond
+	}
+	return SubscribeOptions{
+		MaxDeliveries: o.MaxDeliveries,
+		Dedup:         o.Dedup,
+		Group:         o.Group,
+		batchSize:     o.MaxSize,
+		batchWait:     o.MaxWait,
+	}
+}
+
+// BatchError reports which messages of a batch failed, by index in the batch
+type BatchError struct {
+	Errors map[int]error
+}
+
+// NewBatchError creates an empty BatchError
+func NewBatchError() *BatchError {
+	return &BatchError{Errors: make(map[int]error)}
+}
+
+// Add records the failure of the message at index
+func (e *BatchError) Add(index int, err error) {
+	e.add(index, err)
+}
+
+// Failed returns the error for the message at index, or nil if it succeeded
+func (e *BatchError) Failed(index int) error {
+	if e == nil {
+		return nil
+	}
+	return e.Errors[index]
+}
+
+func (e *BatchError) Error() string {
+	indexes := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	parts := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		parts = append(parts, fmt.Sprintf("message %d: %v", i, e.Errors[i]))
+	}
+	return fmt.Sprintf("%d messages in batch failed: %s", len(e.Errors), strings.Join(parts, "; "))
+}
+
+func (e *BatchError) add(index int, err error) {
+	if e.Errors == nil {
+		e.Errors = make(map[int]error)
+	}
+	e.Errors[index] = err
+}
+
+// orNil returns nil when no message failed so callers can return it directly
+func (e *BatchError) orNil() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+// prepareMessage validates a message and fills in its ID and timestamp
+func prepareMessage(msg *Message) error {
+	if msg == nil {
+		return fmt.Errorf("message is nil")
+	}
+	if msg.Topic == "" {
+		return fmt.Errorf("message topic is required")
+	}
+	if msg.ID == "" {
+		msg.ID = NewMessageID()
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	return nil
+}
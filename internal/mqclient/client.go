@@ -1,20 +1,32 @@
 package mqclient
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 )
 
+// ErrSubscriptionClosed is returned when publishing to a closed subscription
+var ErrSubscriptionClosed = errors.New("subscription closed")
+
 // MessageQueue is a simple message queue interface
 type MessageQueue struct {
 	channel chan string
+	size    int
+
+	mutex         sync.RWMutex
+	subscriptions map[string][]*Subscription
 }
 
 // NewMessageQueue creates a new MessageQueue instance
 func NewMessageQueue(size int) *MessageQueue {
 	return &MessageQueue{
-		channel: make(chan string, size),
+		channel:       make(chan string, size),
+		size:          size,
+		subscriptions: make(map[string][]*Subscription),
 	}
 }
 
@@ -39,3 +51,141 @@ func (mq *MessageQueue) ReceiveMessage() (string, error) {
 		return "", fmt.Errorf("timeout receiving message")
 	}
 }
+
+// Publish delivers a message to every subscription whose topic pattern
+// matches the message topic
+func (mq *MessageQueue) Publish(ctx context.Context, msg *Message) error {
+	if err := prepareMessage(msg); err != nil {
+		return err
+	}
+
+	mq.mutex.RLock()
+	subs := mq.matchingSubscriptions(msg.Topic)
+	mq.mutex.RUnlock()
+
+	timeout := time.NewTimer(2 * time.Second)
+	defer timeout.Stop()
+	for _, sub := range subs {
+		if err := sub.enqueue(ctx, msg.clone(), timeout.C); err != nil {
+			return fmt.Errorf("failed to publish message %s: %v", msg.ID, err)
+		}
+	}
+	return nil
+}
+
+// PublishBatch delivers messages to the subscriptions on their topics. The
+// whole batch shares one subscription lookup per topic and one send timeout,
+// and messages that could not be delivered are reported in a *BatchError.
+func (mq *MessageQueue) PublishBatch(ctx context.Context, msgs []*Message) error {
+	batchErr := &BatchError{}
+	subs := make(map[string][]*Subscription)
+
+	mq.mutex.RLock()
+	for i, msg := range msgs {
+		if err := prepareMessage(msg); err != nil {
+			batchErr.add(i, err)
+			continue
+		}
+		if _, ok := subs[msg.Topic]; !ok {
+			subs[msg.Topic] = mq.matchingSubscriptions(msg.Topic)
+		}
+	}
+	mq.mutex.RUnlock()
+
+	timeout := time.NewTimer(2 * time.Second)
+	defer timeout.Stop()
+	for i, msg := range msgs {
+		if batchErr.Failed(i) != nil {
+			continue
+		}
+		for _, sub := range subs[msg.Topic] {
+			if err := sub.enqueue(ctx, msg.clone(), timeout.C); err != nil {
+				batchErr.add(i, err)
+				break
+			}
+		}
+	}
+	return batchErr.orNil()
+}
+
+// Subscribe registers a handler for messages published to topic
+func (mq *MessageQueue) Subscribe(topic string, handler Handler) (*Subscription, error) {
+	return mq.SubscribeWithOptions(topic, handler, SubscribeOptions{})
+}
+
+// SubscribeWithOptions registers a handler for messages published to topic
+func (mq *MessageQueue) SubscribeWithOptions(topic string, handler Handler, opts SubscribeOptions) (*Subscription, error) {
+	sub, err := newSubscription(topic, handler, nil, opts, mq.size)
+	if err != nil {
+		return nil, err
+	}
+	mq.addSubscription(sub)
+	sub.start()
+	return sub, nil
+}
+
+// SubscribeBatch registers a handler that receives messages published to
+// topic in batches of up to opts.MaxSize, waiting at most opts.MaxWait to
+// fill a batch
+func (mq *MessageQueue) SubscribeBatch(topic string, handler BatchHandler, opts BatchOptions) (*Subscription, error) {
+	sub, err := newSubscription(topic, nil, handler, opts.subscribeOptions(), mq.size)
+	if err != nil {
+		return nil, err
+	}
+	mq.addSubscription(sub)
+	sub.start()
+	return sub, nil
+}
+
+// Close unsubscribes every subscription
+func (mq *MessageQueue) Close() error {
+	mq.mutex.RLock()
+	var subs []*Subscription
+	for _, topicSubs := range mq.subscriptions {
+		subs = append(subs, topicSubs...)
+	}
+	mq.mutex.RUnlock()
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+	return nil
+}
+
+// matchingSubscriptions returns the subscriptions whose pattern matches
+// topic. The caller must hold the mutex.
+func (mq *MessageQueue) matchingSubscriptions(topic string) []*Subscription {
+	subs := mq.subscriptions[topic]
+	for pattern, patternSubs := range mq.subscriptions {
+		if pattern != topic && TopicMatches(pattern, topic) {
+			subs = append(subs[:len(subs):len(subs)], patternSubs...)
+		}
+	}
+	return subs
+}
+
+// addSubscription attaches a subscription to its topic
+func (mq *MessageQueue) addSubscription(sub *Subscription) {
+	sub.onClose = func() { mq.removeSubscription(sub) }
+
+	mq.mutex.Lock()
+	mq.subscriptions[sub.topic] = append(mq.subscriptions[sub.topic], sub)
+	mq.mutex.Unlock()
+}
+
+// removeSubscription detaches a subscription from its topic
+func (mq *MessageQueue) removeSubscription(sub *Subscription) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	subs := mq.subscriptions[sub.topic]
+	for i, s := range subs {
+		if s == sub {
+			mq.subscriptions[sub.topic] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(mq.subscriptions[sub.topic]) == 0 {
+		delete(mq.subscriptions, sub.topic)
+	}
+}
@@ -0,0 +1,374 @@
+package mqclient
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// DedupStatus is the recorded outcome of processing a message
+type DedupStatus string
+
+const (
+	DedupProcessed DedupStatus = "processed" // Handler acked the message
+	DedupFailed    DedupStatus = "failed"    // Handler nacked the message, redelivery is allowed
+)
+
+// DedupRecord is the outcome recorded for a deduplication key
+type DedupRecord struct {
+	Status    DedupStatus `json:"status"`
+	Attempts  int         `json:"attempts"`
+	Error     string      `json:"error,omitempty"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// DedupStore persists processing outcomes by deduplication key
+type DedupStore interface {
+	// Get returns the record for key, or nil if the key is unknown or expired
+	Get(key string) (*DedupRecord, error)
+	// Put records the outcome for key
+	Put(key string, record DedupRecord) error
+}
+
+// KeyFunc extracts the deduplication key from a message
+type KeyFunc func(msg *Message) string
+
+// MessageIDKey uses the message ID as the deduplication key
+func MessageIDKey(msg *Message) string {
+	return msg.ID
+}
+
+// DedupConfig configures the deduplication layer of a subscription
+type DedupConfig struct {
+	Store   DedupStore // Where outcomes are recorded (default in-memory, 10000 keys, 1h TTL)
+	KeyFunc KeyFunc    // How the key is derived (default MessageIDKey)
+}
+
+// Deduplicate wraps a handler so that messages whose key was already
+// processed successfully are acked without running the handler again.
+// Messages without a key are always processed.
+func Deduplicate(handler Handler, cfg DedupConfig) Handler {
+	if cfg.Store == nil {
+		cfg.Store = NewMemoryDedupStore(10000, time.Hour)
+	}
+	if cfg.KeyFunc == nil {
+		cfg.KeyFunc = MessageIDKey
+	}
+
+	// inFlight serializes concurrent deliveries of the same key so that a
+	// duplicate arriving mid-processing sees the first outcome
+	var mutex sync.Mutex
+	inFlight := make(map[string]*dedupLock)
+
+	return func(ctx context.Context, msg *Message) error {
+		key := cfg.KeyFunc(msg)
+		if key == "" {
+			return handler(ctx, msg)
+		}
+
+		mutex.Lock()
+		lock, ok := inFlight[key]
+		if !ok {
+			lock = &dedupLock{}
+			inFlight[key] = lock
+		}
+		lock.refs++
+		mutex.Unlock()
+
+		lock.Lock()
+		defer func() {
+			lock.Unlock()
+			mutex.Lock()
+			lock.refs--
+			if lock.refs == 0 {
+				delete(inFlight, key)
+			}
+			mutex.Unlock()
+		}()
+
+		record, err := cfg.Store.Get(key)
+		if err != nil {
+			return fmt.Errorf("failed to look up dedup key %s: %v", key, err)
+		}
+		if record != nil && record.Status == DedupProcessed {
+			return nil
+		}
+
+		attempts := 1
+		if record != nil {
+			attempts = record.Attempts + 1
+		}
+
+		handlerErr := handler(ctx, msg)
+
+		outcome := DedupRecord{
+			Status:    DedupProcessed,
+			Attempts:  attempts,
+			UpdatedAt: time.Now(),
+		}
+		if handlerErr != nil {
+			outcome.Status = DedupFailed
+			outcome.Error = handlerErr.Error()
+		}
+		if err := cfg.Store.Put(key, outcome); err != nil && handlerErr == nil {
+			return fmt.Errorf("failed to record dedup key %s: %v", key, err)
+		}
+		return handlerErr
+	}
+}
+
+// dedupLock serializes deliveries of a key; refs counts the deliveries
+// holding or waiting for it so that it is dropped only when none are left
+type dedupLock struct {
+	sync.Mutex
+	refs int
+}
+
+// MemoryDedupStore is an in-memory LRU dedup store with a TTL
+type MemoryDedupStore struct {
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List
+	mutex    sync.Mutex
+}
+
+type memoryDedupEntry struct {
+	key    string
+	record DedupRecord
+}
+
+// NewMemoryDedupStore creates a store holding at most capacity keys, each
+// expiring ttl after it was last recorded. A zero ttl never expires keys.
+func NewMemoryDedupStore(capacity int, ttl time.Duration) *MemoryDedupStore {
+	if capacity <= 0 {
+		capacity = 10000
+	}
+	return &MemoryDedupStore{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get returns the record for key
+func (s *MemoryDedupStore) Get(key string) (*DedupRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	entry := elem.Value.(*memoryDedupEntry)
+	if s.ttl > 0 && time.Since(entry.record.UpdatedAt) > s.ttl {
+		s.order.Remove(elem)
+		delete(s.entries, key)
+		return nil, nil
+	}
+	s.order.MoveToFront(elem)
+	record := entry.record
+	return &record, nil
+}
+
+// Put records the outcome for key, evicting the least recently used key
+// when the store is full
+func (s *MemoryDedupStore) Put(key string, record DedupRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if elem, ok := s.entries[key]; ok {
+		elem.Value.(*memoryDedupEntry).record = record
+		s.order.MoveToFront(elem)
+		return nil
+	}
+
+	s.entries[key] = s.order.PushFront(&memoryDedupEntry{key: key, record: record})
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*memoryDedupEntry).key)
+	}
+	return nil
+}
+
+// Len returns the number of keys held by the store
+func (s *MemoryDedupStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.order.Len()
+}
+
+// FileDedupStore is a dedup store that survives restarts by appending
+// records to a JSON lines file. Records are cached in memory and the file
+// is rewritten on Compact.
+type FileDedupStore struct {
+	path    string
+	ttl     time.Duration
+	records map[string]DedupRecord
+	file    *os.File
+	mutex   sync.Mutex
+}
+
+type fileDedupLine struct {
+	Key string `json:"key"`
+	DedupRecord
+}
+
+// NewFileDedupStore opens or creates the store at path and loads the records
+// that have not expired. A zero ttl never expires keys.
+func NewFileDedupStore(path string, ttl time.Duration) (*FileDedupStore, error) {
+	s := &FileDedupStore{
+		path:    path,
+		ttl:     ttl,
+		records: make(map[string]DedupRecord),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dedup store %s: %v", path, err)
+	}
+	s.file = file
+	return s, nil
+}
+
+// load reads existing records from the file
+func (s *FileDedupStore) load() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open dedup store %s: %v", s.path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line fileDedupLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			// A torn final line from a crash is skipped rather than fatal
+			continue
+		}
+		if s.expired(line.DedupRecord) {
+			delete(s.records, line.Key)
+			continue
+		}
+		s.records[line.Key] = line.DedupRecord
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read dedup store %s: %v", s.path, err)
+	}
+	return nil
+}
+
+// expired reports whether a record is past the TTL
+func (s *FileDedupStore) expired(record DedupRecord) bool {
+	return s.ttl > 0 && time.Since(record.UpdatedAt) > s.ttl
+}
+
+// Get returns the record for key
+func (s *FileDedupStore) Get(key string) (*DedupRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.records[key]
+	if !ok {
+		return nil, nil
+	}
+	if s.expired(record) {
+		delete(s.records, key)
+		return nil, nil
+	}
+	return &record, nil
+}
+
+// Put records the outcome for key and appends it to the file
+func (s *FileDedupStore) Put(key string, record DedupRecord) error {
+	data, err := json.Marshal(fileDedupLine{Key: key, DedupRecord: record})
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("dedup store %s is closed", s.path)
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write dedup store %s: %v", s.path, err)
+	}
+	s.records[key] = record
+	return nil
+}
+
+// Compact rewrites the file with only the live records
+func (s *FileDedupStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("dedup store %s is closed", s.path)
+	}
+
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to compact dedup store %s: %v", s.path, err)
+	}
+	writer := bufio.NewWriter(tmp)
+	for key, record := range s.records {
+		if s.expired(record) {
+			delete(s.records, key)
+			continue
+		}
+		data, err := json.Marshal(fileDedupLine{Key: key, DedupRecord: record})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		writer.Write(append(data, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to compact dedup store %s: %v", s.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to compact dedup store %s: %v", s.path, err)
+	}
+
+	s.file.Close()
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to compact dedup store %s: %v", s.path, err)
+	}
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		s.file = nil
+		return fmt.Errorf("failed to reopen dedup store %s: %v", s.path, err)
+	}
+	s.file = file
+	return nil
+}
+
+// Close closes the underlying file
+func (s *FileDedupStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,337 @@
+package mqclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// KafkaAcks is the number of broker acknowledgements a produce waits for
+type KafkaAcks int
+
+const (
+	KafkaAcksAll    KafkaAcks = iota // Wait for all in-sync replicas
+	KafkaAcksLeader                  // Wait for the partition leader only
+	KafkaAcksNone                    // Fire and forget
+)
+
+// KafkaMessageIDHeader is the record header carrying Message.ID
+const KafkaMessageIDHeader = "microcomms-message-id"
+
+// KafkaConfig holds configuration for the Kafka broker
+type KafkaConfig struct {
+	Brokers       []string  // Seed broker addresses
+	ClientID      string    // Client ID sent to the brokers
+	Acks          KafkaAcks // Producer acknowledgement level (default KafkaAcksAll)
+	ConsumerGroup string    // Default consumer group for subscriptions without a Group
+	QueueSize     int       // Messages buffered per subscription (default 100)
+}
+
+// KafkaBroker is a Broker backed by Kafka. Message.Key is used as the record
+// key, so messages sharing a key land on the same partition and keep their
+// order. Subscriptions join a consumer group and commit offsets only after
+// every message of a fetch has been settled, giving at-least-once delivery.
+type KafkaBroker struct {
+	config   KafkaConfig
+	producer *kgo.Client
+
+	mutex sync.Mutex
+	subs  map[*Subscription]struct{}
+}
+
+var _ Broker = (*KafkaBroker)(nil)
+
+// NewKafkaBroker creates a Kafka broker client
+func NewKafkaBroker(config KafkaConfig) (*KafkaBroker, error) {
+	if len(config.Brokers) == 0 {
+		return nil, fmt.Errorf("at least one Kafka broker address is required")
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 100
+	}
+
+	opts := config.clientOpts()
+	switch config.Acks {
+	case KafkaAcksNone:
+		opts = append(opts, kgo.RequiredAcks(kgo.NoAck()), kgo.DisableIdempotentWrite())
+	case KafkaAcksLeader:
+		opts = append(opts, kgo.RequiredAcks(kgo.LeaderAck()), kgo.DisableIdempotentWrite())
+	case KafkaAcksAll:
+		opts = append(opts, kgo.RequiredAcks(kgo.AllISRAcks()))
+	default:
+		return nil, fmt.Errorf("invalid Kafka acks level: %d", config.Acks)
+	}
+
+	producer, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka producer: %v", err)
+	}
+
+	return &KafkaBroker{
+		config:   config,
+		producer: producer,
+		subs:     make(map[*Subscription]struct{}),
+	}, nil
+}
+
+// clientOpts returns the options shared by producer and consumer clients
+func (c KafkaConfig) clientOpts() []kgo.Opt {
+	opts := []kgo.Opt{kgo.SeedBrokers(c.Brokers...)}
+	if c.ClientID != "" {
+		opts = append(opts, kgo.ClientID(c.ClientID))
+	}
+	return opts
+}
+
+// Publish produces a message and waits for the configured acks
+func (k *KafkaBroker) Publish(ctx context.Context, msg *Message) error {
+	if err := prepareMessage(msg); err != nil {
+		return err
+	}
+	if err := k.producer.ProduceSync(ctx, toKafkaRecord(msg)).FirstErr(); err != nil {
+		return fmt.Errorf("failed to publish message %s: %v", msg.ID, err)
+	}
+	return nil
+}
+
+// PublishBatch produces all messages together and waits for their acks
+func (k *KafkaBroker) PublishBatch(ctx context.Context, msgs []*Message) error {
+	batchErr := &BatchError{}
+	records := make([]*kgo.Record, 0, len(msgs))
+	indexes := make([]int, 0, len(msgs))
+	for i, msg := range msgs {
+		if err := prepareMessage(msg); err != nil {
+			batchErr.add(i, err)
+			continue
+		}
+		records = append(records, toKafkaRecord(msg))
+		indexes = append(indexes, i)
+	}
+
+	results := k.producer.ProduceSync(ctx, records...)
+	for j, result := range results {
+		if result.Err != nil {
+			batchErr.add(indexes[j], result.Err)
+		}
+	}
+	return batchErr.orNil()
+}
+
+// SubscribeWithOptions joins the consumer group for topic
+func (k *KafkaBroker) SubscribeWithOptions(topic string, handler Handler, opts SubscribeOptions) (*Subscription, error) {
+	sub, err := newSubscription(topic, handler, nil, opts, k.config.QueueSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.consume(sub); err != nil {
+		sub.Unsubscribe()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// SubscribeBatch joins the consumer group for topic and delivers in batches
+func (k *KafkaBroker) SubscribeBatch(topic string, handler BatchHandler, opts BatchOptions) (*Subscription, error) {
+	sub, err := newSubscription(topic, nil, handler, opts.subscribeOptions(), k.config.QueueSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := k.consume(sub); err != nil {
+		sub.Unsubscribe()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// consume creates the group consumer for a subscription and starts polling
+func (k *KafkaBroker) consume(sub *Subscription) error {
+	group := sub.options.Group
+	if group == "" {
+		group = k.config.ConsumerGroup
+	}
+	if group == "" {
+		return fmt.Errorf("a consumer group is required to subscribe to Kafka topic %s", sub.topic)
+	}
+
+	opts := append(k.config.clientOpts(),
+		kgo.ConsumerGroup(group),
+		kgo.ConsumeTopics(sub.topic),
+		kgo.DisableAutoCommit(),
+		kgo.BlockRebalanceOnPoll(),
+	)
+	consumer, err := kgo.NewClient(opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create Kafka consumer: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub.onClose = func() {
+		cancel()
+		k.mutex.Lock()
+		delete(k.subs, sub)
+		k.mutex.Unlock()
+	}
+
+	k.mutex.Lock()
+	k.subs[sub] = struct{}{}
+	k.mutex.Unlock()
+
+	sub.start()
+	sub.wg.Add(1)
+	go k.poll(ctx, consumer, sub)
+	return nil
+}
+
+// poll fetches records, hands them to the subscription and commits the
+// offsets of a fetch once all of its messages have been settled. Rebalances
+// are blocked between a poll and its commit so that no other group member
+// can be handed a partition whose records are still being processed. When
+// the subscription closes mid-fetch, the records settled so far are committed
+// so that only unprocessed records are redelivered to the group.
+func (k *KafkaBroker) poll(ctx context.Context, consumer *kgo.Client, sub *Subscription) {
+	defer sub.wg.Done()
+	defer consumer.Close()
+
+	for {
+		fetches := consumer.PollFetches(ctx)
+		if fetches.IsClientClosed() || ctx.Err() != nil {
+			return
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			if !errors.Is(err, context.Canceled) {
+				log.Printf("Kafka fetch from %s[%d] failed: %v", topic, partition, err)
+			}
+		})
+
+		records := fetches.Records()
+		var mutex sync.Mutex
+		settled := make([]bool, len(records))
+		remaining := make(chan struct{}, len(records))
+		for i, record := range records {
+			i := i
+			msg := fromKafkaRecord(record)
+			msg.settle = func(error) {
+				mutex.Lock()
+				settled[i] = true
+				mutex.Unlock()
+				remaining <- struct{}{}
+			}
+			if err := sub.enqueue(ctx, msg, nil); err != nil {
+				break
+			}
+		}
+
+		for range records {
+			select {
+			case <-remaining:
+			case <-sub.done:
+				<-sub.stopped
+				mutex.Lock()
+				commit := settledPrefix(records, settled)
+				mutex.Unlock()
+				k.commit(consumer, sub.topic, commit)
+				return
+			}
+		}
+
+		k.commit(consumer, sub.topic, records)
+		consumer.AllowRebalance()
+	}
+}
+
+// commit commits the offsets of records. It does not use the poll context so
+// that processed records are still committed while the subscription closes.
+func (k *KafkaBroker) commit(consumer *kgo.Client, topic string, records []*kgo.Record) {
+	if len(records) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := consumer.CommitRecords(ctx, records...); err != nil {
+		log.Printf("Failed to commit Kafka offsets for topic %s: %v", topic, err)
+	}
+}
+
+// settledPrefix returns, for each partition, the records up to but excluding
+// the first one that has not been settled. Committing a later offset would
+// skip the unsettled record.
+func settledPrefix(records []*kgo.Record, settled []bool) []*kgo.Record {
+	blocked := make(map[string]map[int32]bool)
+	var prefix []*kgo.Record
+	for i, record := range records {
+		if blocked[record.Topic] == nil {
+			blocked[record.Topic] = make(map[int32]bool)
+		}
+		if blocked[record.Topic][record.Partition] {
+			continue
+		}
+		if !settled[i] {
+			blocked[record.Topic][record.Partition] = true
+			continue
+		}
+		prefix = append(prefix, record)
+	}
+	return prefix
+}
+
+// Close stops all subscriptions and flushes and closes the producer
+func (k *KafkaBroker) Close() error {
+	k.mutex.Lock()
+	subs := make([]*Subscription, 0, len(k.subs))
+	for sub := range k.subs {
+		subs = append(subs, sub)
+	}
+	k.mutex.Unlock()
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+	k.producer.Close()
+	return nil
+}
+
+// toKafkaRecord converts a message to a Kafka record
+func toKafkaRecord(msg *Message) *kgo.Record {
+	record := &kgo.Record{
+		Topic:     msg.Topic,
+		Value:     msg.Payload,
+		Timestamp: msg.Timestamp,
+		Headers:   []kgo.RecordHeader{{Key: KafkaMessageIDHeader, Value: []byte(msg.ID)}},
+	}
+	if msg.Key != "" {
+		record.Key = []byte(msg.Key)
+	}
+	for k, v := range msg.Headers {
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: k, Value: []byte(v)})
+	}
+	return record
+}
+
+// fromKafkaRecord converts a consumed Kafka record to a message
+func fromKafkaRecord(record *kgo.Record) *Message {
+	msg := &Message{
+		Topic:     record.Topic,
+		Key:       string(record.Key),
+		Payload:   record.Value,
+		Timestamp: record.Timestamp,
+	}
+	for _, header := range record.Headers {
+		if header.Key == KafkaMessageIDHeader {
+			msg.ID = string(header.Value)
+			continue
+		}
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers[header.Key] = string(header.Value)
+	}
+	if msg.ID == "" {
+		msg.ID = fmt.Sprintf("%s-%d-%d", record.Topic, record.Partition, record.Offset)
+	}
+	return msg
+}
@@ -0,0 +1,74 @@
+package mqclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Message is a message published to or delivered from a topic
+type Message struct {
+	ID         string
+	Topic      string
+	Key        string
+	Payload    []byte
+	Headers    map[string]string
+	Timestamp  time.Time
+	Deliveries int // Number of times this message has been delivered
+
+	// settle is set by brokers that need to know the final outcome of a
+	// delivered message; a nil error acks it
+	settle func(err error)
+}
+
+// Handler processes a delivered message. Returning nil acks the message,
+// returning an error nacks it so that it may be redelivered.
+type Handler func(ctx context.Context, msg *Message) error
+
+// NewMessageID generates a random message ID
+func NewMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// clone returns a copy of the message that is safe to hand to a subscriber
+func (m *Message) clone() *Message {
+	c := *m
+	if m.Headers != nil {
+		c.Headers = make(map[string]string, len(m.Headers))
+		for k, v := range m.Headers {
+			c.Headers[k] = v
+		}
+	}
+	return &c
+}
+
+// TopicMatches reports whether topic matches a subscription pattern. Topics
+// are dot-separated tokens, as in NATS subjects: "*" in a pattern matches
+// exactly one token and a trailing ">" matches one or more tokens, so
+// "orders.*" matches "orders.created" and "orders.>" also matches
+// "orders.eu.created".
+func TopicMatches(pattern, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+	patternTokens := strings.Split(pattern, ".")
+	topicTokens := strings.Split(topic, ".")
+	for i, token := range patternTokens {
+		if token == ">" && i == len(patternTokens)-1 {
+			return len(topicTokens) > i
+		}
+		if i >= len(topicTokens) {
+			return false
+		}
+		if token != "*" && token != topicTokens[i] {
+			return false
+		}
+	}
+	return len(patternTokens) == len(topicTokens)
+}
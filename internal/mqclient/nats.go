@@ -0,0 +1,394 @@
+package mqclient
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// NATSKeyHeader is the message header carrying Message.Key
+const NATSKeyHeader = "Microcomms-Key"
+
+// NATSConfig holds configuration for the NATS broker
+type NATSConfig struct {
+	URL           string        // Server URL (default nats://127.0.0.1:4222)
+	Name          string        // Connection name shown by the server
+	MaxReconnects int           // Reconnect attempts before giving up (default 60, -1 retries forever)
+	ReconnectWait time.Duration // Delay between reconnect attempts (default 2s)
+	QueueSize     int           // Messages buffered per subscription (default 100)
+	// EnqueueTimeout bounds how long a delivery waits for room in a full
+	// subscription queue, holding up the connection's dispatcher. A message
+	// that times out is dropped with core NATS and nak'ed with JetStream.
+	// (default 5s)
+	EnqueueTimeout time.Duration
+
+	// JetStream switches publishing and subscriptions from core NATS to
+	// JetStream, giving durable consumers and at-least-once delivery
+	JetStream      bool
+	Stream         string        // Stream that holds the topics' messages
+	StreamSubjects []string      // When set, the stream is created or updated with these subjects
+	AckWait        time.Duration // Time the server waits for an ack before redelivering (default 30s)
+}
+
+// NATSBroker is a Broker backed by NATS. Topics are NATS subjects, so
+// subscriptions may use the "*" and ">" wildcards (see TopicMatches) and
+// delivered messages carry the concrete subject as their topic.
+//
+// With core NATS delivery is at-most-once: a nacked message is retried
+// locally up to MaxDeliveries and there is nothing to ack. A Group maps onto
+// a queue group, so members share the topic's messages.
+//
+// With JetStream each subscription is a pull consumer on the configured
+// stream, durable when a Group is given. Acks and nacks are passed to the
+// server: an acked message is Ack'ed, a nacked one is Nak'ed for immediate
+// redelivery by the server (which also tracks Message.Deliveries), and one
+// that fails on its last delivery is Term'ed. MaxDeliveries becomes the
+// consumer's MaxDeliver.
+type NATSBroker struct {
+	config NATSConfig
+	conn   *nats.Conn
+	js     jetstream.JetStream
+
+	mutex sync.Mutex
+	subs  map[*Subscription]struct{}
+}
+
+var _ Broker = (*NATSBroker)(nil)
+
+// NewNATSBroker connects to NATS and, for JetStream, prepares the stream
+func NewNATSBroker(config NATSConfig) (*NATSBroker, error) {
+	if config.URL == "" {
+		config.URL = nats.DefaultURL
+	}
+	if config.MaxReconnects == 0 {
+		config.MaxReconnects = nats.DefaultMaxReconnect
+	}
+	if config.ReconnectWait <= 0 {
+		config.ReconnectWait = nats.DefaultReconnectWait
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 100
+	}
+	if config.AckWait <= 0 {
+		config.AckWait = 30 * time.Second
+	}
+	if config.EnqueueTimeout <= 0 {
+		config.EnqueueTimeout = 5 * time.Second
+	}
+	if config.JetStream && config.Stream == "" {
+		return nil, fmt.Errorf("a stream is required to use JetStream")
+	}
+
+	conn, err := nats.Connect(config.URL,
+		nats.Name(config.Name),
+		nats.MaxReconnects(config.MaxReconnects),
+		nats.ReconnectWait(config.ReconnectWait),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("Disconnected from NATS: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Printf("Reconnected to NATS at %s", nc.ConnectedUrl())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			if err := nc.LastError(); err != nil {
+				log.Printf("NATS connection closed: %v", err)
+			}
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %v", err)
+	}
+
+	broker := &NATSBroker{
+		config: config,
+		conn:   conn,
+		subs:   make(map[*Subscription]struct{}),
+	}
+	if !config.JetStream {
+		return broker, nil
+	}
+
+	broker.js, err = jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	if len(config.StreamSubjects) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := broker.js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:     config.Stream,
+			Subjects: config.StreamSubjects,
+		})
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to create JetStream stream %s: %v", config.Stream, err)
+		}
+	}
+	return broker, nil
+}
+
+// Publish sends a message to its subject. With JetStream it waits for the
+// stream to store the message; the message ID is used for the stream's
+// duplicate detection.
+func (n *NATSBroker) Publish(ctx context.Context, msg *Message) error {
+	if err := prepareMessage(msg); err != nil {
+		return err
+	}
+
+	if n.js != nil {
+		if _, err := n.js.PublishMsg(ctx, toNATSMsg(msg)); err != nil {
+			return fmt.Errorf("failed to publish message %s: %v", msg.ID, err)
+		}
+		return nil
+	}
+	if err := n.conn.PublishMsg(toNATSMsg(msg)); err != nil {
+		return fmt.Errorf("failed to publish message %s: %v", msg.ID, err)
+	}
+	return nil
+}
+
+// PublishBatch sends all messages before waiting once: for core NATS a
+// single flush, for JetStream the stream acks of the async publishes
+func (n *NATSBroker) PublishBatch(ctx context.Context, msgs []*Message) error {
+	batchErr := &BatchError{}
+
+	if n.js == nil {
+		for i, msg := range msgs {
+			if err := prepareMessage(msg); err != nil {
+				batchErr.add(i, err)
+				continue
+			}
+			if err := n.conn.PublishMsg(toNATSMsg(msg)); err != nil {
+				batchErr.add(i, err)
+			}
+		}
+		if err := n.conn.FlushWithContext(ctx); err != nil {
+			for i := range msgs {
+				if batchErr.Failed(i) == nil {
+					batchErr.add(i, err)
+				}
+			}
+		}
+		return batchErr.orNil()
+	}
+
+	futures := make(map[int]jetstream.PubAckFuture, len(msgs))
+	for i, msg := range msgs {
+		if err := prepareMessage(msg); err != nil {
+			batchErr.add(i, err)
+			continue
+		}
+		future, err := n.js.PublishMsgAsync(toNATSMsg(msg))
+		if err != nil {
+			batchErr.add(i, err)
+			continue
+		}
+		futures[i] = future
+	}
+	for i, future := range futures {
+		select {
+		case <-future.Ok():
+		case err := <-future.Err():
+			batchErr.add(i, err)
+		case <-ctx.Done():
+			batchErr.add(i, ctx.Err())
+		}
+	}
+	return batchErr.orNil()
+}
+
+// SubscribeWithOptions subscribes to a subject, which may contain wildcards
+func (n *NATSBroker) SubscribeWithOptions(topic string, handler Handler, opts SubscribeOptions) (*Subscription, error) {
+	sub, err := newSubscription(topic, handler, nil, opts, n.config.QueueSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.consume(sub); err != nil {
+		sub.Unsubscribe()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// SubscribeBatch subscribes to a subject and delivers messages in batches
+func (n *NATSBroker) SubscribeBatch(topic string, handler BatchHandler, opts BatchOptions) (*Subscription, error) {
+	sub, err := newSubscription(topic, nil, handler, opts.subscribeOptions(), n.config.QueueSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.consume(sub); err != nil {
+		sub.Unsubscribe()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// consume starts feeding a subscription from core NATS or JetStream
+func (n *NATSBroker) consume(sub *Subscription) error {
+	var stop func()
+	if n.js != nil {
+		consumeCtx, err := n.consumeJetStream(sub)
+		if err != nil {
+			return err
+		}
+		stop = consumeCtx.Stop
+	} else {
+		natsSub, err := n.consumeCore(sub)
+		if err != nil {
+			return err
+		}
+		stop = func() { natsSub.Unsubscribe() }
+	}
+
+	sub.onClose = func() {
+		stop()
+		n.mutex.Lock()
+		delete(n.subs, sub)
+		n.mutex.Unlock()
+	}
+
+	n.mutex.Lock()
+	n.subs[sub] = struct{}{}
+	n.mutex.Unlock()
+
+	sub.start()
+	return nil
+}
+
+// consumeCore subscribes with core NATS, using a queue group for Group
+func (n *NATSBroker) consumeCore(sub *Subscription) (*nats.Subscription, error) {
+	callback := func(m *nats.Msg) {
+		msg := fromNATSMsg(m.Subject, m.Header, m.Data)
+		msg.Timestamp = time.Now()
+		if err := n.enqueue(sub, msg); err != nil && err != ErrSubscriptionClosed {
+			log.Printf("Message on subject %s dropped: %v", m.Subject, err)
+		}
+	}
+
+	var natsSub *nats.Subscription
+	var err error
+	if sub.options.Group != "" {
+		natsSub, err = n.conn.QueueSubscribe(sub.topic, sub.options.Group, callback)
+	} else {
+		natsSub, err = n.conn.Subscribe(sub.topic, callback)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to NATS subject %s: %v", sub.topic, err)
+	}
+	return natsSub, nil
+}
+
+// consumeJetStream creates a pull consumer on the stream filtered to the
+// subscription topic and maps settle outcomes onto JetStream acks
+func (n *NATSBroker) consumeJetStream(sub *Subscription) (jetstream.ConsumeContext, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	consumer, err := n.js.CreateOrUpdateConsumer(ctx, n.config.Stream, jetstream.ConsumerConfig{
+		Durable:       sub.options.Group,
+		FilterSubject: sub.topic,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       n.config.AckWait,
+		MaxDeliver:    sub.options.MaxDeliveries,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream consumer for %s: %v", sub.topic, err)
+	}
+
+	sub.brokerRedelivery = true
+	maxDeliveries := sub.options.MaxDeliveries
+	return consumer.Consume(func(m jetstream.Msg) {
+		msg := fromNATSMsg(m.Subject(), m.Headers(), m.Data())
+		if meta, err := m.Metadata(); err == nil {
+			msg.Timestamp = meta.Timestamp
+			// The subscription counts the delivery it is about to make
+			msg.Deliveries = int(meta.NumDelivered) - 1
+		}
+		msg.settle = func(err error) {
+			switch {
+			case err == nil:
+				m.Ack()
+			case msg.Deliveries >= maxDeliveries:
+				m.TermWithReason(err.Error())
+			default:
+				m.Nak()
+			}
+		}
+		if err := n.enqueue(sub, msg); err != nil {
+			// Let the server redeliver it once the queue has drained
+			m.NakWithDelay(n.config.EnqueueTimeout)
+		}
+	}, jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+		log.Printf("JetStream consumer for %s: %v", sub.topic, err)
+	}))
+}
+
+// enqueue hands a delivered message to a subscription, waiting at most
+// EnqueueTimeout for room in its queue
+func (n *NATSBroker) enqueue(sub *Subscription, msg *Message) error {
+	timeout := time.NewTimer(n.config.EnqueueTimeout)
+	defer timeout.Stop()
+	return sub.enqueue(context.Background(), msg, timeout.C)
+}
+
+// Close stops all subscriptions and drains the connection
+func (n *NATSBroker) Close() error {
+	n.mutex.Lock()
+	subs := make([]*Subscription, 0, len(n.subs))
+	for sub := range n.subs {
+		subs = append(subs, sub)
+	}
+	n.mutex.Unlock()
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+	return n.conn.Drain()
+}
+
+// toNATSMsg converts a message to a NATS message
+func toNATSMsg(msg *Message) *nats.Msg {
+	m := nats.NewMsg(msg.Topic)
+	m.Data = msg.Payload
+	for k, v := range msg.Headers {
+		m.Header.Set(k, v)
+	}
+	m.Header.Set(nats.MsgIdHdr, msg.ID)
+	if msg.Key != "" {
+		m.Header.Set(NATSKeyHeader, msg.Key)
+	}
+	return m
+}
+
+// fromNATSMsg converts a received NATS message to a message
+func fromNATSMsg(subject string, header nats.Header, data []byte) *Message {
+	msg := &Message{
+		Topic:   subject,
+		Payload: data,
+	}
+	for k := range header {
+		switch k {
+		case nats.MsgIdHdr:
+			msg.ID = header.Get(k)
+		case NATSKeyHeader:
+			msg.Key = header.Get(k)
+		default:
+			if msg.Headers == nil {
+				msg.Headers = make(map[string]string)
+			}
+			msg.Headers[k] = header.Get(k)
+		}
+	}
+	if msg.ID == "" {
+		msg.ID = NewMessageID()
+	}
+	return msg
+}
@@ -0,0 +1,72 @@
+package mqclient
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// LaneFor returns the ordered lane for a partition key. Keys are spread with
+// an FNV-1a hash so that every message with the same key lands on the same
+// lane for a fixed lane count.
+func LaneFor(key string, lanes int) int {
+	if lanes <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(lanes))
+}
+
+// runOrdered partitions queued messages by Message.Key into ordered lanes.
+// Each lane has a single worker, so messages sharing a key are handled one
+// at a time in publish order (including redeliveries of a nacked message,
+// which block the lane until they succeed or are dropped), while different
+// lanes run concurrently. Messages without a key carry no ordering
+// requirement and are spread across lanes round-robin.
+//
+// Rebalancing: lane assignment is hash(key) mod lanes and is only stable for
+// a fixed lane count within one subscription. Ordering is not preserved
+// across subscriptions, so when the number of lanes or consumers on a topic
+// changes, keys move to different lanes and per-key order holds only if the
+// old subscription is drained with Unsubscribe (which waits for in-flight
+// messages) before the replacement starts consuming.
+func (s *Subscription) runOrdered(lanes int) {
+	queues := make([]chan *Message, lanes)
+	var workers sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan *Message, cap(s.messages))
+		workers.Add(1)
+		go func(queue chan *Message) {
+			defer workers.Done()
+			for {
+				select {
+				case <-s.done:
+					return
+				case msg := <-queue:
+					s.deliver(msg)
+				}
+			}
+		}(queues[i])
+	}
+	defer workers.Wait()
+
+	next := 0
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.messages:
+			lane := next
+			if msg.Key != "" {
+				lane = LaneFor(msg.Key, lanes)
+			} else {
+				next = (next + 1) % lanes
+			}
+			select {
+			case queues[lane] <- msg:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
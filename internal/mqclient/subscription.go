@@ -0,0 +1,181 @@
+package mqclient
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// SubscribeOptions configures a topic subscription
+type SubscribeOptions struct {
+	MaxDeliveries int          // Deliveries before a nacked message is dropped (default 3)
+	Dedup         *DedupConfig // Skip messages that were already processed
+	OrderedLanes  int          // Process messages serially per Message.Key across this many lanes
+	Group         string       // Consumer group sharing the topic, for brokers that support groups
+
+	batchSize int
+	batchWait time.Duration
+}
+
+// Subscription is an active topic subscription. Brokers feed it messages and
+// it takes care of dispatching them to the handler, redelivering nacked
+// messages and reporting the final outcome of each message back to the
+// broker through the message's settle hook.
+type Subscription struct {
+	topic        string
+	handler      Handler
+	batchHandler BatchHandler
+	options      SubscribeOptions
+	messages     chan *Message
+	done         chan struct{}
+	stopped      chan struct{} // Closed once the dispatch goroutines have exited
+	once         sync.Once
+	wg           sync.WaitGroup
+
+	// onClose detaches the subscription from its broker
+	onClose func()
+	// brokerRedelivery hands nacked messages straight back to a broker that
+	// redelivers them itself instead of retrying them locally
+	brokerRedelivery bool
+}
+
+// newSubscription validates the options and creates a subscription that is
+// not yet started
+func newSubscription(topic string, handler Handler, batchHandler BatchHandler, opts SubscribeOptions, size int) (*Subscription, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("subscription topic is required")
+	}
+	if handler == nil && batchHandler == nil {
+		return nil, fmt.Errorf("subscription handler is required")
+	}
+	if opts.MaxDeliveries <= 0 {
+		opts.MaxDeliveries = 3
+	}
+	if opts.Dedup != nil {
+		if handler != nil {
+			handler = Deduplicate(handler, *opts.Dedup)
+		}
+		if batchHandler != nil {
+			batchHandler = DeduplicateBatch(batchHandler, *opts.Dedup)
+		}
+	}
+	if size < opts.batchSize {
+		size = opts.batchSize
+	}
+	if size <= 0 {
+		size = 1
+	}
+
+	return &Subscription{
+		topic:        topic,
+		handler:      handler,
+		batchHandler: batchHandler,
+		options:      opts,
+		messages:     make(chan *Message, size),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}, nil
+}
+
+// start launches the dispatch goroutines
+func (s *Subscription) start() {
+	run := s.run
+	switch {
+	case s.batchHandler != nil:
+		run = s.runBatch
+	case s.options.OrderedLanes > 0:
+		run = func() { s.runOrdered(s.options.OrderedLanes) }
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(s.stopped)
+		run()
+	}()
+}
+
+// Topic returns the topic of the subscription
+func (s *Subscription) Topic() string {
+	return s.topic
+}
+
+// Unsubscribe stops delivery to the subscription and waits for the handler
+// to finish the message it is processing
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		if s.onClose != nil {
+			s.onClose()
+		}
+		close(s.done)
+	})
+	s.wg.Wait()
+}
+
+// enqueue hands a message to the subscription, giving up when timeout fires
+func (s *Subscription) enqueue(ctx context.Context, msg *Message, timeout <-chan time.Time) error {
+	select {
+	case <-s.done:
+		return ErrSubscriptionClosed
+	default:
+	}
+
+	select {
+	case s.messages <- msg:
+		return nil
+	case <-s.done:
+		return ErrSubscriptionClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		return fmt.Errorf("timeout sending message")
+	}
+}
+
+// run delivers queued messages to the handler until the subscription closes
+func (s *Subscription) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.messages:
+			s.deliver(msg)
+		}
+	}
+}
+
+// deliver runs the handler, redelivering nacked messages until MaxDeliveries
+func (s *Subscription) deliver(msg *Message) {
+	for {
+		msg.Deliveries++
+		err := s.handler(context.Background(), msg)
+		if err == nil {
+			s.finish(msg, nil)
+			return
+		}
+		if s.brokerRedelivery {
+			s.finish(msg, err)
+			return
+		}
+		if msg.Deliveries >= s.options.MaxDeliveries {
+			log.Printf("Message %s on topic %s dropped after %d deliveries: %v", msg.ID, s.topic, msg.Deliveries, err)
+			s.finish(msg, err)
+			return
+		}
+		select {
+		case <-s.done:
+			s.finish(msg, err)
+			return
+		default:
+		}
+	}
+}
+
+// finish reports the final outcome of a message to the broker
+func (s *Subscription) finish(msg *Message, err error) {
+	if msg.settle != nil {
+		msg.settle(err)
+	}
+}
@@ -0,0 +1,55 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ConsulStore keeps limits in the Consul KV store under <prefix>/<key>,
+// using the keys' modify indexes as versions
+type ConsulStore struct {
+	client *api.Client
+	prefix string
+}
+
+var _ Store = (*ConsulStore)(nil)
+
+// NewConsulStore creates a store for the Consul agent at addr, keeping
+// limits under prefix (default "microcomms/quotas")
+func NewConsulStore(addr, prefix string) (*ConsulStore, error) {
+	config := api.DefaultConfig()
+	if addr != "" {
+		config.Address = addr
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Consul client: %v", err)
+	}
+	if prefix == "" {
+		prefix = "microcomms/quotas"
+	}
+	return &ConsulStore{client: client, prefix: strings.Trim(prefix, "/")}, nil
+}
+
+// Get returns the value of key and its modify index
+func (s *ConsulStore) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	pair, _, err := s.client.KV().Get(s.prefix+"/"+key, (&api.QueryOptions{RequireConsistent: true}).WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	if pair == nil {
+		return nil, 0, nil
+	}
+	return pair.Value, pair.ModifyIndex, nil
+}
+
+// CompareAndSwap sets key to value with a check-and-set on its modify
+// index; index 0 only creates the key
+func (s *ConsulStore) CompareAndSwap(ctx context.Context, key string, version uint64, value []byte) (bool, error) {
+	pair := &api.KVPair{Key: s.prefix + "/" + key, Value: value, ModifyIndex: version}
+	swapped, _, err := s.client.KV().CAS(pair, (&api.WriteOptions{}).WithContext(ctx))
+	return swapped, err
+}
@@ -0,0 +1,66 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdStore keeps limits in etcd under <prefix>/<key>, using the keys' mod
+// revisions as versions
+type EtcdStore struct {
+	client *clientv3.Client
+	prefix string
+}
+
+var _ Store = (*EtcdStore)(nil)
+
+// NewEtcdStore creates a store for the etcd cluster at endpoints, keeping
+// limits under prefix (default "/microcomms/quotas")
+func NewEtcdStore(endpoints []string, prefix string) (*EtcdStore, error) {
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("at least one etcd endpoint is required")
+	}
+	client, err := clientv3.New(clientv3.Config{Endpoints: endpoints, DialTimeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create etcd client: %v", err)
+	}
+	if prefix == "" {
+		prefix = "/microcomms/quotas"
+	}
+	return &EtcdStore{client: client, prefix: strings.TrimSuffix(prefix, "/")}, nil
+}
+
+// Get returns the value of key and its mod revision
+func (s *EtcdStore) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	resp, err := s.client.Get(ctx, s.prefix+"/"+key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, nil
+	}
+	return resp.Kvs[0].Value, uint64(resp.Kvs[0].ModRevision), nil
+}
+
+// CompareAndSwap sets key to value in a transaction guarded by its mod
+// revision; etcd reports revision 0 for missing keys
+func (s *EtcdStore) CompareAndSwap(ctx context.Context, key string, version uint64, value []byte) (bool, error) {
+	k := s.prefix + "/" + key
+	resp, err := s.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(k), "=", int64(version))).
+		Then(clientv3.OpPut(k, string(value))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// Close closes the etcd client
+func (s *EtcdStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,155 @@
+// Package quota enforces a rate limit shared by the replicas of a service
+// with the generic cell rate algorithm (GCRA). The only shared state per
+// limit is its theoretical arrival time (TAT), updated with compare-and-swap
+// in a Store such as etcd or the Consul KV store.
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Store holds the state of shared limits
+type Store interface {
+	// Get returns the value of key and its version; a missing key has a
+	// nil value and version 0
+	Get(ctx context.Context, key string) ([]byte, uint64, error)
+	// CompareAndSwap sets key to value if its version is still version,
+	// where version 0 means the key must not exist, and reports whether it
+	// did
+	CompareAndSwap(ctx context.Context, key string, version uint64, value []byte) (bool, error)
+}
+
+// ErrContention is returned by Acquire when other replicas kept updating a
+// limit between its reads and writes
+var ErrContention = errors.New("too much contention on the limit")
+
+// StoreError is returned by Acquire when the store cannot be used
+type StoreError struct {
+	Op  string // "read" or "update"
+	Key string
+	Err error
+}
+
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("failed to %s limit %s: %v", e.Op, e.Key, e.Err)
+}
+
+func (e *StoreError) Unwrap() error {
+	return e.Err
+}
+
+// GCRA is a rate limit of Rate tokens per second allowing bursts of Burst
+// tokens
+type GCRA struct {
+	Rate  float64
+	Burst float64
+}
+
+// Grant is the outcome of Acquire
+type Grant struct {
+	Tokens int           // Tokens taken; 0 if the request was denied
+	Delay  time.Duration // Wait before using the tokens, or until they could be taken if denied
+}
+
+// maxAttempts bounds the compare-and-swap retries of one Acquire
+const maxAttempts = 10
+
+// Acquire takes between need and want tokens of the limit stored at key. It
+// takes as many as are available now, up to want; if fewer than need are,
+// it reserves need tokens that become usable after Grant.Delay, unless that
+// is longer than maxWait.
+func (g GCRA) Acquire(ctx context.Context, store Store, key string, want, need int, maxWait time.Duration) (Grant, error) {
+	if g.Rate <= 0 {
+		return Grant{}, fmt.Errorf("rate must be positive")
+	}
+	if float64(need) > g.Burst {
+		return Grant{}, fmt.Errorf("cannot take %d tokens with a burst of %v", need, g.Burst)
+	}
+	interval := time.Duration(float64(time.Second) / g.Rate)
+	tolerance := time.Duration(g.Burst * float64(interval))
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		value, version, err := store.Get(ctx, key)
+		if err != nil {
+			return Grant{}, &StoreError{Op: "read", Key: key, Err: err}
+		}
+		now := time.Now()
+		tat := now
+		if value != nil {
+			stored, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return Grant{}, &StoreError{Op: "read", Key: key, Err: fmt.Errorf("malformed value: %v", err)}
+			}
+			if t := time.Unix(0, stored); t.After(now) {
+				tat = t
+			}
+		}
+
+		grant := Grant{}
+		if available := int(now.Add(tolerance).Sub(tat) / interval); available >= need {
+			grant.Tokens = available
+			if grant.Tokens > want {
+				grant.Tokens = want
+			}
+		} else {
+			grant.Tokens = need
+			grant.Delay = tat.Add(time.Duration(need) * interval).Sub(now.Add(tolerance))
+			if grant.Delay > maxWait {
+				return Grant{Delay: grant.Delay}, nil
+			}
+		}
+
+		tat = tat.Add(time.Duration(grant.Tokens) * interval)
+		swapped, err := store.CompareAndSwap(ctx, key, version, []byte(strconv.FormatInt(tat.UnixNano(), 10)))
+		if err != nil {
+			return Grant{}, &StoreError{Op: "update", Key: key, Err: err}
+		}
+		if swapped {
+			return grant, nil
+		}
+	}
+	return Grant{}, ErrContention
+}
+
+// MemoryStore keeps limits in memory, for tests and single-process setups
+type MemoryStore struct {
+	mutex  sync.Mutex
+	values map[string]memoryValue
+}
+
+// memoryValue is a stored value and its version
+type memoryValue struct {
+	value   []byte
+	version uint64
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: make(map[string]memoryValue)}
+}
+
+// Get returns the value of key and its version
+func (s *MemoryStore) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	v := s.values[key]
+	return v.value, v.version, nil
+}
+
+// CompareAndSwap sets key to value if its version is still version
+func (s *MemoryStore) CompareAndSwap(ctx context.Context, key string, version uint64, value []byte) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.values[key].version != version {
+		return false, nil
+	}
+	s.values[key] = memoryValue{value: value, version: version + 1}
+	return true, nil
+}
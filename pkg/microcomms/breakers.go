@@ -0,0 +1,184 @@
+package microcomms
+
+import (
+    "net/url"
+    "path"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/pramithamj/microcomms/internal/discovery"
+)
+
+// CircuitBreakerRegistryConfig holds configuration for a circuit breaker
+// registry
+type CircuitBreakerRegistryConfig struct {
+    // Templates configure the breakers created for keys. A template applies
+    // to the key it names exactly, to keys matching it as a path.Match
+    // pattern such as "grpc:/billing.Invoices/*", or to every key of a kind such as
+    // "http". The exact key wins over the longest matching pattern, which
+    // wins over the kind.
+    Templates   map[string]CircuitBreakerConfig
+    Default     CircuitBreakerConfig // Used for keys no template applies to
+    IdleTimeout time.Duration        // Closed breakers unused for this long are dropped (default 10m)
+    // OnStateChange is added to every breaker the registry creates, in
+    // addition to the template's own callback
+    OnStateChange StateChangeFunc
+}
+
+// CircuitBreakerInfo describes a breaker held by a registry
+type CircuitBreakerInfo struct {
+    Key      string
+    Stats    CircuitBreakerStats
+    LastUsed time.Time
+}
+
+// CircuitBreakerRegistry holds one circuit breaker per target, so that a
+// failing downstream only opens the breaker for its own calls. Breakers are
+// keyed by "<kind>:<target>", e.g. "http:payments", "http:api.example.com"
+// or "grpc:/billing.Invoices/Create", and are created on first use.
+type CircuitBreakerRegistry struct {
+    config CircuitBreakerRegistryConfig
+
+    mutex     sync.Mutex
+    breakers  map[string]*registryEntry
+    lastSweep time.Time
+    publish   func(key string, open bool, at time.Time) // Set while sharing state with other replicas
+}
+
+// registryEntry is a breaker and the time it was last handed out
+type registryEntry struct {
+    breaker  *CircuitBreaker
+    lastUsed time.Time
+}
+
+// NewCircuitBreakerRegistry creates an empty circuit breaker registry
+func NewCircuitBreakerRegistry(config CircuitBreakerRegistryConfig) *CircuitBreakerRegistry {
+    if config.IdleTimeout <= 0 {
+        config.IdleTimeout = 10 * time.Minute
+    }
+    return &CircuitBreakerRegistry{
+        config:    config,
+        breakers:  make(map[string]*registryEntry),
+        lastSweep: time.Now(),
+    }
+}
+
+// BreakerKey returns the registry key of a target of a kind. HTTP targets
+// are keyed by service name for service URLs and bare names, and by host
+// for plain http(s) URLs.
+func BreakerKey(kind, target string) string {
+    if kind == "http" {
+        if discovery.IsHTTPURL(target) {
+            if u, err := url.Parse(target); err == nil {
+                target = u.Host
+            }
+        } else if s, err := discovery.ParseServiceURL(target); err == nil {
+            target = s.Service
+        }
+    }
+    return kind + ":" + target
+}
+
+// Get returns the breaker for a key, creating it from its template if needed
+func (r *CircuitBreakerRegistry) Get(key string) *CircuitBreaker {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+
+    now := time.Now()
+    r.sweep(now)
+    entry, ok := r.breakers[key]
+    if !ok {
+        config := r.template(key)
+        if config.Name == "" {
+            config.Name = key
+        }
+        entry = &registryEntry{breaker: NewCircuitBreakerWithConfig(config)}
+        if r.config.OnStateChange != nil {
+            entry.breaker.OnStateChange(r.config.OnStateChange)
+        }
+        entry.breaker.setShare(sharer(r.publish, key))
+        r.breakers[key] = entry
+    }
+    entry.lastUsed = now
+    return entry.breaker
+}
+
+// template returns the configuration for the breaker of a key
+func (r *CircuitBreakerRegistry) template(key string) CircuitBreakerConfig {
+    if config, ok := lookupTemplate(r.config.Templates, key); ok {
+        return config
+    }
+    return r.config.Default
+}
+
+// lookupTemplate returns the template for a key: the one naming it
+// exactly, else the longest path.Match pattern matching it, else the one
+// for its kind, the part before the first ":"
+func lookupTemplate[T any](templates map[string]T, key string) (T, bool) {
+    if template, ok := templates[key]; ok {
+        return template, true
+    }
+    best, found := "", false
+    for pattern := range templates {
+        if matched, _ := path.Match(pattern, key); matched && len(pattern) > len(best) {
+            best, found = pattern, true
+        }
+    }
+    if found {
+        return templates[best], true
+    }
+    if i := strings.Index(key, ":"); i >= 0 {
+        if template, ok := templates[key[:i]]; ok {
+            return template, true
+        }
+    }
+    var zero T
+    return zero, false
+}
+
+// sweep drops idle closed breakers, at most twice per idle timeout; callers
+// hold the mutex. Breakers that are not closed are kept so that dropping
+// them does not let traffic through to a failing target.
+func (r *CircuitBreakerRegistry) sweep(now time.Time) {
+    if now.Sub(r.lastSweep) < r.config.IdleTimeout/2 {
+        return
+    }
+    r.lastSweep = now
+    for key, entry := range r.breakers {
+        if now.Sub(entry.lastUsed) > r.config.IdleTimeout && entry.breaker.State() == StateClosed {
+            delete(r.breakers, key)
+        }
+    }
+}
+
+// Inspect returns the state of the breaker for a key without creating it
+func (r *CircuitBreakerRegistry) Inspect(key string) (CircuitBreakerInfo, bool) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    entry, ok := r.breakers[key]
+    if !ok {
+        return CircuitBreakerInfo{}, false
+    }
+    return CircuitBreakerInfo{Key: key, Stats: entry.breaker.Stats(), LastUsed: entry.lastUsed}, true
+}
+
+// List returns the state of every breaker, sorted by key
+func (r *CircuitBreakerRegistry) List() []CircuitBreakerInfo {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    infos := make([]CircuitBreakerInfo, 0, len(r.breakers))
+    for key, entry := range r.breakers {
+        infos = append(infos, CircuitBreakerInfo{Key: key, Stats: entry.breaker.Stats(), LastUsed: entry.lastUsed})
+    }
+    sort.Slice(infos, func(a, b int) bool { return infos[a].Key < infos[b].Key })
+    return infos
+}
+
+// Remove drops the breaker for a key; the next Get creates a fresh one
+func (r *CircuitBreakerRegistry) Remove(key string) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    delete(r.breakers, key)
+}
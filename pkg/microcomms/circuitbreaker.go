@@ -1,7 +1,9 @@
 package microcomms
 
 import (
-    "fmt"
+    "context"
+    "errors"
+    "net/http"
     "sync"
     "time"
 )
@@ -15,101 +17,511 @@ const (
     StateHalfOpen                          // Testing if circuit can be closed again
 )
 
-// CircuitBreaker implements the circuit breaker pattern
+// String returns the name of the state
+func (s CircuitBreakerState) String() string {
+    switch s {
+    case StateClosed:
+        return "closed"
+    case StateOpen:
+        return "open"
+    case StateHalfOpen:
+        return "half-open"
+    default:
+        return "unknown"
+    }
+}
+
+// StateChangeFunc is called when a circuit breaker changes state
+type StateChangeFunc func(name string, from, to CircuitBreakerState)
+
+// DefaultIsFailure is the failure classifier used when a breaker has none.
+// Errors count as failures except responses rejected as invalid requests
+// (a ServiceError with a 4xx status other than 408 and 429), which say
+// nothing about the health of the target.
+func DefaultIsFailure(err error) bool {
+    var serviceErr *ServiceError
+    if errors.As(err, &serviceErr) && serviceErr.StatusCode >= 400 && serviceErr.StatusCode < 500 {
+        return serviceErr.StatusCode == http.StatusRequestTimeout || serviceErr.StatusCode == http.StatusTooManyRequests
+    }
+    return true
+}
+
+// WindowType selects how a circuit breaker decides to open
+type WindowType string
+
+const (
+    WindowConsecutive WindowType = ""      // Open after FailureThreshold failures without a success in between
+    WindowCount       WindowType = "count" // Failure rate over the last WindowSize calls
+    WindowTime        WindowType = "time"  // Failure rate over the calls of the last WindowDuration
+)
+
+// CircuitBreakerConfig holds configuration for a circuit breaker
+type CircuitBreakerConfig struct {
+    Name             string
+    FailureThreshold int           // Failures that open a consecutive breaker (default 5)
+    ResetTimeout     time.Duration // Time the breaker stays open before probing (default 30s)
+    
+    WindowType     WindowType
+    WindowSize     int           // Calls in a count window (default 100)
+    WindowDuration time.Duration // Length of a time window (default 60s)
+    // FailureRateThreshold is the percentage of failed calls in the window
+    // that opens the breaker (default 50)
+    FailureRateThreshold float64
+    // MinimumRequests is the number of calls the window needs before rates
+    // are judged, so that a few early failures do not open it (default 20)
+    MinimumRequests int
+    // SlowCallThreshold makes calls that take longer count as slow, whether
+    // they fail or not (0 disables slow-call detection)
+    SlowCallThreshold time.Duration
+    // SlowCallRateThreshold is the percentage of slow calls in the window
+    // that opens the breaker (default 100)
+    SlowCallRateThreshold float64
+    // HalfOpenProbes is the number of trial calls admitted once the reset
+    // timeout has passed; the breaker closes when all of them succeed and
+    // opens again on the first failure (default 1)
+    HalfOpenProbes int
+    // IsFailure decides which errors returned through Execute or RecordResult
+    // count as failures; other errors count as successes (default
+    // DefaultIsFailure). Calls cancelled by the caller are never recorded.
+    IsFailure func(err error) bool
+    // OnStateChange is called after every state change, like the callbacks
+    // added with CircuitBreaker.OnStateChange
+    OnStateChange StateChangeFunc
+}
+
+// CircuitBreakerStats is a snapshot of a circuit breaker's window
+type CircuitBreakerStats struct {
+    State        CircuitBreakerState
+    Calls        int     // Calls in the window
+    Failures     int     // Failed calls in the window
+    SlowCalls    int     // Slow calls in the window
+    FailureRate  float64 // Percentage of failed calls
+    SlowCallRate float64 // Percentage of slow calls
+}
+
+// CircuitBreaker implements the circuit breaker pattern. All state
+// transitions happen under one mutex, and every transition starts a new
+// generation: outcomes of calls admitted in an earlier generation, such as a
+// slow call that was let through before the breaker opened, are ignored.
 type CircuitBreaker struct {
     name          string
+    config        CircuitBreakerConfig
     state         CircuitBreakerState
+    generation    uint64
     failureCount  int
     failureThreshold int
     resetTimeout  time.Duration
     lastFailureTime time.Time
-    mutex         sync.RWMutex
+    window        slidingWindow // nil for consecutive breakers
+    probes        int       // Probes admitted in the current half-open period
+    probeSuccesses int
+    halfOpenSince time.Time
+    lastTransition time.Time
+    pinned        bool // State set by Override, kept until ClearOverride
+    listeners     []StateChangeFunc
+    changes       []stateChange // Transitions not yet passed to listeners
+    share         func(open bool, at time.Time) // Publishes trips and recoveries to other replicas
+    mutex         sync.Mutex
+}
+
+// stateChange is a transition waiting to be passed to listeners
+type stateChange struct {
+    from, to CircuitBreakerState
+    at       time.Time
+    shared   bool // Learned from another replica or set by Override, so not published
 }
 
 // NewCircuitBreaker creates a new circuit breaker
 func NewCircuitBreaker(name string, failureThreshold int, resetTimeout time.Duration) *CircuitBreaker {
-    return &CircuitBreaker{
-        name:            name,
-        state:           StateClosed,
-        failureThreshold: failureThreshold,
-        resetTimeout:    resetTimeout,
+    return NewCircuitBreakerWithConfig(CircuitBreakerConfig{
+        Name:             name,
+        FailureThreshold: failureThreshold,
+        ResetTimeout:     resetTimeout,
+    })
+}
+
+// NewCircuitBreakerWithConfig creates a new circuit breaker with custom config
+func NewCircuitBreakerWithConfig(config CircuitBreakerConfig) *CircuitBreaker {
+    if config.FailureThreshold <= 0 {
+        config.FailureThreshold = 5
+    }
+    if config.ResetTimeout <= 0 {
+        config.ResetTimeout = 30 * time.Second
+    }
+    if config.WindowSize <= 0 {
+        config.WindowSize = 100
+    }
+    if config.WindowDuration <= 0 {
+        config.WindowDuration = 60 * time.Second
+    }
+    if config.FailureRateThreshold <= 0 {
+        config.FailureRateThreshold = 50
+    }
+    if config.MinimumRequests <= 0 {
+        config.MinimumRequests = 20
+    }
+    if config.SlowCallRateThreshold <= 0 {
+        config.SlowCallRateThreshold = 100
+    }
+    if config.HalfOpenProbes <= 0 {
+        config.HalfOpenProbes = 1
+    }
+    if config.IsFailure == nil {
+        config.IsFailure = DefaultIsFailure
+    }
+    
+    cb := &CircuitBreaker{
+        name:             config.Name,
+        config:           config,
+        state:            StateClosed,
+        failureThreshold: config.FailureThreshold,
+        resetTimeout:     config.ResetTimeout,
     }
+    switch config.WindowType {
+    case WindowCount:
+        cb.window = newCountWindow(config.WindowSize)
+    case WindowTime:
+        cb.window = newTimeWindow(config.WindowDuration)
+    }
+    if config.OnStateChange != nil {
+        cb.listeners = append(cb.listeners, config.OnStateChange)
+    }
+    return cb
 }
 
-// Execute runs the given function with circuit breaker protection
+// Name returns the name of the breaker
+func (cb *CircuitBreaker) Name() string {
+    return cb.name
+}
+
+// OnStateChange adds a callback for state changes, e.g. for logging,
+// metrics or alerts. Callbacks run synchronously, outside the breaker's
+// lock, on the goroutine whose call caused the change; changes caused by
+// concurrent calls may be reported out of order.
+func (cb *CircuitBreaker) OnStateChange(fn StateChangeFunc) {
+    cb.mutex.Lock()
+    defer cb.mutex.Unlock()
+    cb.listeners = append(cb.listeners, fn)
+}
+
+// unlock releases the mutex and then passes pending transitions to the
+// listeners
+func (cb *CircuitBreaker) unlock() {
+    changes, listeners, share := cb.changes, cb.listeners, cb.share
+    cb.changes = nil
+    cb.mutex.Unlock()
+    for _, change := range changes {
+        for _, fn := range listeners {
+            fn(cb.name, change.from, change.to)
+        }
+        if share != nil && !change.shared && change.to != StateHalfOpen {
+            share(change.to == StateOpen, change.at)
+        }
+    }
+}
+
+// Execute runs the given function with circuit breaker protection. Calls
+// the breaker does not admit fail with a *CircuitBreakerOpenError, which
+// matches ErrCircuitBreakerOpen with errors.Is.
 func (cb *CircuitBreaker) Execute(fn func() error) error {
-    if !cb.AllowRequest() {
-        return fmt.Errorf("circuit breaker '%s' is open", cb.name)
+    generation, state, ok := cb.allow()
+    if !ok {
+        return &CircuitBreakerOpenError{Name: cb.name, State: state}
     }
     
+    start := time.Now()
     err := fn()
+    cb.complete(generation, err, time.Since(start))
+    return err
+}
+
+// Execute runs fn with the protection of cb and returns its result. It
+// returns ctx.Err() without calling fn if ctx is already done; fn runs on
+// the caller's goroutine and is expected to stop when ctx is done. When cb
+// rejects the call, or fn fails with an error that cb counts as a failure
+// while ctx is still live, the result of fallback is returned instead if it
+// is not nil. A panic in fn is recorded as a failure and passed on.
+func Execute[T any](ctx context.Context, cb *CircuitBreaker, fn func(ctx context.Context) (T, error), fallback func(ctx context.Context, err error) (T, error)) (T, error) {
+    var zero T
+    if err := ctx.Err(); err != nil {
+        return zero, err
+    }
     
-    if err != nil {
-        cb.RecordFailure()
-        return err
+    generation, state, ok := cb.allow()
+    if !ok {
+        err := &CircuitBreakerOpenError{Name: cb.name, State: state}
+        if fallback != nil {
+            return fallback(ctx, err)
+        }
+        return zero, err
     }
     
-    cb.RecordSuccess()
-    return nil
+    start := time.Now()
+    completed := false
+    defer func() {
+        if !completed {
+            cb.complete(generation, errors.New("panic in circuit breaker call"), time.Since(start))
+        }
+    }()
+    value, err := fn(ctx)
+    completed = true
+    cb.complete(generation, err, time.Since(start))
+    
+    if err != nil && fallback != nil && ctx.Err() == nil && cb.config.IsFailure(err) {
+        return fallback(ctx, err)
+    }
+    return value, err
 }
 
-// AllowRequest checks if a request is allowed to pass through the circuit breaker
+// AllowRequest checks if a request is allowed to pass through the circuit
+// breaker. In the half-open state only HalfOpenProbes requests are allowed;
+// their outcomes must be reported with RecordResult, RecordSuccess or
+// RecordFailure.
 func (cb *CircuitBreaker) AllowRequest() bool {
-    cb.mutex.RLock()
-    defer cb.mutex.RUnlock()
+    _, _, ok := cb.allow()
+    return ok
+}
+
+// allow admits a request and returns the generation it belongs to, or
+// rejects it and returns the state that caused the rejection
+func (cb *CircuitBreaker) allow() (uint64, CircuitBreakerState, bool) {
+    cb.mutex.Lock()
+    defer cb.unlock()
     
+    now := time.Now()
+    if cb.pinned {
+        return cb.generation, cb.state, cb.state == StateClosed
+    }
     switch cb.state {
     case StateClosed:
-        return true
+        return cb.generation, cb.state, true
     case StateOpen:
-        // Check if reset timeout has expired
-        if time.Since(cb.lastFailureTime) > cb.resetTimeout {
-            // Allow one request to test the circuit
-            cb.mutex.RUnlock()
-            cb.mutex.Lock()
-            cb.state = StateHalfOpen
-            cb.mutex.Unlock()
-            cb.mutex.RLock()
-            return true
+        if now.Sub(cb.lastFailureTime) <= cb.resetTimeout {
+            return 0, cb.state, false
         }
-        return false
+        cb.transition(StateHalfOpen, now)
     case StateHalfOpen:
-        // In half-open state, allow only one request
-        return true
-    default:
-        return false
+        // Probes whose outcome never arrives must not wedge the breaker
+        if now.Sub(cb.halfOpenSince) > cb.resetTimeout {
+            cb.transition(StateHalfOpen, now)
+        }
+    }
+    if cb.probes >= cb.config.HalfOpenProbes {
+        return 0, cb.state, false
+    }
+    cb.probes++
+    return cb.generation, cb.state, true
+}
+
+// RecordResult records the outcome and duration of a call made outside
+// Execute
+func (cb *CircuitBreaker) RecordResult(err error, duration time.Duration) {
+    cb.complete(cb.currentGeneration(), err, duration)
+}
+
+// complete records the outcome of a call admitted in generation, using the
+// failure classifier
+func (cb *CircuitBreaker) complete(generation uint64, err error, duration time.Duration) {
+    if errors.Is(err, context.Canceled) {
+        cb.release(generation)
+        return
+    }
+    cb.recordIn(generation, err != nil && cb.config.IsFailure(err), cb.isSlow(duration))
+}
+
+// release frees the probe slot of a call whose outcome is not recorded
+func (cb *CircuitBreaker) release(generation uint64) {
+    cb.mutex.Lock()
+    defer cb.mutex.Unlock()
+    if generation == cb.generation && cb.state == StateHalfOpen && cb.probes > 0 {
+        cb.probes--
     }
 }
 
 // RecordFailure records a failure and potentially opens the circuit
 func (cb *CircuitBreaker) RecordFailure() {
+    cb.recordIn(cb.currentGeneration(), true, false)
+}
+
+// RecordSuccess records a success and potentially closes the circuit
+func (cb *CircuitBreaker) RecordSuccess() {
+    cb.recordIn(cb.currentGeneration(), false, false)
+}
+
+// isSlow reports whether a call took longer than the slow-call threshold
+func (cb *CircuitBreaker) isSlow(duration time.Duration) bool {
+    return cb.config.SlowCallThreshold > 0 && duration > cb.config.SlowCallThreshold
+}
+
+// currentGeneration returns the generation of the current state
+func (cb *CircuitBreaker) currentGeneration() uint64 {
     cb.mutex.Lock()
     defer cb.mutex.Unlock()
+    return cb.generation
+}
+
+// recordIn updates the breaker with the outcome of a call admitted in
+// generation
+func (cb *CircuitBreaker) recordIn(generation uint64, failed, slow bool) {
+    cb.mutex.Lock()
+    defer cb.unlock()
     
-    cb.failureCount++
-    cb.lastFailureTime = time.Now()
+    if generation != cb.generation || cb.pinned {
+        return
+    }
+    now := time.Now()
+    switch cb.state {
+    case StateHalfOpen:
+        // A slow probe means the dependency has not recovered either
+        if failed || slow {
+            cb.transition(StateOpen, now)
+            return
+        }
+        cb.probeSuccesses++
+        if cb.probeSuccesses >= cb.config.HalfOpenProbes {
+            cb.transition(StateClosed, now)
+        }
+    case StateClosed:
+        if failed {
+            cb.failureCount++
+        }
+        if cb.window != nil {
+            cb.window.record(now, failed, slow)
+            if cb.tripped(cb.window.counts(now)) {
+                cb.transition(StateOpen, now)
+            }
+        } else if !failed {
+            cb.failureCount = 0
+        } else if cb.failureCount >= cb.failureThreshold {
+            cb.transition(StateOpen, now)
+        }
+    }
+}
+
+// tripped reports whether the window's rates call for opening the breaker
+func (cb *CircuitBreaker) tripped(counts windowCounts) bool {
+    if counts.calls < cb.config.MinimumRequests {
+        return false
+    }
+    calls := float64(counts.calls)
+    if float64(counts.failures)*100/calls >= cb.config.FailureRateThreshold {
+        return true
+    }
+    return cb.config.SlowCallThreshold > 0 && float64(counts.slow)*100/calls >= cb.config.SlowCallRateThreshold
+}
+
+// transition moves the breaker to state and starts a new generation;
+// callers hold the mutex
+func (cb *CircuitBreaker) transition(state CircuitBreakerState, now time.Time) {
+    if state != cb.state {
+        cb.changes = append(cb.changes, stateChange{from: cb.state, to: state, at: now})
+    }
+    cb.state = state
+    cb.lastTransition = now
+    cb.generation++
+    cb.probes, cb.probeSuccesses = 0, 0
+    switch state {
+    case StateOpen:
+        cb.lastFailureTime = now
+    case StateHalfOpen:
+        cb.halfOpenSince = now
+    case StateClosed:
+        cb.failureCount = 0
+    }
+    // Each closed period is judged on its own calls
+    if cb.window != nil {
+        cb.window.reset()
+    }
+}
+
+// setShare sets the hook through which trips and recoveries are published
+func (cb *CircuitBreaker) setShare(share func(open bool, at time.Time)) {
+    cb.mutex.Lock()
+    defer cb.mutex.Unlock()
+    cb.share = share
+}
+
+// transitionShared is transition for a change that must not be published
+// to other replicas; callers hold the mutex
+func (cb *CircuitBreaker) transitionShared(state CircuitBreakerState, now time.Time) {
+    changes := len(cb.changes)
+    cb.transition(state, now)
+    if len(cb.changes) > changes {
+        cb.changes[changes].shared = true
+    }
+}
+
+// applyRemote applies a trip or recovery published by another replica at
+// the given time. A remote trip opens a closed or half-open breaker, which
+// then probes on its own reset timeout. A remote recovery only moves an
+// open breaker to half-open, so that this replica confirms the recovery
+// with its own probes. Events older than the breaker's last transition lose
+// to the local state, and pinned breakers ignore remote events.
+func (cb *CircuitBreaker) applyRemote(open bool, at time.Time) {
+    cb.mutex.Lock()
+    defer cb.unlock()
     
-    if cb.state == StateHalfOpen || (cb.state == StateClosed && cb.failureCount >= cb.failureThreshold) {
-        cb.state = StateOpen
+    if cb.pinned || at.Before(cb.lastTransition) {
+        return
+    }
+    now := time.Now()
+    switch {
+    case open && cb.state != StateOpen:
+        cb.transitionShared(StateOpen, now)
+    case !open && cb.state == StateOpen:
+        cb.transitionShared(StateHalfOpen, now)
     }
 }
 
-// RecordSuccess records a success and potentially closes the circuit
-func (cb *CircuitBreaker) RecordSuccess() {
+// Override pins the breaker open or closed, e.g. to cut off a dependency by
+// hand or to keep it reachable while a shared trip is wrong. Until
+// ClearOverride is called, a pinned breaker ignores call outcomes and events
+// from other replicas, and the change is not published to them.
+func (cb *CircuitBreaker) Override(state CircuitBreakerState) {
+    if state == StateHalfOpen {
+        state = StateOpen
+    }
+    cb.mutex.Lock()
+    defer cb.unlock()
+    cb.transitionShared(state, time.Now())
+    cb.pinned = true
+}
+
+// ClearOverride lets the breaker follow call outcomes again; an open
+// breaker starts its reset timeout
+func (cb *CircuitBreaker) ClearOverride() {
+    cb.mutex.Lock()
+    defer cb.unlock()
+    if !cb.pinned {
+        return
+    }
+    cb.pinned = false
+    cb.transitionShared(cb.state, time.Now())
+}
+
+// Stats returns the breaker's state and the counts of its window. For
+// consecutive breakers Failures is the current run of failures.
+func (cb *CircuitBreaker) Stats() CircuitBreakerStats {
     cb.mutex.Lock()
     defer cb.mutex.Unlock()
     
-    if cb.state == StateHalfOpen {
-        cb.failureCount = 0
-        cb.state = StateClosed
-    } else if cb.state == StateClosed {
-        cb.failureCount = 0
+    stats := CircuitBreakerStats{State: cb.state}
+    if cb.window == nil {
+        stats.Failures = cb.failureCount
+        return stats
+    }
+    counts := cb.window.counts(time.Now())
+    stats.Calls, stats.Failures, stats.SlowCalls = counts.calls, counts.failures, counts.slow
+    if counts.calls > 0 {
+        stats.FailureRate = float64(counts.failures) * 100 / float64(counts.calls)
+        stats.SlowCallRate = float64(counts.slow) * 100 / float64(counts.calls)
     }
+    return stats
 }
 
 // State returns the current state of the circuit breaker
 func (cb *CircuitBreaker) State() CircuitBreakerState {
-    cb.mutex.RLock()
-    defer cb.mutex.RUnlock()
+    cb.mutex.Lock()
+    defer cb.mutex.Unlock()
     return cb.state
 }
\ No newline at end of file
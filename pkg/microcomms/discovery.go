@@ -0,0 +1,301 @@
+package microcomms
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "github.com/pramithamj/microcomms/internal/discovery"
+    "github.com/pramithamj/microcomms/internal/grpcclient"
+    "github.com/pramithamj/microcomms/internal/httpclient"
+    "google.golang.org/grpc"
+)
+
+// DiscoveryBackend selects the service registry used for discovery
+type DiscoveryBackend string
+
+const (
+    DiscoveryBackendConsul DiscoveryBackend = "consul" // Consul at ConsulAddress
+    DiscoveryBackendStatic DiscoveryBackend = "static" // Fixed table from StaticServices
+    DiscoveryBackendFile   DiscoveryBackend = "file"   // JSON table at DiscoveryFilePath, reloaded on change
+    DiscoveryBackendEtcd   DiscoveryBackend = "etcd"   // etcd cluster from Etcd
+    DiscoveryBackendDNS    DiscoveryBackend = "dns"    // SRV or A/AAAA records as configured in DNS
+)
+
+// EtcdConfig holds configuration for etcd service discovery
+type EtcdConfig = discovery.EtcdConfig
+
+// DNSConfig holds configuration for DNS service discovery
+type DNSConfig = discovery.DNSConfig
+
+// BalancerStrategy names a client-side load balancing strategy
+type BalancerStrategy = discovery.BalancerStrategy
+
+const (
+    RoundRobin       = discovery.RoundRobin       // Instances in turn
+    Random           = discovery.Random           // Uniformly random instance
+    Weighted         = discovery.Weighted         // Weighted round-robin on the "weight" instance metadata
+    LeastOutstanding = discovery.LeastOutstanding // Instance with the fewest requests in flight
+    PowerOfTwo       = discovery.PowerOfTwo       // Fewer in-flight requests of two random instances
+    ConsistentHash   = discovery.ConsistentHash   // Same instance for the same hash key
+)
+
+// ServiceQuery selects the instances of a service by tags, metadata,
+// datacenter, namespace and version
+type ServiceQuery = discovery.Query
+
+// ZoneConfig holds configuration for zone-aware routing
+type ZoneConfig = discovery.ZoneConfig
+
+// OutlierConfig holds configuration for passive outlier detection
+type OutlierConfig = discovery.OutlierConfig
+
+// HashKeyHeader is the MessageRequest header whose value is used as the
+// consistent-hash key when the context does not carry one
+const HashKeyHeader = "X-Hash-Key"
+
+// WithHashKey returns a context carrying the key that the consistent-hash
+// balancer routes on, such as a user or tenant ID
+func WithHashKey(ctx context.Context, key string) context.Context {
+    return discovery.WithHashKey(ctx, key)
+}
+
+// ServiceInstance is a single reachable instance of a service
+type ServiceInstance = discovery.Instance
+
+// HealthCheck configures how the registry checks a registered instance
+type HealthCheck = discovery.HealthCheck
+
+// CheckType names the kind of health check
+type CheckType = discovery.CheckType
+
+const (
+    CheckHTTP = discovery.CheckHTTP // HTTP GET expecting a 2xx response
+    CheckGRPC = discovery.CheckGRPC // gRPC health checking protocol
+    CheckTCP  = discovery.CheckTCP  // TCP connect
+    CheckTTL  = discovery.CheckTTL  // Heartbeats sent by the instance itself
+)
+
+// RegistrationOptions configures a self-registration
+type RegistrationOptions = discovery.RegistrationOptions
+
+// Registration is the handle of a registered instance
+type Registration = discovery.Registration
+
+// newResolver creates the resolver for the configured discovery backend
+func newResolver(cfg MicrocommsConfig) (discovery.Resolver, error) {
+    switch cfg.DiscoveryBackend {
+    case DiscoveryBackendConsul, "":
+        return discovery.NewConsulDiscovery(cfg.ConsulAddress)
+    case DiscoveryBackendStatic:
+        return discovery.NewStaticResolver(cfg.StaticServices)
+    case DiscoveryBackendFile:
+        return discovery.NewFileResolver(cfg.DiscoveryFilePath)
+    case DiscoveryBackendEtcd:
+        return discovery.NewEtcdDiscovery(cfg.Etcd)
+    case DiscoveryBackendDNS:
+        return discovery.NewDNSResolver(cfg.DNS)
+    default:
+        return nil, fmt.Errorf("unknown discovery backend: %s", cfg.DiscoveryBackend)
+    }
+}
+
+// newURLResolver creates the resolver for service URLs. Bare service names
+// and the "discovery" scheme use the configured backend, as does the
+// backend's own scheme; the other registries are created on first use from
+// their configuration.
+func newURLResolver(cfg MicrocommsConfig, resolver discovery.Resolver, balancers *discovery.Balancers) *discovery.URLResolver {
+    urls, _ := discovery.NewURLResolver(balancers)
+    urls.HandleFunc(string(DiscoveryBackendConsul), func() (discovery.Resolver, error) {
+        consul, err := discovery.NewConsulDiscovery(cfg.ConsulAddress)
+        if err != nil {
+            return nil, err
+        }
+        consul.SetBalancers(balancers)
+        return consul, nil
+    })
+    urls.HandleFunc(string(DiscoveryBackendEtcd), func() (discovery.Resolver, error) {
+        return discovery.NewEtcdDiscovery(cfg.Etcd)
+    })
+    urls.HandleFunc(string(DiscoveryBackendDNS), func() (discovery.Resolver, error) {
+        return discovery.NewDNSResolver(cfg.DNS)
+    })
+    urls.HandleFunc(string(DiscoveryBackendStatic), func() (discovery.Resolver, error) {
+        return discovery.NewStaticResolver(cfg.StaticServices)
+    })
+    if resolver != nil {
+        backend := cfg.DiscoveryBackend
+        if backend == "" {
+            backend = DiscoveryBackendConsul
+        }
+        urls.Handle(string(backend), resolver)
+        urls.Handle(grpcclient.DiscoveryScheme, resolver)
+        urls.Handle("", resolver)
+    }
+    return urls
+}
+
+// ResolveInstances returns the instances of a service known to discovery,
+// filtered by the service's query from ServiceQueries if it has one
+func (m *Microcomms) ResolveInstances(ctx context.Context, name string) ([]ServiceInstance, error) {
+    q := m.queries[name]
+    q.Service = name
+    return m.ResolveQuery(ctx, q)
+}
+
+// ResolveQuery returns the instances of a service matching a query
+func (m *Microcomms) ResolveQuery(ctx context.Context, q ServiceQuery) ([]ServiceInstance, error) {
+    if m.Discovery == nil {
+        return nil, ErrServiceDiscoveryNotEnabled
+    }
+    return discovery.ResolveQuery(ctx, m.Discovery, q)
+}
+
+// ResolveURL returns the concrete URL of a target on one instance of its
+// service. Targets may be bare "service/path" names resolved by the
+// configured backend, service URLs naming a registry such as
+// "consul://payments/path", "etcd://", "dns://", "static://" or
+// "discovery://", or plain http(s) URLs, which are returned unchanged.
+func (m *Microcomms) ResolveURL(ctx context.Context, target string) (string, error) {
+    resolved, track, err := m.resolveURL(ctx, target)
+    if err != nil {
+        return "", err
+    }
+    track.done(nil)
+    return resolved, nil
+}
+
+// ServiceStale reports whether the last lookup of a service was answered
+// with last-known instances because discovery failed, and their age
+func (m *Microcomms) ServiceStale(name string) (bool, time.Duration) {
+    stale, ok := m.Discovery.(*discovery.StaleResolver)
+    if !ok {
+        return false, 0
+    }
+    return stale.Stale(name)
+}
+
+// WatchService returns a channel that receives the instances of a service
+// and then every change, until ctx is done. It requires a discovery backend
+// that supports watches, such as Consul.
+func (m *Microcomms) WatchService(ctx context.Context, name string) (<-chan []ServiceInstance, error) {
+    if m.Discovery == nil {
+        return nil, ErrServiceDiscoveryNotEnabled
+    }
+    watcher, ok := m.Discovery.(discovery.Watcher)
+    if !ok {
+        return nil, ErrWatchNotSupported
+    }
+    return watcher.Watch(ctx, name)
+}
+
+// RegisterSelf registers an instance of this process with the discovery
+// backend. The instance is deregistered when ctx is cancelled, on SIGTERM if
+// opts.DeregisterOnSignal is set, or through the returned handle, which also
+// sends the heartbeats of a TTL check.
+func (m *Microcomms) RegisterSelf(ctx context.Context, instance ServiceInstance, opts RegistrationOptions) (*Registration, error) {
+    if m.Registry == nil {
+        return nil, ErrServiceDiscoveryNotEnabled
+    }
+    return discovery.Register(ctx, m.Registry, instance, opts)
+}
+
+// resolveURL resolves a target like ResolveURL. The returned function must
+// be called with the outcome once the request completes.
+func (m *Microcomms) resolveURL(ctx context.Context, target string) (string, requestTracker, error) {
+    if m.Discovery == nil && !strings.Contains(target, "://") {
+        return "", requestTracker{}, ErrServiceDiscoveryNotEnabled
+    }
+    s, r, err := m.urls.Lookup(target)
+    if err != nil {
+        return "", requestTracker{}, err
+    }
+    if r == nil {
+        return target, requestTracker{done: func(error) {}}, nil
+    }
+    instance, done, err := m.pickInstance(ctx, r, s.Service)
+    if err != nil {
+        return "", requestTracker{}, err
+    }
+    return s.InstanceURL(instance), m.trackRequest(instance, done), nil
+}
+
+// pickInstance resolves a service through r and picks one instance with the
+// service's balancer. The returned DoneFunc must be called once the request
+// completes.
+func (m *Microcomms) pickInstance(ctx context.Context, r discovery.Resolver, name string) (ServiceInstance, discovery.DoneFunc, error) {
+    q := m.queries[name]
+    q.Service = name
+    instances, err := discovery.ResolveQuery(ctx, r, q)
+    if err != nil {
+        return ServiceInstance{}, nil, err
+    }
+    healthy := instances
+    if m.Outliers != nil {
+        healthy = m.Outliers.Filter(instances)
+    }
+    instances = m.zone.PreferZone(instances, healthy)
+    if m.Balancers == nil {
+        if len(instances) == 0 {
+            return ServiceInstance{}, nil, &discovery.NoInstancesError{Service: name}
+        }
+        return instances[0], func(error) {}, nil
+    }
+    return m.Balancers.Pick(ctx, name, instances)
+}
+
+// requestTracker follows a request to a picked instance
+type requestTracker struct {
+    attempt httpclient.AttemptFunc // Reports each attempt to outlier detection; nil if not needed
+    done    func(error)            // Releases the instance in the balancer once the request completes
+}
+
+// trackRequest returns the tracker of a request to a picked instance. Every
+// attempt is reported to outlier detection on its own, so that retries do
+// not hide 5xx responses or inflate latency.
+func (m *Microcomms) trackRequest(instance ServiceInstance, done discovery.DoneFunc) requestTracker {
+    track := requestTracker{done: func(err error) { done(err) }}
+    if m.Outliers == nil {
+        return track
+    }
+    track.attempt = func(resp *http.Response, err error, latency time.Duration) {
+        outcome := discovery.Outcome{Err: err, Latency: latency}
+        var status *httpclient.StatusError
+        if errors.As(err, &status) {
+            outcome.Err, outcome.StatusCode = nil, status.StatusCode
+        } else if resp != nil {
+            outcome.StatusCode = resp.StatusCode
+        }
+        m.Outliers.Report(instance, outcome)
+    }
+    return track
+}
+
+// DialService creates a gRPC client for a service whose instances are
+// resolved through service discovery and kept up to date as they change.
+// The target is a service name or a service URL such as "etcd://payments".
+func (m *Microcomms) DialService(target string) (*GRPCClient, error) {
+    if m.Discovery == nil && !strings.Contains(target, "://") {
+        return nil, ErrServiceDiscoveryNotEnabled
+    }
+    s, r, err := m.urls.Lookup(target)
+    if err != nil {
+        return nil, err
+    }
+    if r == nil {
+        return nil, fmt.Errorf("gRPC target '%s' must name a service", target)
+    }
+    client, err := grpcclient.NewDiscoveryClient(s.Service, r)
+    if err != nil {
+        return nil, err
+    }
+    return &GRPCClient{client: client}, nil
+}
+
+// Conn returns the underlying gRPC connection, for use with generated stubs
+func (g *GRPCClient) Conn() *grpc.ClientConn {
+    return g.client.Conn()
+}
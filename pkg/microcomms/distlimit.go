@@ -0,0 +1,263 @@
+package microcomms
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "sync"
+    "time"
+
+    "github.com/pramithamj/microcomms/internal/quota"
+)
+
+// QuotaStore holds the shared state of distributed rate limits
+type QuotaStore = quota.Store
+
+// NewMemoryQuotaStore creates a store sharing limits between limiters in
+// one process
+func NewMemoryQuotaStore() QuotaStore {
+    return quota.NewMemoryStore()
+}
+
+// NewEtcdQuotaStore creates a store keeping limits in etcd under prefix
+// (default "/microcomms/quotas")
+func NewEtcdQuotaStore(endpoints []string, prefix string) (QuotaStore, error) {
+    return quota.NewEtcdStore(endpoints, prefix)
+}
+
+// NewConsulQuotaStore creates a store keeping limits in the Consul KV store
+// under prefix (default "microcomms/quotas")
+func NewConsulQuotaStore(addr, prefix string) (QuotaStore, error) {
+    return quota.NewConsulStore(addr, prefix)
+}
+
+// DistributedLimiterConfig holds configuration for a distributed limiter
+type DistributedLimiterConfig struct {
+    Key         string        // Name of the shared limit in the store, e.g. "partner-api"
+    Rate        float64       // Tokens per second across all replicas
+    Burst       float64       // Bucket size across all replicas (default Rate, at least 1)
+    Prefetch    int           // Tokens taken from the store per round trip (default 1)
+    PrefetchTTL time.Duration // Prefetched tokens unused for this long are dropped (default 1s)
+    // Replicas is the expected number of replicas. While the store is
+    // unavailable each replica allows Rate/Replicas on its own (default 1).
+    Replicas      int
+    RetryInterval time.Duration // How long the local limit is used after a store failure (default 5s)
+    Timeout       time.Duration // Timeout of one store round trip (default 1s)
+}
+
+// DistributedLimiter enforces a rate limit shared by every replica, e.g. a
+// partner's global quota, using GCRA over a shared store. Taking Prefetch
+// tokens per round trip saves a store call per request at the cost of
+// letting a replica hold tokens for up to PrefetchTTL. When the store
+// fails the limiter falls back to a local share of the limit and retries
+// the store after RetryInterval.
+type DistributedLimiter struct {
+    store    QuotaStore
+    config   DistributedLimiterConfig
+    gcra     quota.GCRA
+    fallback *RateLimiter
+
+    mutex         sync.Mutex
+    tokens        int           // Prefetched tokens
+    expires       time.Time     // When prefetched tokens are dropped
+    degradedUntil time.Time     // The local limit is used until then
+    refill        chan struct{} // Closed when the prefetch in flight completes
+}
+
+// NewDistributedLimiter creates a limiter for the limit config.Key in store
+func NewDistributedLimiter(store QuotaStore, config DistributedLimiterConfig) *DistributedLimiter {
+    if config.Burst <= 0 {
+        config.Burst = math.Max(config.Rate, 1)
+    }
+    if config.Prefetch <= 0 {
+        config.Prefetch = 1
+    }
+    if float64(config.Prefetch) > config.Burst {
+        config.Prefetch = int(config.Burst)
+    }
+    if config.PrefetchTTL <= 0 {
+        config.PrefetchTTL = time.Second
+    }
+    if config.Replicas <= 0 {
+        config.Replicas = 1
+    }
+    if config.RetryInterval <= 0 {
+        config.RetryInterval = 5 * time.Second
+    }
+    if config.Timeout <= 0 {
+        config.Timeout = time.Second
+    }
+    replicas := float64(config.Replicas)
+    return &DistributedLimiter{
+        store:    store,
+        config:   config,
+        gcra:     quota.GCRA{Rate: config.Rate, Burst: config.Burst},
+        fallback: NewRateLimiter(config.Rate/replicas, math.Max(config.Burst/replicas, 1)),
+    }
+}
+
+// Allow checks if a request is allowed by the shared limit
+func (d *DistributedLimiter) Allow(ctx context.Context) bool {
+    return d.AllowN(ctx, 1)
+}
+
+// AllowN checks if n requests are allowed by the shared limit, taking
+// their tokens if so
+func (d *DistributedLimiter) AllowN(ctx context.Context, n int) bool {
+    if d.check(n) != nil {
+        return false
+    }
+    _, ok := d.take(ctx, n, 0)
+    return ok
+}
+
+// Wait blocks until a token is available or ctx is done
+func (d *DistributedLimiter) Wait(ctx context.Context) error {
+    return d.WaitN(ctx, 1)
+}
+
+// WaitN blocks until n tokens are available or ctx is done. It fails with
+// ErrRateLimited at once if the wait would outlast ctx's deadline. Tokens
+// reserved in the store are not returned if ctx is done while waiting.
+func (d *DistributedLimiter) WaitN(ctx context.Context, n int) error {
+    if err := d.check(n); err != nil {
+        return err
+    }
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    maxWait := time.Duration(math.MaxInt64)
+    if deadline, ok := ctx.Deadline(); ok {
+        maxWait = time.Until(deadline)
+    }
+    delay, ok := d.take(ctx, n, maxWait)
+    if !ok {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+        return ErrRateLimited
+    }
+    if delay == 0 {
+        return nil
+    }
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// check rejects requests the limit can never grant, before the store is
+// contacted
+func (d *DistributedLimiter) check(n int) error {
+    if d.config.Rate <= 0 {
+        return ErrRateLimited
+    }
+    if float64(n) > d.config.Burst {
+        return fmt.Errorf("cannot wait for %d tokens with a burst of %v", n, d.config.Burst)
+    }
+    return nil
+}
+
+// Degraded reports whether the limiter is using its local limit because
+// the store failed
+func (d *DistributedLimiter) Degraded() bool {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    return time.Now().Before(d.degradedUntil)
+}
+
+// take takes n tokens usable within maxWait and returns how long to wait
+// before using them. The store is called without holding the mutex. When
+// prefetching, one refill runs at a time and other callers wait for its
+// tokens rather than each calling the store.
+func (d *DistributedLimiter) take(ctx context.Context, n int, maxWait time.Duration) (time.Duration, bool) {
+    prefetch := d.config.Prefetch > n
+    for {
+        d.mutex.Lock()
+        now := time.Now()
+        if !now.Before(d.expires) {
+            d.tokens = 0
+        }
+        if d.tokens >= n {
+            d.tokens -= n
+            d.mutex.Unlock()
+            return 0, true
+        }
+        if now.Before(d.degradedUntil) {
+            defer d.mutex.Unlock()
+            return d.takeLocal(now, n, maxWait)
+        }
+        if prefetch && d.refill != nil {
+            refill := d.refill
+            d.mutex.Unlock()
+            select {
+            case <-refill:
+                continue
+            case <-ctx.Done():
+                return 0, false
+            }
+        }
+        var refill chan struct{}
+        if prefetch {
+            refill = make(chan struct{})
+            d.refill = refill
+        }
+        d.mutex.Unlock()
+
+        return d.acquire(ctx, n, maxWait, refill)
+    }
+}
+
+// acquire takes n tokens, plus up to Prefetch in total for later calls,
+// from the store. refill, if not nil, is closed once they are pooled.
+func (d *DistributedLimiter) acquire(ctx context.Context, n int, maxWait time.Duration, refill chan struct{}) (time.Duration, bool) {
+    storeCtx, cancel := context.WithTimeout(ctx, d.config.Timeout)
+    want := d.config.Prefetch
+    if want < n {
+        want = n
+    }
+    grant, err := d.gcra.Acquire(storeCtx, d.store, d.config.Key, want, n, maxWait)
+    cancel()
+
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    if refill != nil {
+        d.refill = nil
+        close(refill)
+    }
+    now := time.Now()
+    var storeErr *quota.StoreError
+    switch {
+    case err == nil:
+    case errors.As(err, &storeErr) && ctx.Err() == nil:
+        log.Printf("Rate limit store unavailable, using the local limit for %s: %v", d.config.Key, err)
+        d.degradedUntil = now.Add(d.config.RetryInterval)
+        return d.takeLocal(now, n, maxWait)
+    default:
+        // Contention or a caller that gave up; the store itself is fine
+        return 0, false
+    }
+    if grant.Tokens == 0 {
+        return grant.Delay, false
+    }
+    if extra := grant.Tokens - n; extra > 0 {
+        d.tokens += extra
+        d.expires = now.Add(d.config.PrefetchTTL)
+    }
+    return grant.Delay, true
+}
+
+// takeLocal takes n tokens from the local share of the limit; callers hold
+// the mutex
+func (d *DistributedLimiter) takeLocal(now time.Time, n int, maxWait time.Duration) (time.Duration, bool) {
+    d.fallback.mutex.Lock()
+    defer d.fallback.mutex.Unlock()
+    r := d.fallback.reserve(now, n, maxWait)
+    return r.DelayFrom(now), r.ok
+}
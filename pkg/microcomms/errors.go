@@ -3,6 +3,8 @@ package microcomms
 import (
     "errors"
     "fmt"
+    
+    "github.com/pramithamj/microcomms/internal/discovery"
 )
 
 // Common errors
@@ -13,8 +15,24 @@ var (
     ErrServiceDiscoveryNotEnabled = errors.New("service discovery not enabled")
     ErrTimeout                  = errors.New("request timed out")
     ErrInvalidProtocol          = errors.New("invalid protocol")
+    ErrWatchNotSupported        = discovery.ErrWatchNotSupported
 )
 
+// CircuitBreakerOpenError is returned for calls rejected by a circuit
+// breaker. It matches ErrCircuitBreakerOpen with errors.Is.
+type CircuitBreakerOpenError struct {
+    Name  string              // Name of the breaker
+    State CircuitBreakerState // Open, or half-open with every probe slot taken
+}
+
+func (e *CircuitBreakerOpenError) Error() string {
+    return fmt.Sprintf("circuit breaker '%s' is %s", e.Name, e.State)
+}
+
+func (e *CircuitBreakerOpenError) Unwrap() error {
+    return ErrCircuitBreakerOpen
+}
+
 // ServiceError represents an error from a service
 type ServiceError struct {
     ServiceName string
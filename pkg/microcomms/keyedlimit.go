@@ -0,0 +1,182 @@
+package microcomms
+
+import (
+    "context"
+    "math"
+    "sort"
+    "sync"
+    "time"
+)
+
+// RateLimitRule configures the token bucket of a key
+type RateLimitRule struct {
+    Rate  float64 // Tokens added per second; a zero rule leaves keys unlimited
+    Burst float64 // Bucket size (default Rate, at least 1)
+}
+
+// RateLimitKeyFunc returns the keys a request of a kind ("http", "grpc" or
+// "mq") is limited by; the request waits for a token from each of them
+type RateLimitKeyFunc func(ctx context.Context, kind string, req MessageRequest) []string
+
+// DefaultRateLimitKeys limits requests by target, keyed like their circuit
+// breakers, e.g. "http:payments"
+func DefaultRateLimitKeys(ctx context.Context, kind string, req MessageRequest) []string {
+    return []string{BreakerKey(kind, req.Target)}
+}
+
+// KeyedLimiterConfig holds configuration for a keyed rate limiter
+type KeyedLimiterConfig struct {
+    // Rules configure the buckets of keys, matched like circuit breaker
+    // templates: an exact key such as "http:payments" wins over the longest
+    // path.Match pattern such as "apikey:test-*", which wins over a kind
+    // such as "tenant". Every key gets its own bucket, so a "tenant" rule
+    // limits each tenant separately.
+    Rules       map[string]RateLimitRule
+    Default     RateLimitRule // Used for keys no rule applies to (default unlimited)
+    IdleTimeout time.Duration // Full buckets unused for this long are dropped (default 10m)
+}
+
+// KeyedLimiter holds one rate limiter per key, e.g. per downstream service
+// ("http:payments"), tenant ("tenant:acme") or API key ("apikey:k1").
+// Buckets are created from the rules on first use.
+type KeyedLimiter struct {
+    config KeyedLimiterConfig
+
+    mutex     sync.Mutex
+    limiters  map[string]*limiterEntry
+    lastSweep time.Time
+}
+
+// limiterEntry is a bucket and the time it was last used
+type limiterEntry struct {
+    limiter  *RateLimiter
+    lastUsed time.Time
+}
+
+// NewKeyedLimiter creates an empty keyed rate limiter
+func NewKeyedLimiter(config KeyedLimiterConfig) *KeyedLimiter {
+    if config.IdleTimeout <= 0 {
+        config.IdleTimeout = 10 * time.Minute
+    }
+    return &KeyedLimiter{
+        config:    config,
+        limiters:  make(map[string]*limiterEntry),
+        lastSweep: time.Now(),
+    }
+}
+
+// Limiter returns the bucket for a key, creating it from its rule if
+// needed, or false if the key is unlimited
+func (k *KeyedLimiter) Limiter(key string) (*RateLimiter, bool) {
+    k.mutex.Lock()
+    defer k.mutex.Unlock()
+
+    now := time.Now()
+    k.sweep(now)
+    entry, ok := k.limiters[key]
+    if !ok {
+        rule, found := lookupTemplate(k.config.Rules, key)
+        if !found {
+            rule = k.config.Default
+        }
+        if rule.Rate <= 0 {
+            return nil, false
+        }
+        burst := rule.Burst
+        if burst <= 0 {
+            burst = math.Max(rule.Rate, 1)
+        }
+        entry = &limiterEntry{limiter: NewRateLimiter(rule.Rate, burst)}
+        k.limiters[key] = entry
+    }
+    entry.lastUsed = now
+    return entry.limiter, true
+}
+
+// sweep drops idle full buckets, at most twice per idle timeout; callers
+// hold the mutex. Buckets still refilling are kept so that dropping them
+// does not hand out a fresh burst.
+func (k *KeyedLimiter) sweep(now time.Time) {
+    if now.Sub(k.lastSweep) < k.config.IdleTimeout/2 {
+        return
+    }
+    k.lastSweep = now
+    for key, entry := range k.limiters {
+        if now.Sub(entry.lastUsed) > k.config.IdleTimeout && entry.limiter.full(now) {
+            delete(k.limiters, key)
+        }
+    }
+}
+
+// Allow takes a token from the bucket of every key, or from none of them
+// if any is empty
+func (k *KeyedLimiter) Allow(keys ...string) bool {
+    _, ok := k.reserve(time.Now(), keys, 0)
+    return ok
+}
+
+// Wait blocks until every key's bucket has a token or ctx is done. It
+// fails with ErrRateLimited at once if the wait would outlast ctx's
+// deadline.
+func (k *KeyedLimiter) Wait(ctx context.Context, keys ...string) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    now := time.Now()
+    maxWait := time.Duration(math.MaxInt64)
+    if deadline, ok := ctx.Deadline(); ok {
+        maxWait = deadline.Sub(now)
+    }
+    reservations, ok := k.reserve(now, keys, maxWait)
+    if !ok {
+        return ErrRateLimited
+    }
+    return waitFor(ctx, now, reservations)
+}
+
+// reserve takes a token from every key's bucket if all of them can grant
+// it within maxWait, and from none otherwise
+func (k *KeyedLimiter) reserve(now time.Time, keys []string, maxWait time.Duration) ([]*Reservation, bool) {
+    reservations := make([]*Reservation, 0, len(keys))
+    for _, key := range keys {
+        limiter, ok := k.Limiter(key)
+        if !ok {
+            continue
+        }
+        limiter.mutex.Lock()
+        r := limiter.reserve(now, 1, maxWait)
+        limiter.mutex.Unlock()
+        if !r.ok {
+            for _, taken := range reservations {
+                taken.release()
+            }
+            return nil, false
+        }
+        reservations = append(reservations, r)
+    }
+    return reservations, true
+}
+
+// Keys returns the keys that currently have a bucket, sorted
+func (k *KeyedLimiter) Keys() []string {
+    k.mutex.Lock()
+    defer k.mutex.Unlock()
+    keys := make([]string, 0, len(k.limiters))
+    for key := range k.limiters {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// Remove drops the bucket for a key; the next use creates a full one
+func (k *KeyedLimiter) Remove(key string) {
+    k.mutex.Lock()
+    defer k.mutex.Unlock()
+    delete(k.limiters, key)
+}
+
+// limit waits until the rate limits of a request allow it
+func (m *Microcomms) limit(ctx context.Context, kind string, req MessageRequest) error {
+    return m.Limits.Wait(ctx, m.rateLimitKeys(ctx, kind, req)...)
+}
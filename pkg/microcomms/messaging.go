@@ -0,0 +1,197 @@
+package microcomms
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    "github.com/pramithamj/microcomms/internal/mqclient"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/propagation"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// MQBackend selects the message broker used by MQClient
+type MQBackend string
+
+const (
+    MQBackendMemory MQBackend = "memory" // In-process queue
+    MQBackendKafka  MQBackend = "kafka"  // Kafka via KafkaConfig
+    MQBackendNATS   MQBackend = "nats"   // NATS or JetStream via NATSConfig
+)
+
+// KafkaConfig holds configuration for the Kafka broker
+type KafkaConfig = mqclient.KafkaConfig
+
+// KafkaAcks is the number of broker acknowledgements a Kafka produce waits for
+type KafkaAcks = mqclient.KafkaAcks
+
+const (
+    KafkaAcksNone   = mqclient.KafkaAcksNone
+    KafkaAcksLeader = mqclient.KafkaAcksLeader
+    KafkaAcksAll    = mqclient.KafkaAcksAll
+)
+
+// NATSConfig holds configuration for the NATS and JetStream broker
+type NATSConfig = mqclient.NATSConfig
+
+// Message is a message published to or delivered from a topic
+type Message = mqclient.Message
+
+// MessageHandler processes a delivered message; returning an error nacks it
+type MessageHandler = mqclient.Handler
+
+// BatchHandler processes a batch of delivered messages; returning a
+// *BatchError nacks only the messages it lists
+type BatchHandler = mqclient.BatchHandler
+
+// BatchOptions configures a batching subscription
+type BatchOptions = mqclient.BatchOptions
+
+// BatchError reports which messages of a batch failed
+type BatchError = mqclient.BatchError
+
+// Subscription is an active topic subscription
+type Subscription = mqclient.Subscription
+
+// SubscribeOptions configures a topic subscription
+type SubscribeOptions = mqclient.SubscribeOptions
+
+// DedupConfig configures idempotent consumption for a subscription
+type DedupConfig = mqclient.DedupConfig
+
+// DedupStore persists message processing outcomes by deduplication key
+type DedupStore = mqclient.DedupStore
+
+// DedupRecord is the outcome recorded for a deduplication key
+type DedupRecord = mqclient.DedupRecord
+
+// NewMemoryDedupStore creates an in-memory LRU dedup store with a TTL
+func NewMemoryDedupStore(capacity int, ttl time.Duration) *mqclient.MemoryDedupStore {
+    return mqclient.NewMemoryDedupStore(capacity, ttl)
+}
+
+// NewFileDedupStore creates a dedup store persisted to a file at path
+func NewFileDedupStore(path string, ttl time.Duration) (*mqclient.FileDedupStore, error) {
+    return mqclient.NewFileDedupStore(path, ttl)
+}
+
+// NewBatchError creates an empty BatchError for a batch handler to fill in
+func NewBatchError() *BatchError {
+    return mqclient.NewBatchError()
+}
+
+// messageCarrier propagates trace context through message headers
+type messageCarrier struct {
+    msg *Message
+}
+
+func (c messageCarrier) Get(key string) string {
+    return c.msg.Headers[key]
+}
+
+func (c messageCarrier) Set(key, value string) {
+    if c.msg.Headers == nil {
+        c.msg.Headers = make(map[string]string)
+    }
+    c.msg.Headers[key] = value
+}
+
+func (c messageCarrier) Keys() []string {
+    keys := make([]string, 0, len(c.msg.Headers))
+    for k := range c.msg.Headers {
+        keys = append(keys, k)
+    }
+    return keys
+}
+
+var messagePropagator = propagation.TraceContext{}
+
+// Publish publishes a message to its topic with tracing
+func (m *MQClient) Publish(ctx context.Context, msg *Message) error {
+    ctx, span := StartSpan(ctx, "MQClient.Publish")
+    defer span.End()
+
+    messagePropagator.Inject(ctx, messageCarrier{msg})
+    return m.broker.Publish(ctx, msg)
+}
+
+// PublishBatch publishes messages in a single broker call. Each message gets
+// its own span under the batch span so that consumers can link back to it,
+// and per-message failures are returned as a *BatchError and recorded on
+// the message's span.
+func (m *MQClient) PublishBatch(ctx context.Context, msgs []*Message) error {
+    ctx, span := StartSpan(ctx, "MQClient.PublishBatch")
+    defer span.End()
+    span.SetAttributes(attribute.Int("messaging.batch.message_count", len(msgs)))
+
+    spans := make([]trace.Span, len(msgs))
+    for i, msg := range msgs {
+        msgCtx, msgSpan := StartSpan(ctx, "MQClient.PublishBatch.Message")
+        msgSpan.SetAttributes(attribute.String("messaging.destination.name", msg.Topic))
+        messagePropagator.Inject(msgCtx, messageCarrier{msg})
+        spans[i] = msgSpan
+    }
+
+    err := m.broker.PublishBatch(ctx, msgs)
+    var batchErr *BatchError
+    partial := errors.As(err, &batchErr)
+    for i, msgSpan := range spans {
+        msgErr := err
+        if partial {
+            msgErr = batchErr.Failed(i)
+        }
+        if msgErr != nil {
+            msgSpan.RecordError(msgErr)
+        }
+        msgSpan.End()
+    }
+    if err != nil {
+        span.RecordError(err)
+    }
+    return err
+}
+
+// Subscribe registers a handler for messages published to topic
+func (m *MQClient) Subscribe(topic string, handler MessageHandler) (*Subscription, error) {
+    return m.SubscribeWithOptions(topic, handler, SubscribeOptions{})
+}
+
+// SubscribeWithOptions registers a handler for messages published to topic,
+// optionally skipping messages that were already processed
+func (m *MQClient) SubscribeWithOptions(topic string, handler MessageHandler, opts SubscribeOptions) (*Subscription, error) {
+    return m.broker.SubscribeWithOptions(topic, func(ctx context.Context, msg *Message) error {
+        ctx = messagePropagator.Extract(ctx, messageCarrier{msg})
+        ctx, span := StartSpan(ctx, "MQClient.Consume")
+        defer span.End()
+
+        return handler(ctx, msg)
+    }, opts)
+}
+
+// SubscribeBatch registers a handler that receives messages in batches. The
+// span around each batch is linked to the publish span of every message in it.
+func (m *MQClient) SubscribeBatch(topic string, handler BatchHandler, opts BatchOptions) (*Subscription, error) {
+    return m.broker.SubscribeBatch(topic, func(ctx context.Context, msgs []*Message) error {
+        links := make([]trace.Link, 0, len(msgs))
+        for _, msg := range msgs {
+            msgCtx := messagePropagator.Extract(ctx, messageCarrier{msg})
+            if sc := trace.SpanContextFromContext(msgCtx); sc.IsValid() {
+                links = append(links, trace.Link{SpanContext: sc})
+            }
+        }
+
+        ctx, span := StartSpan(ctx, "MQClient.ConsumeBatch", trace.WithLinks(links...))
+        defer span.End()
+        span.SetAttributes(attribute.Int("messaging.batch.message_count", len(msgs)))
+
+        return handler(ctx, msgs)
+    }, opts)
+}
+
+// Close stops the client's subscriptions and closes its broker, releasing
+// Kafka clients and consumer group membership or draining the NATS
+// connection
+func (m *MQClient) Close() error {
+    return m.broker.Close()
+}
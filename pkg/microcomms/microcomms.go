@@ -3,7 +3,9 @@ package microcomms
 
 import (
     "context"
+    "io"
     "net/http"
+    "sync"
     "time"
     
     "github.com/pramithamj/microcomms/internal/config"
@@ -19,15 +21,31 @@ type Microcomms struct {
     HTTPClient     *HTTPClient
     GRPCClient     *GRPCClient
     MQClient       *MQClient
-    Discovery      *discovery.ConsulDiscovery
+    Discovery      discovery.Resolver
+    Registry       discovery.Registry // Set when the discovery backend supports registration
+    Balancers      *discovery.Balancers // Pick the instance of a service that receives a request
+    Outliers       *discovery.OutlierDetector // Ejects misbehaving instances; nil when disabled
+    // CircuitBreakers holds the kind-wide "http", "grpc" and "mq" breakers.
+    // Requests use the per-target breakers in Breakers instead.
     CircuitBreakers map[string]*CircuitBreaker
+    Breakers       *CircuitBreakerRegistry // One circuit breaker per service, host or gRPC method
+    Limits         *KeyedLimiter // Rate limits per target, tenant or API key
     Logger         zerolog.Logger
     config         *config.Config
+    queries        map[string]ServiceQuery
+    zone           ZoneConfig
+    urls           *discovery.URLResolver
+    rateLimitKeys  RateLimitKeyFunc
+    grpcMutex      sync.Mutex
+    grpcClients    map[string]*GRPCClient // Clients dialed for gRPC service URLs, by scheme and service
 }
 
 // HTTPClient wraps the internal HTTP client
 type HTTPClient struct {
     client *httpclient.Client
+    // resolve turns service URLs into instance URLs; nil for clients that
+    // only take plain http(s) URLs
+    resolve func(ctx context.Context, target string) (string, requestTracker, error)
 }
 
 // GRPCClient wraps the internal gRPC client
@@ -37,7 +55,8 @@ type GRPCClient struct {
 
 // MQClient wraps the internal message queue client
 type MQClient struct {
-    queue *mqclient.MessageQueue
+    queue  *mqclient.MessageQueue
+    broker mqclient.Broker
 }
 
 // MicrocommsConfig holds configuration for Microcomms
@@ -45,9 +64,30 @@ type MicrocommsConfig struct {
     HTTPTimeout       time.Duration
     HTTPRetryAttempts int
     ServiceDiscovery  bool
+    DiscoveryBackend  DiscoveryBackend    // Registry used when ServiceDiscovery is enabled (default consul)
     ConsulAddress     string
+    StaticServices    map[string][]string // "host:port" addresses by service name for DiscoveryBackendStatic
+    DiscoveryFilePath string              // JSON service table for DiscoveryBackendFile
+    Etcd              EtcdConfig          // Used when DiscoveryBackend is DiscoveryBackendEtcd
+    DNS               DNSConfig           // Used when DiscoveryBackend is DiscoveryBackendDNS
+    LoadBalancer      BalancerStrategy    // Balancer for services without their own (default round-robin)
+    ServiceBalancers  map[string]BalancerStrategy // Balancer per target service
+    StaleCacheTTL     time.Duration       // How long last-known instances are served while discovery fails (0 disables)
+    DiscoverySnapshotPath string          // Optional file persisting last-known instances for cold starts
+    OutlierDetection  bool                // Eject instances that fail or lag in real traffic
+    Outliers          OutlierConfig       // Used when OutlierDetection is enabled
+    ServiceQueries    map[string]ServiceQuery // Filters applied when resolving a service by name
+    Zone              ZoneConfig          // Prefer instances in this process's zone
+    CircuitBreakers   map[string]CircuitBreakerConfig // Breaker templates by key, key pattern or kind ("http", "grpc", "mq")
+    CircuitBreakerIdleTimeout time.Duration // Idle per-target breakers are dropped after this long (default 10m)
+    BreakerSharing    BreakerSharingConfig // Share breaker trips and recoveries with other replicas when a backend is set
+    RateLimits        KeyedLimiterConfig // Rate limit rules by key, key pattern or kind (default unlimited)
+    RateLimitKeys     RateLimitKeyFunc   // Keys a request is limited by (default its target)
     TracingEnabled    bool
     ServiceName       string
+    MQBackend         MQBackend   // Message broker used by MQClient (default in-memory)
+    Kafka             KafkaConfig // Used when MQBackend is MQBackendKafka
+    NATS              NATSConfig  // Used when MQBackend is MQBackendNATS
 }
 
 // DefaultConfig returns a default MicrocommsConfig
@@ -56,9 +96,13 @@ func DefaultConfig() MicrocommsConfig {
         HTTPTimeout:       5 * time.Second,
         HTTPRetryAttempts: 3,
         ServiceDiscovery:  true,
+        DiscoveryBackend:  DiscoveryBackendConsul,
         ConsulAddress:     "localhost:8500",
+        StaleCacheTTL:     5 * time.Minute,
+        OutlierDetection:  true,
         TracingEnabled:    true,
         ServiceName:       "microcomms-client",
+        MQBackend:         MQBackendMemory,
     }
 }
 
@@ -97,38 +141,149 @@ func NewMicrocommsWithConfig(cfg MicrocommsConfig) *Microcomms {
     
     // Initialize MQ client
     mqClient := mqclient.NewMessageQueue(10)
+    var broker mqclient.Broker = mqClient
+    switch cfg.MQBackend {
+    case MQBackendKafka:
+        kafkaBroker, err := mqclient.NewKafkaBroker(cfg.Kafka)
+        if err != nil {
+            logger.Error().Err(err).Msg("Failed to initialize Kafka broker")
+        } else {
+            broker = kafkaBroker
+        }
+    case MQBackendNATS:
+        natsBroker, err := mqclient.NewNATSBroker(cfg.NATS)
+        if err != nil {
+            logger.Error().Err(err).Msg("Failed to initialize NATS broker")
+        } else {
+            broker = natsBroker
+        }
+    }
     
     // Initialize service discovery
-    var discoveryClient *discovery.ConsulDiscovery
+    var resolver discovery.Resolver
+    var registry discovery.Registry
     if cfg.ServiceDiscovery {
-        dc, err := discovery.NewConsulDiscovery(cfg.ConsulAddress)
+        r, err := newResolver(cfg)
         if err != nil {
             logger.Error().Err(err).Msg("Failed to initialize service discovery")
         } else {
-            discoveryClient = dc
+            resolver = r
+            registry, _ = r.(discovery.Registry)
+        }
+    }
+    backend := resolver
+    if resolver != nil && cfg.StaleCacheTTL > 0 {
+        stale, err := discovery.NewStaleResolver(resolver, discovery.StaleConfig{
+            MaxStale:     cfg.StaleCacheTTL,
+            SnapshotPath: cfg.DiscoverySnapshotPath,
+        })
+        if err != nil {
+            logger.Error().Err(err).Msg("Failed to initialize stale discovery cache")
+        } else {
+            resolver = stale
+        }
+    }
+    
+    // Initialize load balancing
+    balancers, err := discovery.NewBalancers(cfg.LoadBalancer, cfg.ServiceBalancers)
+    if err != nil {
+        logger.Error().Err(err).Msg("Failed to initialize load balancers")
+        balancers, _ = discovery.NewBalancers(RoundRobin, nil)
+    }
+    if consul, ok := backend.(*discovery.ConsulDiscovery); ok {
+        consul.SetBalancers(balancers)
+    }
+    
+    var outliers *discovery.OutlierDetector
+    if cfg.OutlierDetection {
+        outliers, err = discovery.NewOutlierDetector(cfg.Outliers)
+        if err != nil {
+            logger.Error().Err(err).Msg("Failed to initialize outlier detection")
         }
     }
     
     // Initialize circuit breakers
+    templates := map[string]CircuitBreakerConfig{
+        "http": {FailureThreshold: 5, ResetTimeout: 30 * time.Second},
+        "grpc": {FailureThreshold: 3, ResetTimeout: 20 * time.Second},
+        "mq":   {FailureThreshold: 10, ResetTimeout: 60 * time.Second},
+    }
+    for key, breakerCfg := range cfg.CircuitBreakers {
+        templates[key] = breakerCfg
+    }
     circuitBreakers := make(map[string]*CircuitBreaker)
-    circuitBreakers["http"] = NewCircuitBreaker("http", 5, 30*time.Second)
-    circuitBreakers["grpc"] = NewCircuitBreaker("grpc", 3, 20*time.Second)
-    circuitBreakers["mq"] = NewCircuitBreaker("mq", 10, 60*time.Second)
+    for _, kind := range []string{"http", "grpc", "mq"} {
+        breakerCfg := templates[kind]
+        breakerCfg.Name = kind
+        circuitBreakers[kind] = NewCircuitBreakerWithConfig(breakerCfg)
+    }
+    breakers := NewCircuitBreakerRegistry(CircuitBreakerRegistryConfig{
+        Templates:   templates,
+        IdleTimeout: cfg.CircuitBreakerIdleTimeout,
+        OnStateChange: func(name string, from, to CircuitBreakerState) {
+            logger.Warn().Str("breaker", name).Str("from", from.String()).Str("to", to.String()).Msg("Circuit breaker state changed")
+        },
+    })
     
-    return &Microcomms{
+    m := &Microcomms{
         HTTPClient: &HTTPClient{client: httpClient},
         GRPCClient: &GRPCClient{client: grpcClient},
-        MQClient:   &MQClient{queue: mqClient},
-        Discovery:  discoveryClient,
+        MQClient:   &MQClient{queue: mqClient, broker: broker},
+        Discovery:  resolver,
+        Registry:   registry,
+        Balancers:  balancers,
+        Outliers:   outliers,
         CircuitBreakers: circuitBreakers,
+        Breakers:   breakers,
+        Limits:     NewKeyedLimiter(cfg.RateLimits),
         Logger:     logger,
         config:     internalCfg,
+        queries:    cfg.ServiceQueries,
+        zone:       cfg.Zone,
+        urls:       newURLResolver(cfg, resolver, balancers),
+        rateLimitKeys: cfg.RateLimitKeys,
+        grpcClients: make(map[string]*GRPCClient),
+    }
+    m.HTTPClient.resolve = m.resolveURL
+    if m.rateLimitKeys == nil {
+        m.rateLimitKeys = DefaultRateLimitKeys
+    }
+    if cfg.BreakerSharing.Backend != nil {
+        if err := breakers.Share(context.Background(), cfg.BreakerSharing); err != nil {
+            logger.Error().Err(err).Msg("Failed to share circuit breaker state")
+        }
+    }
+    return m
+}
+
+// Close releases the message broker, the gRPC connections and registry
+// clients created for service URLs, such as the etcd client behind
+// "etcd://" targets, and the discovery client if it can be closed
+func (m *Microcomms) Close() error {
+    err := m.MQClient.Close()
+    
+    m.grpcMutex.Lock()
+    for key, client := range m.grpcClients {
+        client.client.Close()
+        delete(m.grpcClients, key)
+    }
+    m.grpcMutex.Unlock()
+    
+    if closeErr := m.urls.Close(); closeErr != nil && err == nil {
+        err = closeErr
+    }
+    if closer, ok := m.Discovery.(io.Closer); ok {
+        if closeErr := closer.Close(); closeErr != nil && err == nil {
+            err = closeErr
+        }
     }
+    return err
 }
 
-// Get makes an HTTP GET request with circuit breaker and tracing
+// Get makes an HTTP GET request with circuit breaker and tracing. The URL
+// may be a service URL such as "consul://payments/v1/charges".
 func (h *HTTPClient) Get(url string) (*http.Response, error) {
-    return h.client.Get(url)
+    return h.GetWithContext(context.Background(), url)
 }
 
 // GetWithContext makes an HTTP GET request with context, circuit breaker, and tracing
@@ -136,7 +291,16 @@ func (h *HTTPClient) GetWithContext(ctx context.Context, url string) (*http.Resp
     ctx, span := StartSpan(ctx, "HTTPClient.GetWithContext")
     defer span.End()
     
-    return h.client.Get(url)
+    if h.resolve == nil {
+        return h.client.GetWithAttempts(ctx, url, nil)
+    }
+    resolved, track, err := h.resolve(ctx, url)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := h.client.GetWithAttempts(ctx, resolved, track.attempt)
+    track.done(err)
+    return resp, err
 }
 
 // CallExample makes a gRPC call with circuit breaker and tracing
@@ -167,11 +331,7 @@ func (m *MQClient) ReceiveMessage() (string, error) {
 
 // ResolveService resolves a service using service discovery
 func (m *Microcomms) ResolveService(name string) (string, error) {
-    if m.Discovery == nil {
-        return "", ErrServiceDiscoveryNotEnabled
-    }
-    
-    return m.Discovery.FindService(name)
+    return m.ResolveURL(context.Background(), name)
 }
 
 // Get makes an HTTP GET request to a service using service discovery
@@ -179,25 +339,12 @@ func (m *Microcomms) Get(ctx context.Context, serviceName, path string) (*http.R
     ctx, span := StartSpan(ctx, "Microcomms.Get")
     defer span.End()
     
-    // Circuit breaker pattern
-    var resp *http.Response
-    var err error
-    
-    err = m.CircuitBreakers["http"].Execute(func() error {
-        // Resolve service name if using service discovery
-        serviceURL := serviceName
-        if m.Discovery != nil {
-            resolvedURL, resolveErr := m.Discovery.FindService(serviceName)
-            if resolveErr != nil {
-                return resolveErr
-            }
-            serviceURL = resolvedURL
-        }
-        
-        // Make the request
-        resp, err = m.HTTPClient.GetWithContext(ctx, serviceURL+path)
-        return err
-    })
+    if err := m.limit(ctx, "http", MessageRequest{Target: serviceName}); err != nil {
+        return nil, err
+    }
     
-    return resp, err
+    // The HTTP client resolves service names and service URLs
+    return Execute(ctx, m.Breakers.Get(BreakerKey("http", serviceName)), func(ctx context.Context) (*http.Response, error) {
+        return m.HTTPClient.GetWithContext(ctx, serviceName+path)
+    }, nil)
 }
\ No newline at end of file
@@ -1,16 +1,22 @@
 package microcomms
 
 import (
+    "context"
+    "fmt"
+    "math"
     "sync"
     "time"
 )
 
-// RateLimiter implements a token bucket rate limiter
+// RateLimiter implements a token bucket rate limiter. Tokens may be
+// reserved ahead of time: the bucket then goes into debt and later callers
+// wait behind earlier ones, so waiters are served in order without polling.
 type RateLimiter struct {
     tokensPerSecond float64
     maxTokens       float64
     tokens          float64
     lastRefill      time.Time
+    changed         chan struct{} // Closed when the rate or burst changes
     mutex           sync.Mutex
 }
 
@@ -21,49 +27,263 @@ func NewRateLimiter(tokensPerSecond, maxTokens float64) *RateLimiter {
         maxTokens:       maxTokens,
         tokens:          maxTokens,
         lastRefill:      time.Now(),
+        changed:         make(chan struct{}),
     }
 }
 
-// Allow checks if a request is allowed by the rate limiter
-func (rl *RateLimiter) Allow() bool {
+// Reservation holds tokens taken from a rate limiter, usable after Delay
+type Reservation struct {
+    limiter   *RateLimiter
+    ok        bool
+    tokens    float64
+    timeToAct time.Time
+}
+
+// OK reports whether the limiter can ever grant the reservation. A
+// reservation for more tokens than the burst size is never granted.
+func (r *Reservation) OK() bool {
+    return r.ok
+}
+
+// Delay returns how long to wait before acting on the reservation
+func (r *Reservation) Delay() time.Duration {
+    return r.DelayFrom(time.Now())
+}
+
+// DelayFrom returns how long to wait from now before acting on the
+// reservation, or math.MaxInt64 if it is not OK
+func (r *Reservation) DelayFrom(now time.Time) time.Duration {
+    if !r.ok {
+        return math.MaxInt64
+    }
+    if delay := r.timeToAct.Sub(now); delay > 0 {
+        return delay
+    }
+    return 0
+}
+
+// Cancel returns the reservation's tokens to the limiter if it has not yet
+// come due, e.g. when the caller gives up waiting
+func (r *Reservation) Cancel() {
+    r.giveBack(false)
+}
+
+// release returns the reservation's tokens even if it has come due, for
+// reservations taken together with others that could not be granted
+func (r *Reservation) release() {
+    r.giveBack(true)
+}
+
+// giveBack returns the reservation's tokens to the limiter once
+func (r *Reservation) giveBack(due bool) {
+    if !r.ok || r.tokens == 0 {
+        return
+    }
+    rl := r.limiter
     rl.mutex.Lock()
     defer rl.mutex.Unlock()
-    
-    // Refill tokens
+
     now := time.Now()
+    if !due && !r.timeToAct.After(now) {
+        return
+    }
+    rl.refill(now)
+    rl.tokens += r.tokens
+    if rl.tokens > rl.maxTokens {
+        rl.tokens = rl.maxTokens
+    }
+    r.tokens = 0
+}
+
+// full reports whether the bucket has refilled to its burst size
+func (rl *RateLimiter) full(now time.Time) bool {
+    rl.mutex.Lock()
+    defer rl.mutex.Unlock()
+    rl.refill(now)
+    return rl.tokens >= rl.maxTokens
+}
+
+// refill adds the tokens earned since the last refill; callers hold the mutex
+func (rl *RateLimiter) refill(now time.Time) {
     elapsed := now.Sub(rl.lastRefill).Seconds()
+    if elapsed <= 0 {
+        return
+    }
     rl.lastRefill = now
-    
-    // Add tokens based on elapsed time
     rl.tokens += elapsed * rl.tokensPerSecond
     if rl.tokens > rl.maxTokens {
         rl.tokens = rl.maxTokens
     }
-    
-    // Check if we have enough tokens
-    if rl.tokens < 1 {
-        return false
+}
+
+// reserve takes n tokens if they are available within maxWait; callers
+// hold the mutex
+func (rl *RateLimiter) reserve(now time.Time, n int, maxWait time.Duration) *Reservation {
+    rl.refill(now)
+    tokens := float64(n)
+    if tokens > rl.maxTokens {
+        return &Reservation{limiter: rl}
+    }
+
+    var wait time.Duration
+    if missing := tokens - rl.tokens; missing > 0 {
+        if rl.tokensPerSecond <= 0 {
+            return &Reservation{limiter: rl}
+        }
+        wait = time.Duration(missing / rl.tokensPerSecond * float64(time.Second))
+    }
+    if wait > maxWait {
+        return &Reservation{limiter: rl}
     }
-    
-    // Use a token
-    rl.tokens--
-    return true
+    rl.tokens -= tokens
+    return &Reservation{limiter: rl, ok: true, tokens: tokens, timeToAct: now.Add(wait)}
 }
 
-// WaitAndAllow waits until a token is available and then uses it
+// Allow checks if a request is allowed by the rate limiter
+func (rl *RateLimiter) Allow() bool {
+    return rl.AllowN(time.Now(), 1)
+}
+
+// AllowN checks if n requests are allowed at now, taking their tokens if so
+func (rl *RateLimiter) AllowN(now time.Time, n int) bool {
+    rl.mutex.Lock()
+    defer rl.mutex.Unlock()
+    return rl.reserve(now, n, 0).ok
+}
+
+// Reserve reserves a token; the caller waits Delay before acting, or calls
+// Cancel if it does not act
+func (rl *RateLimiter) Reserve() *Reservation {
+    return rl.ReserveN(time.Now(), 1)
+}
+
+// ReserveN reserves n tokens at now
+func (rl *RateLimiter) ReserveN(now time.Time, n int) *Reservation {
+    rl.mutex.Lock()
+    defer rl.mutex.Unlock()
+    return rl.reserve(now, n, math.MaxInt64)
+}
+
+// Wait blocks until a token is available or ctx is done
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+    return rl.WaitN(ctx, 1)
+}
+
+// WaitN blocks until n tokens are available or ctx is done. It fails at
+// once if n exceeds the burst size or the wait would outlast ctx's
+// deadline; tokens of an abandoned wait are returned to the limiter.
+func (rl *RateLimiter) WaitN(ctx context.Context, n int) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+    now := time.Now()
+    maxWait := time.Duration(math.MaxInt64)
+    if deadline, ok := ctx.Deadline(); ok {
+        maxWait = deadline.Sub(now)
+    }
+
+    rl.mutex.Lock()
+    r := rl.reserve(now, n, maxWait)
+    burst := rl.maxTokens
+    rl.mutex.Unlock()
+    if !r.ok {
+        if float64(n) > burst {
+            return fmt.Errorf("cannot wait for %d tokens with a burst of %v", n, burst)
+        }
+        return ErrRateLimited
+    }
+
+    return waitFor(ctx, now, []*Reservation{r})
+}
+
+// waitFor blocks until every reservation is due, cancelling them if ctx is
+// done first
+func waitFor(ctx context.Context, now time.Time, reservations []*Reservation) error {
+    var delay time.Duration
+    for _, r := range reservations {
+        if d := r.DelayFrom(now); d > delay {
+            delay = d
+        }
+    }
+    if delay == 0 {
+        return nil
+    }
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return nil
+    case <-ctx.Done():
+        for _, r := range reservations {
+            r.Cancel()
+        }
+        return ctx.Err()
+    }
+}
+
+// WaitAndAllow waits until a token is available and then uses it. A
+// limiter that cannot grant tokens at its current rate and burst blocks
+// until SetRate or SetBurst changes them. Prefer Wait, which can be
+// cancelled.
 func (rl *RateLimiter) WaitAndAllow() {
     for {
-        if rl.Allow() {
+        rl.mutex.Lock()
+        changed := rl.changed
+        rl.mutex.Unlock()
+        if rl.Wait(context.Background()) == nil {
             return
         }
-        time.Sleep(time.Millisecond * 10)
+        <-changed
     }
 }
 
+// notifyChange wakes WaitAndAllow callers blocked on the old settings;
+// callers hold the mutex
+func (rl *RateLimiter) notifyChange() {
+    close(rl.changed)
+    rl.changed = make(chan struct{})
+}
+
+// Rate returns the number of tokens added per second
+func (rl *RateLimiter) Rate() float64 {
+    rl.mutex.Lock()
+    defer rl.mutex.Unlock()
+    return rl.tokensPerSecond
+}
+
+// Burst returns the bucket size
+func (rl *RateLimiter) Burst() float64 {
+    rl.mutex.Lock()
+    defer rl.mutex.Unlock()
+    return rl.maxTokens
+}
+
+// SetRate changes the number of tokens added per second. Tokens earned so
+// far are kept; pending reservations keep their original delay.
+func (rl *RateLimiter) SetRate(tokensPerSecond float64) {
+    rl.mutex.Lock()
+    defer rl.mutex.Unlock()
+    rl.refill(time.Now())
+    rl.tokensPerSecond = tokensPerSecond
+    rl.notifyChange()
+}
+
+// SetBurst changes the bucket size; a smaller bucket drops excess tokens
+func (rl *RateLimiter) SetBurst(maxTokens float64) {
+    rl.mutex.Lock()
+    defer rl.mutex.Unlock()
+    rl.refill(time.Now())
+    rl.maxTokens = maxTokens
+    if rl.tokens > rl.maxTokens {
+        rl.tokens = rl.maxTokens
+    }
+    rl.notifyChange()
+}
+
 // RateLimitedFunc wraps a function with rate limiting
 func (m *Microcomms) RateLimitedFunc(limiter *RateLimiter, fn func() error) error {
     if !limiter.Allow() {
         return ErrRateLimited
     }
     return fn()
-}
\ No newline at end of file
+}
@@ -0,0 +1,192 @@
+package microcomms
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/pramithamj/microcomms/internal/breakerstate"
+)
+
+// Breaker state sharing types
+type (
+    BreakerEvent        = breakerstate.Event
+    BreakerStateBackend = breakerstate.Backend
+)
+
+// NewMemoryBreakerBackend creates a backend sharing breaker state between
+// registries in one process
+func NewMemoryBreakerBackend() BreakerStateBackend {
+    return breakerstate.NewMemoryBackend()
+}
+
+// NewConsulBreakerBackend creates a backend storing breaker state in the
+// Consul KV store under prefix (default "microcomms/breakers")
+func NewConsulBreakerBackend(addr, prefix string) (BreakerStateBackend, error) {
+    return breakerstate.NewConsulBackend(addr, prefix)
+}
+
+// NewEtcdBreakerBackend creates a backend storing breaker state in etcd
+// under prefix (default "/microcomms/breakers")
+func NewEtcdBreakerBackend(endpoints []string, prefix string) (BreakerStateBackend, error) {
+    return breakerstate.NewEtcdBackend(endpoints, prefix)
+}
+
+// BreakerBackend returns a backend sharing breaker state through a topic of
+// the client's broker (default "microcomms.breakers"). replicaID must be
+// unique per replica so that every replica receives every event.
+func (m *MQClient) BreakerBackend(topic, replicaID string) BreakerStateBackend {
+    return breakerstate.NewBrokerBackend(m.broker, topic, replicaID)
+}
+
+// BreakerSharingConfig holds configuration for sharing breaker state
+// between replicas
+type BreakerSharingConfig struct {
+    Backend     BreakerStateBackend // Carries events between replicas; sharing is off when nil
+    ReplicaID   string              // Identifies this replica's events (default hostname-pid)
+    MaxEventAge time.Duration       // Older events are ignored, e.g. stored ones at startup (default 5m)
+}
+
+// Share publishes the trips and recoveries of the registry's breakers to
+// the backend and applies those of other replicas until ctx is done. A
+// remote trip opens the local breaker, creating it if needed; a remote
+// recovery moves an open local breaker to half-open so that this replica
+// probes before closing it. A newer local transition wins over an older
+// event, and breakers pinned with Override ignore remote events.
+func (r *CircuitBreakerRegistry) Share(ctx context.Context, config BreakerSharingConfig) error {
+    if config.Backend == nil {
+        return fmt.Errorf("breaker sharing requires a backend")
+    }
+    if config.ReplicaID == "" {
+        host, _ := os.Hostname()
+        config.ReplicaID = fmt.Sprintf("%s-%d", host, os.Getpid())
+    }
+    if config.MaxEventAge <= 0 {
+        config.MaxEventAge = 5 * time.Minute
+    }
+
+    queue := &breakerEventQueue{backend: config.Backend, wake: make(chan struct{}, 1)}
+    go queue.run(ctx)
+    publish := func(key string, open bool, at time.Time) {
+        queue.push(BreakerEvent{Key: key, Open: open, Origin: config.ReplicaID, Time: at})
+    }
+    r.mutex.Lock()
+    r.publish = publish
+    for key, entry := range r.breakers {
+        entry.breaker.setShare(sharer(publish, key))
+    }
+    r.mutex.Unlock()
+
+    err := config.Backend.Subscribe(ctx, func(event BreakerEvent) {
+        if event.Origin == config.ReplicaID || time.Since(event.Time) > config.MaxEventAge {
+            return
+        }
+        r.applyEvent(event)
+    })
+    if err != nil {
+        return fmt.Errorf("failed to subscribe to breaker events: %v", err)
+    }
+    go func() {
+        <-ctx.Done()
+        r.mutex.Lock()
+        r.publish = nil
+        for _, entry := range r.breakers {
+            entry.breaker.setShare(nil)
+        }
+        r.mutex.Unlock()
+    }()
+    return nil
+}
+
+// sharer returns the hook through which the breaker of a key publishes
+func sharer(publish func(key string, open bool, at time.Time), key string) func(open bool, at time.Time) {
+    if publish == nil {
+        return nil
+    }
+    return func(open bool, at time.Time) { publish(key, open, at) }
+}
+
+// breakerEventQueue publishes a registry's events one at a time, in the
+// order they were queued, so that a trip and the recovery right after it
+// reach the backend in that order. Breakers report transitions after
+// releasing their lock, so an event may still be queued after a newer one
+// of its key; it is dropped rather than published over the newer one.
+type breakerEventQueue struct {
+    backend BreakerStateBackend
+    wake    chan struct{} // Signalled when events are queued
+
+    mutex   sync.Mutex
+    pending []BreakerEvent
+}
+
+// push queues an event for publishing
+func (q *breakerEventQueue) push(event BreakerEvent) {
+    q.mutex.Lock()
+    q.pending = append(q.pending, event)
+    q.mutex.Unlock()
+    select {
+    case q.wake <- struct{}{}:
+    default:
+    }
+}
+
+// run publishes queued events until ctx is done
+func (q *breakerEventQueue) run(ctx context.Context) {
+    latest := make(map[string]time.Time) // Time of the last event published per key
+    lastPrune := time.Now()
+    for {
+        select {
+        case <-q.wake:
+        case <-ctx.Done():
+            return
+        }
+        q.mutex.Lock()
+        events := q.pending
+        q.pending = nil
+        q.mutex.Unlock()
+
+        for _, event := range events {
+            if event.Time.Before(latest[event.Key]) {
+                continue
+            }
+            latest[event.Key] = event.Time
+            pubCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+            err := q.backend.Publish(pubCtx, event)
+            cancel()
+            if err != nil && ctx.Err() == nil {
+                log.Printf("Failed to share state of breaker %s: %v", event.Key, err)
+            }
+        }
+
+        // Events are only ever a moment late, so old times can be forgotten
+        if now := time.Now(); now.Sub(lastPrune) > time.Minute {
+            lastPrune = now
+            for key, at := range latest {
+                if now.Sub(at) > time.Minute {
+                    delete(latest, key)
+                }
+            }
+        }
+    }
+}
+
+// applyEvent applies another replica's event to the breaker of its key. Only
+// trips create breakers: a recovery has nothing to do for an unknown key.
+func (r *CircuitBreakerRegistry) applyEvent(event BreakerEvent) {
+    var cb *CircuitBreaker
+    if event.Open {
+        cb = r.Get(event.Key)
+    } else {
+        r.mutex.Lock()
+        if entry, ok := r.breakers[event.Key]; ok {
+            cb = entry.breaker
+        }
+        r.mutex.Unlock()
+    }
+    if cb != nil {
+        cb.applyRemote(event.Open, event.Time)
+    }
+}
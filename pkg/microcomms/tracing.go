@@ -27,9 +27,9 @@ func InitTracing(config TracingConfig) {
 }
 
 // StartSpan starts a new tracing span
-func StartSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+func StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
     tracer := otel.Tracer("github.com/pramithamj/microcomms")
-    return tracer.Start(ctx, name)
+    return tracer.Start(ctx, name, opts...)
 }
 
 // AddSpanEvent adds an event to the current span
@@ -3,7 +3,11 @@ package microcomms
 import (
     "context"
     "fmt"
+    "net/http"
+    "strings"
     "time"
+    
+    "github.com/pramithamj/microcomms/internal/discovery"
 )
 
 // MessageRequest represents a generic communication request
@@ -37,6 +41,10 @@ const (
 // If protocol is Auto, it will select the best protocol based on the message type
 // If protocol is Fallback, it will try HTTP first, then gRPC, then MQ
 func (m *Microcomms) Send(ctx context.Context, req MessageRequest, protocol ProtocolType) (*MessageResponse, error) {
+    if _, ok := discovery.HashKeyFromContext(ctx); !ok && req.Headers[HashKeyHeader] != "" {
+        ctx = WithHashKey(ctx, req.Headers[HashKeyHeader])
+    }
+    
     switch protocol {
     case ProtocolHTTP:
         return m.sendHTTP(ctx, req)
@@ -55,9 +63,14 @@ func (m *Microcomms) Send(ctx context.Context, req MessageRequest, protocol Prot
 
 // sendHTTP sends a message over HTTP
 func (m *Microcomms) sendHTTP(ctx context.Context, req MessageRequest) (*MessageResponse, error) {
-    // Implementation details here
-    // For now, just a simple wrapper over the existing HTTP client
-    resp, err := m.HTTPClient.Get(req.Target)
+    if err := m.limit(ctx, "http", req); err != nil {
+        return nil, err
+    }
+    
+    // Service names and service URLs are resolved by the HTTP client
+    resp, err := Execute(ctx, m.Breakers.Get(BreakerKey("http", req.Target)), func(ctx context.Context) (*http.Response, error) {
+        return m.HTTPClient.GetWithContext(ctx, req.Target)
+    }, nil)
     if err != nil {
         return nil, err
     }
@@ -71,8 +84,17 @@ func (m *Microcomms) sendHTTP(ctx context.Context, req MessageRequest) (*Message
 
 // sendGRPC sends a message over gRPC
 func (m *Microcomms) sendGRPC(ctx context.Context, req MessageRequest) (*MessageResponse, error) {
-    // Implementation details here
-    resp, err := m.GRPCClient.CallExample(ctx, req.Target)
+    if err := m.limit(ctx, "grpc", req); err != nil {
+        return nil, err
+    }
+    
+    client, method, err := m.grpcTarget(req.Target)
+    if err != nil {
+        return nil, err
+    }
+    resp, err := Execute(ctx, m.Breakers.Get(BreakerKey("grpc", req.Target)), func(ctx context.Context) (string, error) {
+        return client.CallExample(ctx, method)
+    }, nil)
     if err != nil {
         return nil, err
     }
@@ -83,6 +105,35 @@ func (m *Microcomms) sendGRPC(ctx context.Context, req MessageRequest) (*Message
     }, nil
 }
 
+// grpcTarget returns the client and method of a gRPC target. Service URLs
+// such as "consul://billing/billing.Invoices/Create", and bare names such
+// as "billing/billing.Invoices/Create" when discovery is enabled, are
+// dialed through discovery once per service; method targets such as
+// "/billing.Invoices/Create" use the default client.
+func (m *Microcomms) grpcTarget(target string) (*GRPCClient, string, error) {
+    if strings.HasPrefix(target, "/") || (m.Discovery == nil && !strings.Contains(target, "://")) {
+        return m.GRPCClient, target, nil
+    }
+    s, err := discovery.ParseServiceURL(target)
+    if err != nil {
+        return nil, "", err
+    }
+    key := s.Service
+    if s.Scheme != "" {
+        key = s.Scheme + "://" + s.Service
+    }
+    m.grpcMutex.Lock()
+    defer m.grpcMutex.Unlock()
+    client, ok := m.grpcClients[key]
+    if !ok {
+        if client, err = m.DialService(key); err != nil {
+            return nil, "", err
+        }
+        m.grpcClients[key] = client
+    }
+    return client, s.Rest, nil
+}
+
 // sendMQ sends a message through a message queue
 func (m *Microcomms) sendMQ(ctx context.Context, req MessageRequest) (*MessageResponse, error) {
     // Implementation details here
@@ -90,6 +141,9 @@ func (m *Microcomms) sendMQ(ctx context.Context, req MessageRequest) (*MessageRe
     if !ok {
         return nil, fmt.Errorf("MQ payload must be a string")
     }
+    if err := m.limit(ctx, "mq", req); err != nil {
+        return nil, err
+    }
     
     err := m.MQClient.SendMessage(payload)
     if err != nil {
@@ -118,8 +172,8 @@ func (m *Microcomms) sendWithFallback(ctx context.Context, req MessageRequest) (
 
 // sendAuto selects the best protocol based on the message type
 func (m *Microcomms) sendAuto(ctx context.Context, req MessageRequest) (*MessageResponse, error) {
-    // Simple heuristic: if target contains http/https, use HTTP
-    if len(req.Target) > 4 && (req.Target[:4] == "http" || req.Target[:5] == "https") {
+    // Simple heuristic: http(s) and service URLs such as consul://payments use HTTP
+    if strings.Contains(req.Target, "://") {
         return m.sendHTTP(ctx, req)
     }
     
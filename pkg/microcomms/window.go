@@ -0,0 +1,115 @@
+package microcomms
+
+import (
+    "time"
+)
+
+// windowCounts aggregates the calls recorded in a sliding window
+type windowCounts struct {
+    calls    int
+    failures int
+    slow     int
+}
+
+// add adds or, with a negative sign, removes one call
+func (c *windowCounts) add(failed, slow bool, sign int) {
+    c.calls += sign
+    if failed {
+        c.failures += sign
+    }
+    if slow {
+        c.slow += sign
+    }
+}
+
+// slidingWindow records call outcomes over the recent past
+type slidingWindow interface {
+    record(now time.Time, failed, slow bool)
+    counts(now time.Time) windowCounts
+    reset()
+}
+
+// countWindow keeps the outcomes of the last size calls in a ring buffer
+type countWindow struct {
+    failed []bool
+    slow   []bool
+    next   int
+    filled int
+    total  windowCounts
+}
+
+func newCountWindow(size int) *countWindow {
+    return &countWindow{failed: make([]bool, size), slow: make([]bool, size)}
+}
+
+func (w *countWindow) record(now time.Time, failed, slow bool) {
+    if w.filled == len(w.failed) {
+        w.total.add(w.failed[w.next], w.slow[w.next], -1)
+    } else {
+        w.filled++
+    }
+    w.failed[w.next], w.slow[w.next] = failed, slow
+    w.total.add(failed, slow, 1)
+    w.next = (w.next + 1) % len(w.failed)
+}
+
+func (w *countWindow) counts(now time.Time) windowCounts {
+    return w.total
+}
+
+func (w *countWindow) reset() {
+    w.next, w.filled, w.total = 0, 0, windowCounts{}
+}
+
+// timeBuckets is the number of buckets a time window is split into; calls
+// leave the window one bucket at a time
+const timeBuckets = 10
+
+// timeWindow keeps the outcomes of the calls made within a duration,
+// aggregated into buckets
+type timeWindow struct {
+    width   time.Duration
+    buckets [timeBuckets]windowCounts
+    starts  [timeBuckets]time.Time
+}
+
+func newTimeWindow(duration time.Duration) *timeWindow {
+    width := duration / timeBuckets
+    if width <= 0 {
+        width = 1
+    }
+    return &timeWindow{width: width}
+}
+
+// bucket returns the bucket for now, clearing it if it held older calls
+func (w *timeWindow) bucket(now time.Time) *windowCounts {
+    start := now.Truncate(w.width)
+    i := int(start.UnixNano()/int64(w.width)) % timeBuckets
+    if !w.starts[i].Equal(start) {
+        w.starts[i] = start
+        w.buckets[i] = windowCounts{}
+    }
+    return &w.buckets[i]
+}
+
+func (w *timeWindow) record(now time.Time, failed, slow bool) {
+    w.bucket(now).add(failed, slow, 1)
+}
+
+func (w *timeWindow) counts(now time.Time) windowCounts {
+    oldest := now.Truncate(w.width).Add(-w.width * (timeBuckets - 1))
+    var total windowCounts
+    for i := range w.buckets {
+        if !w.starts[i].Before(oldest) {
+            total.calls += w.buckets[i].calls
+            total.failures += w.buckets[i].failures
+            total.slow += w.buckets[i].slow
+        }
+    }
+    return total
+}
+
+func (w *timeWindow) reset() {
+    w.buckets = [timeBuckets]windowCounts{}
+    w.starts = [timeBuckets]time.Time{}
+}
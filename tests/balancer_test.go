@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/pramithamj/microcomms/internal/discovery"
+)
+
+func balancerInstances(weights ...string) []discovery.Instance {
+	instances := make([]discovery.Instance, len(weights))
+	for i, weight := range weights {
+		instances[i] = discovery.Instance{
+			ID:      string(rune('a' + i)),
+			Service: "payments",
+			Address: "10.0.0.1",
+			Port:    8080 + i,
+		}
+		if weight != "" {
+			instances[i].Meta = map[string]string{discovery.WeightMetaKey: weight}
+		}
+	}
+	return instances
+}
+
+func pickSequence(t *testing.T, b discovery.Balancer, instances []discovery.Instance, n int) string {
+	t.Helper()
+	picked := ""
+	for i := 0; i < n; i++ {
+		instance, done, err := b.Pick(context.Background(), instances)
+		if err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+		done(nil)
+		picked += instance.ID
+	}
+	return picked
+}
+
+func TestBalancer_RoundRobin(t *testing.T) {
+	b, _ := discovery.NewBalancer(discovery.RoundRobin)
+	if got := pickSequence(t, b, balancerInstances("", "", ""), 6); got != "abcabc" {
+		t.Fatalf("Expected abcabc, but got %s", got)
+	}
+}
+
+func TestBalancer_WeightedIsSmooth(t *testing.T) {
+	b, _ := discovery.NewBalancer(discovery.Weighted)
+	// Weights 5:1:1 interleave rather than sending five requests in a row
+	if got := pickSequence(t, b, balancerInstances("5", "1", "1"), 7); got != "aabacaa" {
+		t.Fatalf("Expected aabacaa, but got %s", got)
+	}
+	// Zero-weight instances are skipped while others have weight
+	if got := pickSequence(t, b, balancerInstances("0", "1"), 3); got != "bbb" {
+		t.Fatalf("Expected bbb, but got %s", got)
+	}
+}
+
+func TestBalancer_RandomCoversInstances(t *testing.T) {
+	b, _ := discovery.NewBalancer(discovery.Random)
+	seen := make(map[rune]bool)
+	for _, id := range pickSequence(t, b, balancerInstances("", "", ""), 200) {
+		seen[id] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("Expected every instance to be picked, but got %v", seen)
+	}
+}
+
+func TestBalancer_LeastOutstandingAndP2C(t *testing.T) {
+	for _, strategy := range []discovery.BalancerStrategy{discovery.LeastOutstanding, discovery.PowerOfTwo} {
+		b, _ := discovery.NewBalancer(strategy)
+		instances := balancerInstances("", "")
+		ctx := context.Background()
+
+		// Keep a request in flight on the first picked instance
+		busy, busyDone, _ := b.Pick(ctx, instances)
+		for i := 0; i < 10; i++ {
+			instance, done, _ := b.Pick(ctx, instances)
+			if instance.ID == busy.ID {
+				t.Fatalf("%s: expected the idle instance while %s is busy", strategy, busy.ID)
+			}
+			done(nil)
+		}
+		busyDone(nil)
+		// Calling done twice must not go negative and skew later picks
+		busyDone(nil)
+
+		first, firstDone, _ := b.Pick(ctx, instances)
+		second, secondDone, _ := b.Pick(ctx, instances)
+		if first.ID == second.ID {
+			t.Fatalf("%s: expected requests to spread once both are idle", strategy)
+		}
+		firstDone(nil)
+		secondDone(nil)
+	}
+}
+
+func TestBalancers_PerServiceStrategy(t *testing.T) {
+	if _, err := discovery.NewBalancers(discovery.RoundRobin, map[string]discovery.BalancerStrategy{"x": "fastest"}); err == nil {
+		t.Fatalf("Expected an error for an unknown strategy")
+	}
+
+	balancers, err := discovery.NewBalancers(discovery.RoundRobin, map[string]discovery.BalancerStrategy{
+		"payments": discovery.Weighted,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if balancers.For("payments") != balancers.For("payments") {
+		t.Fatalf("Expected a service to keep its balancer")
+	}
+	if got := pickSequence(t, balancers.For("payments"), balancerInstances("2", "1"), 3); got != "aba" {
+		t.Fatalf("Expected weighted picks aba, but got %s", got)
+	}
+	if got := pickSequence(t, balancers.For("users"), balancerInstances("2", "1"), 3); got != "aba" {
+		t.Fatalf("Expected round-robin picks aba, but got %s", got)
+	}
+	if _, _, err := balancers.Pick(context.Background(), "users", nil); err == nil {
+		t.Fatalf("Expected an error without instances")
+	}
+}
+
+func TestBalancer_ConsistentHashIsStickyAndStable(t *testing.T) {
+	b, err := discovery.NewBalancer(discovery.ConsistentHash)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	instances := balancerInstances("", "", "", "")
+
+	pick := func(instances []discovery.Instance, key string) string {
+		instance, done, err := b.Pick(discovery.WithHashKey(context.Background(), key), instances)
+		if err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+		done(nil)
+		return instance.ID
+	}
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		key := "user-" + strconv.Itoa(i)
+		owners[key] = pick(instances, key)
+		counts[owners[key]]++
+		if again := pick(instances, key); again != owners[key] {
+			t.Fatalf("Expected %s to stick to %s, but got %s", key, owners[key], again)
+		}
+	}
+	for id, count := range counts {
+		if count < 300 || count > 700 {
+			t.Fatalf("Expected keys to spread evenly, but %s got %d of 2000", id, count)
+		}
+	}
+
+	// Removing an instance only moves the keys it owned
+	remaining := append([]discovery.Instance(nil), instances[:1]...)
+	remaining = append(remaining, instances[2:]...)
+	for key, owner := range owners {
+		now := pick(remaining, key)
+		if owner != "b" && now != owner {
+			t.Fatalf("Expected %s to stay on %s, but it moved to %s", key, owner, now)
+		}
+		if now == "b" {
+			t.Fatalf("Expected no keys on the removed instance")
+		}
+	}
+
+	// Without a key requests are spread round-robin
+	if got := pickSequence(t, b, instances, 4); got != "abcd" {
+		t.Fatalf("Expected abcd without a hash key, but got %s", got)
+	}
+}
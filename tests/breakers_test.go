@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/pkg/microcomms"
+)
+
+func TestBreakerKey(t *testing.T) {
+	cases := map[[2]string]string{
+		{"http", "https://api.example.com/v1/charges"}: "http:api.example.com",
+		{"http", "consul://payments/v1/charges"}:       "http:payments",
+		{"http", "payments/v1/charges"}:                "http:payments",
+		{"grpc", "/billing.Invoices/Create"}:           "grpc:/billing.Invoices/Create",
+	}
+	for in, want := range cases {
+		if got := microcomms.BreakerKey(in[0], in[1]); got != want {
+			t.Fatalf("Expected %s for %v, but got %s", want, in, got)
+		}
+	}
+}
+
+func TestCircuitBreakerRegistry_PerTargetTemplates(t *testing.T) {
+	r := microcomms.NewCircuitBreakerRegistry(microcomms.CircuitBreakerRegistryConfig{
+		Templates: map[string]microcomms.CircuitBreakerConfig{
+			"http":                       {FailureThreshold: 2},
+			"http:payments":              {FailureThreshold: 1},
+			"grpc:/billing.Invoices/*":   {FailureThreshold: 3},
+			"grpc:/billing.Invoices/Cr*": {FailureThreshold: 4},
+		},
+		Default: microcomms.CircuitBreakerConfig{FailureThreshold: 7},
+	})
+
+	// A failing service only opens its own breaker
+	payments := r.Get("http:payments")
+	payments.RecordFailure()
+	if payments.State() != microcomms.StateOpen {
+		t.Fatalf("Expected the payments breaker to open after one failure")
+	}
+	if r.Get("http:orders").State() != microcomms.StateClosed {
+		t.Fatalf("Expected the orders breaker to stay closed")
+	}
+	if r.Get("http:payments") != payments {
+		t.Fatalf("Expected the same breaker for the same key")
+	}
+
+	thresholds := map[string]int{
+		"http:orders":                   2, // Kind template
+		"grpc:/billing.Invoices/Delete": 3, // Pattern
+		"grpc:/billing.Invoices/Create": 4, // Longest pattern
+		"mq:events":                     7, // Default
+	}
+	for key, want := range thresholds {
+		cb := r.Get(key)
+		for i := 0; i < want-1; i++ {
+			cb.RecordFailure()
+		}
+		if cb.State() != microcomms.StateClosed {
+			t.Fatalf("Expected %s to stay closed after %d failures", key, want-1)
+		}
+		cb.RecordFailure()
+		if cb.State() != microcomms.StateOpen {
+			t.Fatalf("Expected %s to open after %d failures", key, want)
+		}
+	}
+
+	infos := r.List()
+	if len(infos) != 5 || infos[0].Key != "grpc:/billing.Invoices/Create" {
+		t.Fatalf("Expected 5 breakers sorted by key, but got %+v", infos)
+	}
+	info, ok := r.Inspect("http:payments")
+	if !ok || info.Stats.State != microcomms.StateOpen || info.LastUsed.IsZero() {
+		t.Fatalf("Expected the open payments breaker, but got %+v, %v", info, ok)
+	}
+	if _, ok := r.Inspect("http:unknown"); ok {
+		t.Fatalf("Expected Inspect not to create breakers")
+	}
+}
+
+func TestCircuitBreakerRegistry_EvictsIdleClosedBreakers(t *testing.T) {
+	r := microcomms.NewCircuitBreakerRegistry(microcomms.CircuitBreakerRegistryConfig{
+		Default:     microcomms.CircuitBreakerConfig{FailureThreshold: 1, ResetTimeout: time.Minute},
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	r.Get("http:idle")
+	r.Get("http:broken").RecordFailure()
+
+	time.Sleep(80 * time.Millisecond)
+	r.Get("http:active")
+
+	if _, ok := r.Inspect("http:idle"); ok {
+		t.Fatalf("Expected the idle breaker to be evicted")
+	}
+	if info, ok := r.Inspect("http:broken"); !ok || info.Stats.State != microcomms.StateOpen {
+		t.Fatalf("Expected the open breaker to be kept, but got %+v, %v", info, ok)
+	}
+}
@@ -0,0 +1,193 @@
+package tests
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/pkg/microcomms"
+)
+
+func newSharedRegistry(t *testing.T, ctx context.Context, backend microcomms.BreakerStateBackend, replica string) *microcomms.CircuitBreakerRegistry {
+	t.Helper()
+	r := microcomms.NewCircuitBreakerRegistry(microcomms.CircuitBreakerRegistryConfig{
+		Default: microcomms.CircuitBreakerConfig{FailureThreshold: 1, ResetTimeout: 50 * time.Millisecond},
+	})
+	if err := r.Share(ctx, microcomms.BreakerSharingConfig{Backend: backend, ReplicaID: replica}); err != nil {
+		t.Fatalf("Failed to share breaker state: %v", err)
+	}
+	return r
+}
+
+func waitForState(t *testing.T, cb *microcomms.CircuitBreaker, want microcomms.CircuitBreakerState) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for cb.State() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to be %s, but it is %s", cb.Name(), want, cb.State())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBreakerSharing_TripsAndRecoveriesPropagate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := microcomms.NewMemoryBreakerBackend()
+	a := newSharedRegistry(t, ctx, backend, "a")
+	b := newSharedRegistry(t, ctx, backend, "b")
+
+	// A trip on one replica opens the breaker on the other, creating it
+	a.Get("http:payments").RecordFailure()
+	remote := b.Get("http:payments")
+	waitForState(t, remote, microcomms.StateOpen)
+	if b.Get("http:orders").State() != microcomms.StateClosed {
+		t.Fatalf("Expected other breakers to stay closed")
+	}
+
+	// A recovery only moves the remote breaker to half-open
+	time.Sleep(60 * time.Millisecond)
+	local := a.Get("http:payments")
+	if err := local.Execute(func() error { return nil }); err != nil {
+		t.Fatalf("Expected the probe to be admitted, but got %v", err)
+	}
+	if local.State() != microcomms.StateClosed {
+		t.Fatalf("Expected the local breaker to close after the probe")
+	}
+	waitForState(t, remote, microcomms.StateHalfOpen)
+	if err := remote.Execute(func() error { return nil }); err != nil {
+		t.Fatalf("Expected the remote probe to be admitted, but got %v", err)
+	}
+	waitForState(t, remote, microcomms.StateClosed)
+}
+
+func TestBreakerSharing_OverrideIgnoresRemoteEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := microcomms.NewMemoryBreakerBackend()
+	a := newSharedRegistry(t, ctx, backend, "a")
+	b := newSharedRegistry(t, ctx, backend, "b")
+
+	pinned := b.Get("http:payments")
+	pinned.Override(microcomms.StateClosed)
+	a.Get("http:payments").RecordFailure()
+	time.Sleep(20 * time.Millisecond)
+	if pinned.State() != microcomms.StateClosed {
+		t.Fatalf("Expected the pinned breaker to ignore the remote trip")
+	}
+	pinned.RecordFailure()
+	if pinned.State() != microcomms.StateClosed {
+		t.Fatalf("Expected the pinned breaker to ignore local failures")
+	}
+
+	// Pinning open is local: the other replica keeps its own state
+	orders := b.Get("http:orders")
+	orders.Override(microcomms.StateOpen)
+	if err := orders.Execute(func() error { return nil }); err == nil {
+		t.Fatalf("Expected the breaker pinned open to reject calls")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if info, ok := a.Inspect("http:orders"); ok {
+		t.Fatalf("Expected the override not to be shared, but got %+v", info)
+	}
+
+	orders.ClearOverride()
+	time.Sleep(60 * time.Millisecond)
+	if err := orders.Execute(func() error { return nil }); err != nil {
+		t.Fatalf("Expected a probe after the override was cleared, but got %v", err)
+	}
+	if orders.State() != microcomms.StateClosed {
+		t.Fatalf("Expected the breaker to close after the probe")
+	}
+}
+
+func TestBreakerSharing_IgnoresOwnAndStaleEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := microcomms.NewMemoryBreakerBackend()
+	r := newSharedRegistry(t, ctx, backend, "a")
+
+	// Stored events older than the maximum age do not open breakers
+	backend.Publish(ctx, microcomms.BreakerEvent{Key: "http:old", Open: true, Origin: "b", Time: time.Now().Add(-time.Hour)})
+	if _, ok := r.Inspect("http:old"); ok {
+		t.Fatalf("Expected the stale event to be ignored")
+	}
+
+	// Events published by the replica itself are not applied again
+	backend.Publish(ctx, microcomms.BreakerEvent{Key: "http:self", Open: true, Origin: "a", Time: time.Now()})
+	if _, ok := r.Inspect("http:self"); ok {
+		t.Fatalf("Expected the replica's own event to be ignored")
+	}
+
+	// An event older than the breaker's last transition loses to local state
+	cb := r.Get("http:payments")
+	cb.RecordFailure()
+	time.Sleep(60 * time.Millisecond)
+	cb.Execute(func() error { return nil })
+	backend.Publish(ctx, microcomms.BreakerEvent{Key: "http:payments", Open: true, Origin: "b", Time: time.Now().Add(-time.Second)})
+	if cb.State() != microcomms.StateClosed {
+		t.Fatalf("Expected the newer local recovery to win, but got %s", cb.State())
+	}
+}
+
+// recordingBackend records published events, publishing trips slowly
+type recordingBackend struct {
+	microcomms.BreakerStateBackend
+	mutex  sync.Mutex
+	events []microcomms.BreakerEvent
+}
+
+func (b *recordingBackend) Publish(ctx context.Context, event microcomms.BreakerEvent) error {
+	if event.Open {
+		time.Sleep(50 * time.Millisecond)
+	}
+	b.mutex.Lock()
+	b.events = append(b.events, event)
+	b.mutex.Unlock()
+	return b.BreakerStateBackend.Publish(ctx, event)
+}
+
+func TestBreakerSharing_PublishesTransitionsInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := &recordingBackend{BreakerStateBackend: microcomms.NewMemoryBreakerBackend()}
+	r := microcomms.NewCircuitBreakerRegistry(microcomms.CircuitBreakerRegistryConfig{
+		Default: microcomms.CircuitBreakerConfig{FailureThreshold: 1, ResetTimeout: 10 * time.Millisecond},
+	})
+	if err := r.Share(ctx, microcomms.BreakerSharingConfig{Backend: backend, ReplicaID: "a"}); err != nil {
+		t.Fatalf("Failed to share breaker state: %v", err)
+	}
+
+	// A trip followed quickly by a recovery
+	cb := r.Get("http:payments")
+	tripped := time.Now()
+	cb.RecordFailure()
+	time.Sleep(20 * time.Millisecond)
+	if err := cb.Execute(func() error { return nil }); err != nil {
+		t.Fatalf("Expected the probe to be admitted, but got %v", err)
+	}
+	if cb.State() != microcomms.StateClosed {
+		t.Fatalf("Expected the breaker to close after the probe")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		backend.mutex.Lock()
+		events := append([]microcomms.BreakerEvent(nil), backend.events...)
+		backend.mutex.Unlock()
+		if len(events) == 2 {
+			if !events[0].Open || events[1].Open {
+				t.Fatalf("Expected the trip to be published before the recovery, but got %+v", events)
+			}
+			if events[0].Time.Before(tripped) || events[0].Time.Sub(tripped) > 10*time.Millisecond {
+				t.Fatalf("Expected the trip to carry its transition time, but got %v for a trip at %v", events[0].Time, tripped)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 published events, but got %+v", events)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
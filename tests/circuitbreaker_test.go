@@ -0,0 +1,495 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/pkg/microcomms"
+)
+
+var errCall = errors.New("call failed")
+
+func TestCircuitBreaker_CountWindowFailureRate(t *testing.T) {
+	cb := microcomms.NewCircuitBreakerWithConfig(microcomms.CircuitBreakerConfig{
+		Name:                 "payments",
+		WindowType:           microcomms.WindowCount,
+		WindowSize:           10,
+		FailureRateThreshold: 50,
+		MinimumRequests:      10,
+		ResetTimeout:         time.Minute,
+	})
+
+	// Four failures are below the minimum volume
+	for i := 0; i < 4; i++ {
+		cb.RecordFailure()
+	}
+	if cb.State() != microcomms.StateClosed {
+		t.Fatalf("Expected the breaker to stay closed below the minimum volume")
+	}
+
+	// Successes push old failures out of the window, unlike a counter that
+	// only resets on success
+	for i := 0; i < 10; i++ {
+		cb.RecordSuccess()
+	}
+	if stats := cb.Stats(); stats.Calls != 10 || stats.Failures != 0 {
+		t.Fatalf("Expected 10 calls without failures in the window, but got %+v", stats)
+	}
+
+	// Interleaved failures still open the breaker once the rate is reached
+	for i := 0; i < 5; i++ {
+		cb.RecordSuccess()
+		cb.RecordFailure()
+	}
+	if cb.State() != microcomms.StateOpen {
+		t.Fatalf("Expected the breaker to open at a 50%% failure rate, but got %+v", cb.Stats())
+	}
+	if err := cb.Execute(func() error { return nil }); err == nil {
+		t.Fatalf("Expected an open breaker to reject calls")
+	}
+}
+
+func TestCircuitBreaker_TimeWindowExpires(t *testing.T) {
+	cb := microcomms.NewCircuitBreakerWithConfig(microcomms.CircuitBreakerConfig{
+		WindowType:           microcomms.WindowTime,
+		WindowDuration:       200 * time.Millisecond,
+		FailureRateThreshold: 50,
+		MinimumRequests:      4,
+	})
+
+	for i := 0; i < 3; i++ {
+		cb.RecordFailure()
+	}
+	if stats := cb.Stats(); stats.Calls != 3 || stats.FailureRate != 100 {
+		t.Fatalf("Expected 3 failed calls in the window, but got %+v", stats)
+	}
+
+	// The failures age out, so a later failure alone does not open it
+	time.Sleep(300 * time.Millisecond)
+	if stats := cb.Stats(); stats.Calls != 0 {
+		t.Fatalf("Expected an empty window, but got %+v", stats)
+	}
+	cb.RecordFailure()
+	if cb.State() != microcomms.StateClosed {
+		t.Fatalf("Expected expired failures not to count")
+	}
+}
+
+func TestCircuitBreaker_SlowCallRate(t *testing.T) {
+	cb := microcomms.NewCircuitBreakerWithConfig(microcomms.CircuitBreakerConfig{
+		WindowType:            microcomms.WindowCount,
+		WindowSize:            4,
+		MinimumRequests:       4,
+		SlowCallThreshold:     10 * time.Millisecond,
+		SlowCallRateThreshold: 50,
+	})
+
+	cb.RecordResult(nil, time.Millisecond)
+	cb.RecordResult(nil, time.Millisecond)
+	cb.RecordResult(nil, 50*time.Millisecond)
+	if cb.State() != microcomms.StateClosed {
+		t.Fatalf("Expected the breaker to stay closed below the minimum volume")
+	}
+	if err := cb.Execute(func() error {
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if cb.State() != microcomms.StateOpen {
+		t.Fatalf("Expected successful but slow calls to open the breaker, but got %+v", cb.Stats())
+	}
+}
+
+func TestCircuitBreaker_ConsecutiveDefault(t *testing.T) {
+	cb := microcomms.NewCircuitBreaker("legacy", 3, 50*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		cb.Execute(func() error { return errCall })
+	}
+	if cb.State() != microcomms.StateOpen {
+		t.Fatalf("Expected the breaker to open after 3 failures")
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	if err := cb.Execute(func() error { return nil }); err != nil {
+		t.Fatalf("Expected the probe to pass, but got: %v", err)
+	}
+	if cb.State() != microcomms.StateClosed {
+		t.Fatalf("Expected a successful probe to close the breaker")
+	}
+}
+
+// openBreaker returns a breaker that has just opened
+func openBreaker(t *testing.T, probes int, resetTimeout time.Duration) *microcomms.CircuitBreaker {
+	t.Helper()
+	cb := microcomms.NewCircuitBreakerWithConfig(microcomms.CircuitBreakerConfig{
+		Name:             "inventory",
+		FailureThreshold: 1,
+		ResetTimeout:     resetTimeout,
+		HalfOpenProbes:   probes,
+	})
+	cb.Execute(func() error { return errCall })
+	if cb.State() != microcomms.StateOpen {
+		t.Fatalf("Expected the breaker to be open")
+	}
+	return cb
+}
+
+func TestCircuitBreaker_HalfOpenAdmitsLimitedProbes(t *testing.T) {
+	const probes = 3
+	cb := openBreaker(t, probes, 20*time.Millisecond)
+	if err := cb.Execute(func() error { return nil }); !errors.Is(err, microcomms.ErrCircuitBreakerOpen) {
+		t.Fatalf("Expected ErrCircuitBreakerOpen, but got: %v", err)
+	}
+	time.Sleep(40 * time.Millisecond)
+
+	release := make(chan struct{})
+	var admitted, rejected int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := cb.Execute(func() error {
+				atomic.AddInt64(&admitted, 1)
+				<-release
+				return nil
+			})
+			if errors.Is(err, microcomms.ErrCircuitBreakerOpen) {
+				atomic.AddInt64(&rejected, 1)
+			}
+		}()
+	}
+	// Every goroutine either blocks in a probe or has been rejected
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&admitted)+atomic.LoadInt64(&rejected) < 100 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the calls")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if admitted != probes || rejected != 100-probes {
+		t.Fatalf("Expected %d probes and %d rejections, but got %d and %d", probes, 100-probes, admitted, rejected)
+	}
+	if cb.State() != microcomms.StateHalfOpen {
+		t.Fatalf("Expected the breaker to be half-open while probing")
+	}
+
+	close(release)
+	wg.Wait()
+	if cb.State() != microcomms.StateClosed {
+		t.Fatalf("Expected the breaker to close after all probes succeeded")
+	}
+}
+
+func TestCircuitBreaker_FailedProbeReopens(t *testing.T) {
+	cb := openBreaker(t, 2, 20*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+
+	if err := cb.Execute(func() error { return nil }); err != nil {
+		t.Fatalf("Expected the first probe to pass, but got: %v", err)
+	}
+	if cb.State() != microcomms.StateHalfOpen {
+		t.Fatalf("Expected the breaker to stay half-open until every probe succeeded")
+	}
+	cb.Execute(func() error { return errCall })
+	if cb.State() != microcomms.StateOpen {
+		t.Fatalf("Expected a failed probe to reopen the breaker")
+	}
+}
+
+func TestCircuitBreaker_IgnoresOutcomesFromEarlierState(t *testing.T) {
+	cb := microcomms.NewCircuitBreakerWithConfig(microcomms.CircuitBreakerConfig{
+		FailureThreshold: 2,
+		ResetTimeout:     20 * time.Millisecond,
+	})
+
+	// A call admitted while closed finishes after the breaker has opened and
+	// moved to half-open; its success must not count as a probe
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cb.Execute(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	cb.Execute(func() error { return errCall })
+	cb.Execute(func() error { return errCall })
+	time.Sleep(40 * time.Millisecond)
+	if !cb.AllowRequest() || cb.State() != microcomms.StateHalfOpen {
+		t.Fatalf("Expected the breaker to admit a probe")
+	}
+
+	close(release)
+	<-done
+	if cb.State() != microcomms.StateHalfOpen {
+		t.Fatalf("Expected the stale success to be ignored, but the breaker is %v", cb.State())
+	}
+}
+
+func TestCircuitBreaker_ConcurrentProbeCycles(t *testing.T) {
+	const probes = 2
+	cb := openBreaker(t, probes, 5*time.Millisecond)
+
+	for cycle := 0; cycle < 50; cycle++ {
+		time.Sleep(10 * time.Millisecond)
+
+		start := make(chan struct{})
+		var admitted int64
+		var wg sync.WaitGroup
+		for g := 0; g < 32; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				if cb.AllowRequest() {
+					atomic.AddInt64(&admitted, 1)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+		if admitted != probes {
+			t.Fatalf("Cycle %d: expected %d probes, but got %d", cycle, probes, admitted)
+		}
+		cb.RecordFailure()
+		if cb.State() != microcomms.StateOpen {
+			t.Fatalf("Cycle %d: expected the failed probe to reopen the breaker", cycle)
+		}
+	}
+}
+
+func TestCircuitBreaker_ConcurrentStress(t *testing.T) {
+	cb := microcomms.NewCircuitBreakerWithConfig(microcomms.CircuitBreakerConfig{
+		WindowType:      microcomms.WindowCount,
+		WindowSize:      20,
+		MinimumRequests: 5,
+		ResetTimeout:    time.Millisecond,
+		HalfOpenProbes:  3,
+	})
+
+	// Mixed outcomes keep the breaker cycling through every state while the
+	// race detector watches
+	var calls, rejected int64
+	var wg sync.WaitGroup
+	for g := 0; g < 50; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				err := cb.Execute(func() error {
+					atomic.AddInt64(&calls, 1)
+					if (g+i)%3 != 0 {
+						return errCall
+					}
+					return nil
+				})
+				if errors.Is(err, microcomms.ErrCircuitBreakerOpen) {
+					atomic.AddInt64(&rejected, 1)
+				}
+				cb.Stats()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if calls+rejected != 50*200 {
+		t.Fatalf("Expected every call to run or be rejected, but got %d calls and %d rejections", calls, rejected)
+	}
+	if calls == 0 || rejected == 0 {
+		t.Fatalf("Expected the breaker to both admit and reject calls, but got %d and %d", calls, rejected)
+	}
+}
+
+func TestCircuitBreaker_OpenErrorAndStateChanges(t *testing.T) {
+	var mutex sync.Mutex
+	var changes []string
+	cb := microcomms.NewCircuitBreakerWithConfig(microcomms.CircuitBreakerConfig{
+		Name:             "payments",
+		FailureThreshold: 1,
+		ResetTimeout:     20 * time.Millisecond,
+		OnStateChange: func(name string, from, to microcomms.CircuitBreakerState) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			changes = append(changes, name+":"+from.String()+"->"+to.String())
+		},
+	})
+	alerts := 0
+	cb.OnStateChange(func(name string, from, to microcomms.CircuitBreakerState) {
+		// Callbacks run outside the lock, so they may use the breaker
+		if to == microcomms.StateOpen && cb.State() == microcomms.StateOpen {
+			alerts++
+		}
+	})
+
+	cb.Execute(func() error { return errCall })
+	err := cb.Execute(func() error { return nil })
+	var openErr *microcomms.CircuitBreakerOpenError
+	if !errors.As(err, &openErr) || openErr.Name != "payments" || !errors.Is(err, microcomms.ErrCircuitBreakerOpen) {
+		t.Fatalf("Expected a CircuitBreakerOpenError for payments, but got: %v", err)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	cb.Execute(func() error { return nil })
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []string{"payments:closed->open", "payments:open->half-open", "payments:half-open->closed"}
+	if len(changes) != len(want) {
+		t.Fatalf("Expected %v, but got %v", want, changes)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Fatalf("Expected %v, but got %v", want, changes)
+		}
+	}
+	if alerts != 1 {
+		t.Fatalf("Expected one alert, but got %d", alerts)
+	}
+}
+
+func TestCircuitBreaker_FailureClassification(t *testing.T) {
+	cb := microcomms.NewCircuitBreaker("orders", 2, time.Minute)
+
+	// Cancellation and invalid requests say nothing about the target
+	cb.Execute(func() error { return context.Canceled })
+	cb.Execute(func() error { return microcomms.NewServiceError("orders", 400, "invalid order", nil) })
+	cb.Execute(func() error { return context.Canceled })
+	if cb.State() != microcomms.StateClosed {
+		t.Fatalf("Expected ignored errors not to open the breaker")
+	}
+
+	cb.Execute(func() error { return microcomms.NewServiceError("orders", 503, "unavailable", nil) })
+	cb.Execute(func() error { return context.DeadlineExceeded })
+	if cb.State() != microcomms.StateOpen {
+		t.Fatalf("Expected 5xx and timeouts to count as failures")
+	}
+
+	// A custom classifier replaces the default
+	custom := microcomms.NewCircuitBreakerWithConfig(microcomms.CircuitBreakerConfig{
+		FailureThreshold: 1,
+		IsFailure:        func(err error) bool { return !errors.Is(err, errCall) },
+	})
+	custom.Execute(func() error { return errCall })
+	if custom.State() != microcomms.StateClosed {
+		t.Fatalf("Expected the classifier to exclude errCall")
+	}
+}
+
+func TestCircuitBreaker_CancelledProbeFreesSlot(t *testing.T) {
+	cb := openBreaker(t, 1, 20*time.Millisecond)
+	time.Sleep(40 * time.Millisecond)
+
+	cb.Execute(func() error { return context.Canceled })
+	if cb.State() != microcomms.StateHalfOpen {
+		t.Fatalf("Expected a cancelled probe to leave the breaker half-open")
+	}
+	if err := cb.Execute(func() error { return nil }); err != nil {
+		t.Fatalf("Expected another probe to be admitted, but got: %v", err)
+	}
+	if cb.State() != microcomms.StateClosed {
+		t.Fatalf("Expected the breaker to close")
+	}
+}
+
+func TestExecute_ResultsAndFallback(t *testing.T) {
+	cb := microcomms.NewCircuitBreaker("prices", 2, time.Minute)
+	ctx := context.Background()
+	cached := func(ctx context.Context, err error) (int, error) { return 42, nil }
+
+	price, err := microcomms.Execute(ctx, cb, func(ctx context.Context) (int, error) { return 7, nil }, cached)
+	if err != nil || price != 7 {
+		t.Fatalf("Expected 7, but got %d, %v", price, err)
+	}
+
+	// A failure uses the fallback; an invalid request does not
+	price, err = microcomms.Execute(ctx, cb, func(ctx context.Context) (int, error) { return 0, errCall }, cached)
+	if err != nil || price != 42 {
+		t.Fatalf("Expected the fallback value, but got %d, %v", price, err)
+	}
+	invalid := microcomms.NewServiceError("prices", 422, "bad currency", nil)
+	if _, err := microcomms.Execute(ctx, cb, func(ctx context.Context) (int, error) { return 0, invalid }, cached); err != invalid {
+		t.Fatalf("Expected the invalid request error, but got: %v", err)
+	}
+
+	// The invalid request counted as a success, so two more failures open it
+	for i := 0; i < 2; i++ {
+		microcomms.Execute(ctx, cb, func(ctx context.Context) (int, error) { return 0, errCall }, nil)
+	}
+
+	// Once open, calls go straight to the fallback with the open error
+	called := false
+	_, err = microcomms.Execute(ctx, cb, func(ctx context.Context) (int, error) {
+		called = true
+		return 0, nil
+	}, func(ctx context.Context, err error) (int, error) {
+		return 0, err
+	})
+	if called || !errors.Is(err, microcomms.ErrCircuitBreakerOpen) {
+		t.Fatalf("Expected the fallback to receive the open error, but got called=%v, %v", called, err)
+	}
+}
+
+func TestExecute_RespectsContext(t *testing.T) {
+	cb := microcomms.NewCircuitBreaker("search", 1, time.Minute)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := microcomms.Execute(cancelled, cb, func(ctx context.Context) (string, error) {
+		t.Fatalf("Expected fn not to be called with a done context")
+		return "", nil
+	}, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, but got: %v", err)
+	}
+
+	// fn sees the deadline through its context, and no fallback is used
+	// once the caller has given up
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err := microcomms.Execute(ctx, microcomms.NewCircuitBreaker("slow", 1, time.Minute), func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}, func(ctx context.Context, err error) (string, error) {
+		return "fallback", nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the deadline error, but got: %v", err)
+	}
+
+	// A call cancelled by its caller is not a failure of the target
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	microcomms.Execute(cancelCtx, cb, func(ctx context.Context) (string, error) {
+		cancel()
+		<-ctx.Done()
+		return "", ctx.Err()
+	}, nil)
+	time.Sleep(10 * time.Millisecond)
+	if cb.State() != microcomms.StateClosed {
+		t.Fatalf("Expected cancellation not to open the breaker")
+	}
+}
+
+func TestExecute_PanicReachesCaller(t *testing.T) {
+	cb := microcomms.NewCircuitBreaker("search", 1, time.Minute)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("Expected the panic to reach the caller")
+			}
+		}()
+		microcomms.Execute(context.Background(), cb, func(ctx context.Context) (string, error) {
+			panic("boom")
+		}, nil)
+	}()
+	if cb.State() != microcomms.StateOpen {
+		t.Fatalf("Expected the panic to be recorded as a failure")
+	}
+}
@@ -0,0 +1,481 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pramithamj/microcomms/internal/discovery"
+	"github.com/pramithamj/microcomms/pkg/microcomms"
+)
+
+// fakeConsul serves /v1/health/service/<name> with blocking query support
+type fakeConsul struct {
+	mutex    sync.Mutex
+	index    uint64
+	entries  map[string][]*api.ServiceEntry
+	changed  chan struct{}
+	nonBlock int // Queries without a wait index
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 1, entries: make(map[string][]*api.ServiceEntry), changed: make(chan struct{})}
+}
+
+func (f *fakeConsul) set(service string, ports ...int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var entries []*api.ServiceEntry
+	for _, port := range ports {
+		entries = append(entries, &api.ServiceEntry{
+			Node:    &api.Node{Address: "10.0.0.1"},
+			Service: &api.AgentService{ID: service + "-" + strconv.Itoa(port), Service: service, Port: port},
+		})
+	}
+	f.entries[service] = entries
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	service := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+
+	f.mutex.Lock()
+	if wait == 0 {
+		f.nonBlock++
+	}
+	for wait != 0 && wait >= f.index {
+		changed := f.changed
+		f.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		f.mutex.Lock()
+	}
+	entries := f.entries[service]
+	index := f.index
+	f.mutex.Unlock()
+
+	if entries == nil {
+		entries = []*api.ServiceEntry{}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func receiveInstances(t *testing.T, ch <-chan []discovery.Instance) []discovery.Instance {
+	t.Helper()
+	select {
+	case instances, ok := <-ch:
+		if !ok {
+			t.Fatalf("Expected instances, but the channel was closed")
+		}
+		return instances
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for instances")
+	}
+	return nil
+}
+
+func TestConsulDiscovery_WatchPushesChanges(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set("payments", 8081, 8082)
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	d, err := discovery.NewConsulDiscovery(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer d.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	instances, err := d.Resolve(ctx, "payments")
+	if err != nil || len(instances) != 2 {
+		t.Fatalf("Expected 2 instances, but got %+v, %v", instances, err)
+	}
+
+	updates, err := d.Watch(ctx, "payments")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if instances := receiveInstances(t, updates); len(instances) != 2 {
+		t.Fatalf("Expected current instances first, but got %+v", instances)
+	}
+
+	// A removal reaches subscribers and the cache without waiting for expiry
+	consul.set("payments", 8082)
+	instances = receiveInstances(t, updates)
+	if len(instances) != 1 || instances[0].HostPort() != "10.0.0.1:8082" {
+		t.Fatalf("Expected only 8082 after removal, but got %+v", instances)
+	}
+	if instances, _ := d.Resolve(ctx, "payments"); len(instances) != 1 {
+		t.Fatalf("Expected the cache to be updated, but got %+v", instances)
+	}
+
+	consul.mutex.Lock()
+	nonBlock := consul.nonBlock
+	consul.mutex.Unlock()
+	if nonBlock != 1 {
+		t.Fatalf("Expected a single non-blocking query, but got %d", nonBlock)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-updates:
+		if ok {
+			// Drain an update that raced the cancellation
+			if _, ok := <-updates; ok {
+				t.Fatalf("Expected the channel to be closed after cancel")
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the channel to be closed after cancel")
+	}
+}
+
+// flakyResolver fails with err while it is set
+type flakyResolver struct {
+	mutex     sync.Mutex
+	instances []discovery.Instance
+	err       error
+}
+
+func (f *flakyResolver) set(instances []discovery.Instance, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.instances, f.err = instances, err
+}
+
+func (f *flakyResolver) Resolve(ctx context.Context, service string) ([]discovery.Instance, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	if len(f.instances) == 0 {
+		return nil, &discovery.NoInstancesError{Service: service}
+	}
+	return f.instances, nil
+}
+
+func TestStaleResolver_ServesLastKnownForBoundedPeriod(t *testing.T) {
+	inner := &flakyResolver{}
+	inner.set([]discovery.Instance{{ID: "p1", Service: "payments", Address: "10.0.0.1", Port: 8081}}, nil)
+	snapshot := filepath.Join(t.TempDir(), "discovery.json")
+
+	r, err := discovery.NewStaleResolver(inner, discovery.StaleConfig{MaxStale: 300 * time.Millisecond, SnapshotPath: snapshot})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	ctx := context.Background()
+	if _, err := r.Resolve(ctx, "payments"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if stale, _ := r.Stale("payments"); stale {
+		t.Fatalf("Expected fresh instances")
+	}
+
+	inner.set(nil, errors.New("connection refused"))
+	instances, err := r.Resolve(ctx, "payments")
+	if err != nil || len(instances) != 1 || instances[0].ID != "p1" {
+		t.Fatalf("Expected last-known instances, but got %+v, %v", instances, err)
+	}
+	if stale, _ := r.Stale("payments"); !stale {
+		t.Fatalf("Expected the answer to be flagged stale")
+	}
+
+	// A cold start while the registry is down uses the snapshot
+	cold, err := discovery.NewStaleResolver(inner, discovery.StaleConfig{MaxStale: 300 * time.Millisecond, SnapshotPath: snapshot})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if instances, err := cold.Resolve(ctx, "payments"); err != nil || instances[0].ID != "p1" {
+		t.Fatalf("Expected instances from the snapshot, but got %+v, %v", instances, err)
+	}
+
+	// Stale instances are only served for MaxStale
+	time.Sleep(400 * time.Millisecond)
+	if _, err := r.Resolve(ctx, "payments"); err == nil {
+		t.Fatalf("Expected an error once the instances are too old")
+	}
+
+	// An empty answer from a reachable registry is not papered over
+	inner.set(nil, nil)
+	var noInstances *discovery.NoInstancesError
+	if _, err := cold.Resolve(ctx, "payments"); !errors.As(err, &noInstances) {
+		t.Fatalf("Expected NoInstancesError, but got: %v", err)
+	}
+}
+
+// flakyQueryResolver is a flakyResolver that evaluates queries itself
+type flakyQueryResolver struct {
+	flakyResolver
+}
+
+func (f *flakyQueryResolver) ResolveQuery(ctx context.Context, q discovery.Query) ([]discovery.Instance, error) {
+	instances, err := f.Resolve(ctx, q.Service)
+	if err != nil {
+		return nil, err
+	}
+	return discovery.FilterInstances(instances, q)
+}
+
+func TestStaleResolver_RemembersQueryLookups(t *testing.T) {
+	instances := []discovery.Instance{
+		{ID: "p1", Service: "payments", Address: "10.0.0.1", Port: 8081, Tags: []string{"canary"}},
+		{ID: "p2", Service: "payments", Address: "10.0.0.2", Port: 8081},
+	}
+	canary := discovery.Query{Service: "payments", Tags: []string{"canary"}}
+	for name, inner := range map[string]interface {
+		discovery.Resolver
+		set([]discovery.Instance, error)
+	}{
+		"resolver":       &flakyResolver{},
+		"query resolver": &flakyQueryResolver{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			inner.set(instances, nil)
+			snapshot := filepath.Join(t.TempDir(), "discovery.json")
+			r, err := discovery.NewStaleResolver(inner, discovery.StaleConfig{MaxStale: time.Minute, SnapshotPath: snapshot})
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			ctx := context.Background()
+			if found, err := r.ResolveQuery(ctx, canary); err != nil || len(found) != 1 {
+				t.Fatalf("Expected the canary instance, but got %+v, %v", found, err)
+			}
+
+			inner.set(nil, errors.New("connection refused"))
+			found, err := r.ResolveQuery(ctx, canary)
+			if err != nil || len(found) != 1 || found[0].ID != "p1" {
+				t.Fatalf("Expected the last-known canary instance, but got %+v, %v", found, err)
+			}
+			if stale, _ := r.Stale("payments"); !stale {
+				t.Fatalf("Expected the answer to be flagged stale")
+			}
+
+			// The snapshot holds the query's answer too
+			cold, err := discovery.NewStaleResolver(inner, discovery.StaleConfig{MaxStale: time.Minute, SnapshotPath: snapshot})
+			if err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			if found, err := cold.ResolveQuery(ctx, canary); err != nil || len(found) != 1 || found[0].ID != "p1" {
+				t.Fatalf("Expected the canary instance from the snapshot, but got %+v, %v", found, err)
+			}
+		})
+	}
+}
+
+func TestStaleResolver_ConsulUnreachable(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set("payments", 8081)
+	server := httptest.NewServer(consul)
+
+	d, err := discovery.NewConsulDiscovery(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer d.Close()
+	r, err := discovery.NewStaleResolver(d, discovery.StaleConfig{MaxStale: time.Minute})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	ctx := context.Background()
+	if _, err := r.Resolve(ctx, "payments"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	server.CloseClientConnections()
+	server.Close()
+
+	// Once the watch notices Consul is gone, the discovery itself fails but
+	// the stale resolver keeps answering
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := d.Resolve(ctx, "payments"); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected Consul discovery to fail while Consul is down")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	instances, err := r.Resolve(ctx, "payments")
+	if err != nil || len(instances) != 1 {
+		t.Fatalf("Expected last-known instances, but got %+v, %v", instances, err)
+	}
+	if stale, age := r.Stale("payments"); !stale || age <= 0 {
+		t.Fatalf("Expected stale flag with age, but got %v %v", stale, age)
+	}
+}
+
+func TestConsulDiscovery_ResolveHonorsContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	d, err := discovery.NewConsulDiscovery(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer d.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := d.Resolve(ctx, "payments"); err == nil {
+		t.Fatalf("Expected an error when ctx is done before Consul answers")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected Resolve to return with ctx, but it took %v", elapsed)
+	}
+}
+
+func TestConsulDiscovery_FailedLookupsDoNotLeakGoroutines(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	d, err := discovery.NewConsulDiscovery(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer d.Close()
+
+	d.Resolve(context.Background(), "payments")
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		if _, err := d.Resolve(context.Background(), "payments"); err == nil {
+			t.Fatalf("Expected lookups to fail while Consul is down")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before+10 {
+		t.Fatalf("Expected failed watches to exit, but goroutines grew from %d to %d", before, after)
+	}
+}
+
+func TestConsulDiscovery_StopsIdleWatches(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set("payments", 8081)
+	var blocking int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "" {
+			atomic.AddInt64(&blocking, 1)
+			defer atomic.AddInt64(&blocking, -1)
+		}
+		consul.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	d, err := discovery.NewConsulDiscovery(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer d.Close()
+	d.SetWatchIdleTimeout(100 * time.Millisecond)
+
+	// Every tag combination is a watch of its own
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		q := discovery.Query{Service: "payments", Tags: []string{strconv.Itoa(i)}}
+		if _, err := d.ResolveQuery(ctx, q); err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+	}
+	updates, err := d.Watch(ctx, "payments")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	receiveInstances(t, updates)
+	waitForBlocking := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt64(&blocking) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d blocking queries, but got %d", want, atomic.LoadInt64(&blocking))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForBlocking(11)
+
+	// A later lookup stops the idle watches; the subscribed one stays
+	time.Sleep(150 * time.Millisecond)
+	if _, err := d.Resolve(ctx, "payments"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	waitForBlocking(1)
+
+	// A stopped watch is started again by the next lookup
+	if _, err := d.ResolveQuery(ctx, discovery.Query{Service: "payments", Tags: []string{"0"}}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	waitForBlocking(2)
+}
+
+func TestMicrocomms_CloseClosesDefaultDiscovery(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set("payments", 8081)
+	var blocking int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "" {
+			atomic.AddInt64(&blocking, 1)
+			defer atomic.AddInt64(&blocking, -1)
+		}
+		consul.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	defer server.CloseClientConnections()
+
+	// The default config wraps Consul in a stale cache
+	cfg := microcomms.DefaultConfig()
+	cfg.ConsulAddress = strings.TrimPrefix(server.URL, "http://")
+	m := newTestMicrocomms(t, cfg)
+	if _, err := m.Discovery.Resolve(context.Background(), "payments"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	waitForBlocking := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt64(&blocking) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d blocking queries, but got %d", want, atomic.LoadInt64(&blocking))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForBlocking(1)
+	if err := m.Close(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	waitForBlocking(0)
+}
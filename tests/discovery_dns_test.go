@@ -0,0 +1,207 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pramithamj/microcomms/internal/discovery"
+	"github.com/pramithamj/microcomms/internal/grpcclient"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// startDNSServer serves records from zone over UDP and counts the queries
+func startDNSServer(t *testing.T, zone []string, queries *int32) string {
+	t.Helper()
+	records := make(map[uint16]map[string][]dns.RR)
+	for _, line := range zone {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			t.Fatalf("Invalid record %q: %v", line, err)
+		}
+		qtype := rr.Header().Rrtype
+		if records[qtype] == nil {
+			records[qtype] = make(map[string][]dns.RR)
+		}
+		records[qtype][rr.Header().Name] = append(records[qtype][rr.Header().Name], rr)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		q := req.Question[0]
+		resp.Answer = records[q.Qtype][q.Name]
+		if q.Qtype == dns.TypeSRV {
+			// Only the first target gets glue, the other must be looked up
+			for _, rr := range resp.Answer {
+				resp.Extra = append(resp.Extra, records[dns.TypeA][rr.(*dns.SRV).Target]...)
+				break
+			}
+		}
+		w.WriteMsg(resp)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestDNSResolver_SRVRecordsAndTTL(t *testing.T) {
+	var queries int32
+	server := startDNSServer(t, []string{
+		"payments.svc.test. 1 IN SRV 10 60 8081 p1.svc.test.",
+		"payments.svc.test. 1 IN SRV 20 40 8082 p2.svc.test.",
+		"p1.svc.test. 30 IN A 10.0.0.1",
+		"p2.svc.test. 30 IN A 10.0.0.2",
+	}, &queries)
+
+	resolver, err := discovery.NewDNSResolver(discovery.DNSConfig{Server: server, Domain: "svc.test"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	ctx := context.Background()
+	instances, err := resolver.Resolve(ctx, "payments")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(instances) != 2 || instances[0].HostPort() != "10.0.0.1:8081" || instances[1].HostPort() != "10.0.0.2:8082" {
+		t.Fatalf("Unexpected instances: %+v", instances)
+	}
+	if instances[0].Meta["priority"] != "10" || instances[0].Meta["weight"] != "60" {
+		t.Fatalf("Expected SRV priority and weight in metadata, but got %v", instances[0].Meta)
+	}
+
+	// Cached until the 1s TTL of the SRV records expires
+	before := atomic.LoadInt32(&queries)
+	resolver.Resolve(ctx, "payments")
+	if atomic.LoadInt32(&queries) != before {
+		t.Fatalf("Expected cached answer within TTL")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	resolver.Resolve(ctx, "payments")
+	if atomic.LoadInt32(&queries) == before {
+		t.Fatalf("Expected a new query after the TTL expired")
+	}
+}
+
+func TestDNSResolver_AddressRecordsUseDefaultPort(t *testing.T) {
+	var queries int32
+	server := startDNSServer(t, []string{
+		"web.svc.test. 60 IN A 10.0.0.3",
+		"web.svc.test. 60 IN AAAA fd00::3",
+	}, &queries)
+
+	resolver, err := discovery.NewDNSResolver(discovery.DNSConfig{Server: server, Domain: "svc.test", DefaultPort: 8080})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	instances, err := resolver.Resolve(context.Background(), "web")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(instances) != 2 || instances[0].HostPort() != "10.0.0.3:8080" || instances[1].HostPort() != "[fd00::3]:8080" {
+		t.Fatalf("Unexpected instances: %+v", instances)
+	}
+
+	if _, err := resolver.Resolve(context.Background(), "missing"); err == nil {
+		t.Fatalf("Expected an error for an unknown service")
+	}
+}
+
+func TestDNSResolver_RetriesTruncatedAnswersOverTCP(t *testing.T) {
+	var srv []dns.RR
+	var glue []dns.RR
+	for i := 1; i <= 40; i++ {
+		target := fmt.Sprintf("p%d.svc.test.", i)
+		rr, _ := dns.NewRR(fmt.Sprintf("payments.svc.test. 60 IN SRV 10 10 8080 %s", target))
+		srv = append(srv, rr)
+		rr, _ = dns.NewRR(fmt.Sprintf("%s 60 IN A 10.0.1.%d", target, i))
+		glue = append(glue, rr)
+	}
+	handler := func(truncate bool) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			if req.Question[0].Qtype == dns.TypeSRV {
+				resp.Answer = srv
+				resp.Extra = glue
+				if truncate {
+					// What a server does when the answer exceeds 512 bytes
+					resp.Answer = srv[:5]
+					resp.Extra = glue[:5]
+					resp.Truncated = true
+				}
+			}
+			w.WriteMsg(resp)
+		})
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	pc, err := net.ListenPacket("udp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: handler(true)}
+	tcp := &dns.Server{Listener: lis, Handler: handler(false)}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	t.Cleanup(func() { udp.Shutdown(); tcp.Shutdown() })
+
+	resolver, err := discovery.NewDNSResolver(discovery.DNSConfig{Server: lis.Addr().String(), Domain: "svc.test"})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	instances, err := resolver.Resolve(context.Background(), "payments")
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(instances) != 40 {
+		t.Fatalf("Expected all 40 instances from the TCP answer, but got %d", len(instances))
+	}
+}
+
+func TestDiscoveryClient_ResolvesGRPCTarget(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(lis)
+	defer server.Stop()
+
+	resolver, err := discovery.NewStaticResolver(map[string][]string{"health": {lis.Addr().String()}})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	client, err := grpcclient.NewDiscoveryClient("health", resolver)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer client.Conn().Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(client.Conn()).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("Expected SERVING, but got %v", resp.Status)
+	}
+}
@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/internal/discovery"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+func localURL(t *testing.T) url.URL {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve port: %v", err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func startEtcdServer(t *testing.T) string {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, peerURL := localURL(t), localURL(t)
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, peerURL.String())
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("Failed to start etcd: %v", err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("etcd did not start")
+	}
+	return clientURL.Host
+}
+
+func waitForInstances(t *testing.T, resolver discovery.Resolver, service string, want int) []discovery.Instance {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		instances, err := resolver.Resolve(context.Background(), service)
+		if len(instances) == want && (err == nil || want == 0) {
+			return instances
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d instances of %s, but got %+v, %v", want, service, instances, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestEtcdDiscovery_RegisterWatchDeregister(t *testing.T) {
+	endpoint := startEtcdServer(t)
+
+	registry, err := discovery.NewEtcdDiscovery(discovery.EtcdConfig{Endpoints: []string{endpoint}, TTL: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer registry.Close()
+	resolver, err := discovery.NewEtcdDiscovery(discovery.EtcdConfig{Endpoints: []string{endpoint}})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer resolver.Close()
+
+	ctx := context.Background()
+	var noInstances *discovery.NoInstancesError
+	if _, err := resolver.Resolve(ctx, "payments"); !errors.As(err, &noInstances) {
+		t.Fatalf("Expected NoInstancesError, but got: %v", err)
+	}
+
+	// Registrations made after the first Resolve arrive through the watch
+	err = registry.Register(ctx, discovery.Instance{ID: "payments-1", Service: "payments", Address: "10.0.0.1", Port: 8081, Tags: []string{"v2"}})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	registry.Register(ctx, discovery.Instance{ID: "payments-2", Service: "payments", Address: "10.0.0.2", Port: 8081})
+
+	instances := waitForInstances(t, resolver, "payments", 2)
+	if instances[0].ID != "payments-1" || instances[0].HostPort() != "10.0.0.1:8081" || instances[0].Tags[0] != "v2" {
+		t.Fatalf("Unexpected instance: %+v", instances[0])
+	}
+
+	// The lease is kept alive beyond its TTL
+	time.Sleep(3 * time.Second)
+	waitForInstances(t, resolver, "payments", 2)
+
+	if err := registry.Deregister(ctx, "payments-1"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	instances = waitForInstances(t, resolver, "payments", 1)
+	if instances[0].ID != "payments-2" {
+		t.Fatalf("Expected payments-2 to remain, but got %+v", instances[0])
+	}
+
+	// Closing the registry revokes its remaining leases
+	registry.Close()
+	waitForInstances(t, resolver, "payments", 0)
+}
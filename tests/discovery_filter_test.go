@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pramithamj/microcomms/internal/discovery"
+)
+
+func filterIDs(instances []discovery.Instance) string {
+	ids := make([]string, len(instances))
+	for i, instance := range instances {
+		ids[i] = instance.ID
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestFilterInstances_TagsMetaDatacenterVersion(t *testing.T) {
+	instances := []discovery.Instance{
+		{ID: "a", Tags: []string{"primary", "http"}, Meta: map[string]string{"version": "1.2.0", "datacenter": "dc1", "tier": "gold"}},
+		{ID: "b", Tags: []string{"http"}, Meta: map[string]string{"version": "v1.10.3-rc1", "datacenter": "dc1"}},
+		{ID: "c", Tags: []string{"http"}, Meta: map[string]string{"version": "2.0", "datacenter": "dc2"}},
+		{ID: "d", Tags: []string{"http"}},
+	}
+
+	cases := []struct {
+		query discovery.Query
+		want  string
+	}{
+		{discovery.Query{}, "a,b,c,d"},
+		{discovery.Query{Tags: []string{"http", "primary"}}, "a"},
+		{discovery.Query{Meta: map[string]string{"tier": "gold"}}, "a"},
+		{discovery.Query{Datacenter: "dc1"}, "a,b"},
+		{discovery.Query{Version: ">=1.2, <2"}, "a,b"},
+		{discovery.Query{Version: ">1.2"}, "b,c"},
+		{discovery.Query{Version: "1.2"}, "a"},
+		{discovery.Query{Version: "!=2.0.0", Datacenter: "dc2"}, ""},
+	}
+	for _, c := range cases {
+		filtered, err := discovery.FilterInstances(instances, c.query)
+		if err != nil {
+			t.Fatalf("%+v: expected no error, but got: %v", c.query, err)
+		}
+		if got := filterIDs(filtered); got != c.want {
+			t.Errorf("%+v: expected %q, but got %q", c.query, c.want, got)
+		}
+	}
+
+	if _, err := discovery.FilterInstances(instances, discovery.Query{Version: ">=one"}); err == nil {
+		t.Fatalf("Expected an error for an invalid constraint")
+	}
+}
+
+func TestResolveQuery_StaticBackend(t *testing.T) {
+	r, _ := discovery.NewStaticResolver(nil)
+	ctx := context.Background()
+	r.Register(ctx, discovery.Instance{ID: "p1", Service: "payments", Address: "10.0.0.1", Port: 8081, Meta: map[string]string{"version": "1.0"}})
+	r.Register(ctx, discovery.Instance{ID: "p2", Service: "payments", Address: "10.0.0.2", Port: 8081, Meta: map[string]string{"version": "2.0"}})
+
+	instances, err := discovery.ResolveQuery(ctx, r, discovery.Query{Service: "payments", Version: ">=2"})
+	if err != nil || filterIDs(instances) != "p2" {
+		t.Fatalf("Expected p2, but got %+v, %v", instances, err)
+	}
+	var noInstances *discovery.NoInstancesError
+	if _, err := discovery.ResolveQuery(ctx, r, discovery.Query{Service: "payments", Version: ">=3"}); !errors.As(err, &noInstances) {
+		t.Fatalf("Expected NoInstancesError, but got: %v", err)
+	}
+}
+
+func TestConsulDiscovery_QueryPassesTagsAndDatacenter(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set("payments", 8081)
+	var mutex sync.Mutex
+	var seen []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") == "" {
+			mutex.Lock()
+			seen = append(seen, r.URL.Query()["tag"]...)
+			seen = append(seen, "dc="+r.URL.Query().Get("dc"))
+			mutex.Unlock()
+		}
+		consul.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	d, err := discovery.NewConsulDiscovery(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer d.Close()
+
+	instances, err := d.ResolveQuery(context.Background(), discovery.Query{Service: "payments", Tags: []string{"v2"}, Datacenter: "eu"})
+	if err != nil || len(instances) != 1 {
+		t.Fatalf("Expected one instance, but got %+v, %v", instances, err)
+	}
+	mutex.Lock()
+	got := strings.Join(seen, " ")
+	mutex.Unlock()
+	if got != "v2 dc=eu" {
+		t.Fatalf("Expected the tag and datacenter in the Consul query, but got %q", got)
+	}
+}
+
+func TestZoneConfig_PreferZoneWithSpillover(t *testing.T) {
+	zoned := func(id, zone string) discovery.Instance {
+		return discovery.Instance{ID: id, Meta: map[string]string{"zone": zone}}
+	}
+	all := []discovery.Instance{zoned("a1", "a"), zoned("a2", "a"), zoned("a3", "a"), zoned("a4", "a"), zoned("b1", "b")}
+	z := discovery.ZoneConfig{Zone: "a"}
+
+	if got := filterIDs(z.PreferZone(all, all)); got != "a1,a2,a3,a4" {
+		t.Fatalf("Expected only zone a, but got %s", got)
+	}
+	// Half of the zone healthy is still enough at the default 50%
+	healthy := []discovery.Instance{all[0], all[1], all[4]}
+	if got := filterIDs(z.PreferZone(all, healthy)); got != "a1,a2" {
+		t.Fatalf("Expected the healthy zone a instances, but got %s", got)
+	}
+	// Below the threshold traffic spills over to other zones
+	healthy = []discovery.Instance{all[0], all[4]}
+	if got := filterIDs(z.PreferZone(all, healthy)); got != "a1,b1" {
+		t.Fatalf("Expected spillover to zone b, but got %s", got)
+	}
+	// Without a zone every healthy instance is used
+	if got := filterIDs(discovery.ZoneConfig{}.PreferZone(all, healthy)); got != "a1,b1" {
+		t.Fatalf("Expected all healthy instances, but got %s", got)
+	}
+}
@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/internal/discovery"
+)
+
+func TestStaticResolver_ResolveAndRegister(t *testing.T) {
+	resolver, err := discovery.NewStaticResolver(map[string][]string{
+		"payments": {"127.0.0.1:8081", "127.0.0.1:8082"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	ctx := context.Background()
+	instances, err := resolver.Resolve(ctx, "payments")
+	if err != nil || len(instances) != 2 || instances[0].URL() != "http://127.0.0.1:8081" {
+		t.Fatalf("Unexpected instances: %+v, %v", instances, err)
+	}
+
+	resolver.Register(ctx, discovery.Instance{ID: "users-1", Service: "users", Address: "10.0.0.5", Port: 9000})
+	if instances, err := resolver.Resolve(ctx, "users"); err != nil || instances[0].HostPort() != "10.0.0.5:9000" {
+		t.Fatalf("Expected registered instance, but got: %+v, %v", instances, err)
+	}
+
+	resolver.Deregister(ctx, "users-1")
+	var noInstances *discovery.NoInstancesError
+	if _, err := resolver.Resolve(ctx, "users"); !errors.As(err, &noInstances) {
+		t.Fatalf("Expected NoInstancesError, but got: %v", err)
+	}
+}
+
+func TestStaticResolver_RejectsInvalidAddress(t *testing.T) {
+	if _, err := discovery.NewStaticResolver(map[string][]string{"payments": {"localhost"}}); err == nil {
+		t.Fatalf("Expected an error for an address without a port")
+	}
+}
+
+func TestFileResolver_ReloadsOnChange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	os.WriteFile(path, []byte(`{"payments": [{"address": "127.0.0.1", "port": 8081}]}`), 0o644)
+
+	resolver, err := discovery.NewFileResolver(path)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	instances, err := resolver.Resolve(context.Background(), "payments")
+	if err != nil || instances[0].Port != 8081 || instances[0].Service != "payments" {
+		t.Fatalf("Unexpected instances: %+v, %v", instances, err)
+	}
+
+	os.WriteFile(path, []byte(`{"payments": [{"address": "127.0.0.1", "port": 9091}]}`), 0o644)
+	future := time.Now().Add(2 * time.Second)
+	os.Chtimes(path, future, future)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		instances, _ = resolver.Resolve(context.Background(), "payments")
+		if instances[0].Port == 9091 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Expected file changes to be picked up, but got %+v", instances)
+}
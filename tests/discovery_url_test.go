@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pramithamj/microcomms/internal/discovery"
+	"github.com/pramithamj/microcomms/pkg/microcomms"
+)
+
+func TestParseServiceURL(t *testing.T) {
+	cases := []struct {
+		raw  string
+		want discovery.ServiceURL
+	}{
+		{"consul://payments/v1/charges?currency=EUR", discovery.ServiceURL{Scheme: "consul", Service: "payments", Rest: "/v1/charges?currency=EUR"}},
+		{"etcd+https://orders", discovery.ServiceURL{Scheme: "etcd", Service: "orders", Secure: true}},
+		{"DNS://search.internal/q#top", discovery.ServiceURL{Scheme: "dns", Service: "search.internal", Rest: "/q#top"}},
+		{"payments/v1/charges", discovery.ServiceURL{Service: "payments", Rest: "/v1/charges"}},
+	}
+	for _, c := range cases {
+		got, err := discovery.ParseServiceURL(c.raw)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, but got: %v", c.raw, err)
+		}
+		if got != c.want {
+			t.Fatalf("Expected %+v for %s, but got %+v", c.want, c.raw, got)
+		}
+	}
+
+	if _, err := discovery.ParseServiceURL("consul:///v1/charges"); err == nil {
+		t.Fatalf("Expected an error for a URL without a service name")
+	}
+}
+
+func TestURLResolver_Schemes(t *testing.T) {
+	consul := newFakeConsul()
+	consul.set("payments", 8081)
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	urls, err := discovery.NewURLResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	static, err := discovery.NewStaticResolver(map[string][]string{"orders": {"10.0.0.2:9000"}})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	urls.Handle("static", static)
+	urls.Handle("", static)
+	created := 0
+	urls.HandleFunc("consul", func() (discovery.Resolver, error) {
+		created++
+		return discovery.NewConsulDiscovery(strings.TrimPrefix(server.URL, "http://"))
+	})
+
+	ctx := context.Background()
+	cases := map[string]string{
+		"static://orders/v1/items?page=2":   "http://10.0.0.2:9000/v1/items?page=2",
+		"static+https://orders/v1/items":    "https://10.0.0.2:9000/v1/items",
+		"orders/v1/items":                   "http://10.0.0.2:9000/v1/items",
+		"consul://payments/v1/charges":      "http://10.0.0.1:8081/v1/charges",
+		"consul://payments":                 "http://10.0.0.1:8081",
+		"https://example.com/already/there": "https://example.com/already/there",
+	}
+	for target, want := range cases {
+		got, done, err := urls.ResolveURL(ctx, target)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, but got: %v", target, err)
+		}
+		done(nil)
+		if got != want {
+			t.Fatalf("Expected %s for %s, but got %s", want, target, got)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("Expected the consul resolver to be created once, but got %d", created)
+	}
+
+	// Failures are returned rather than ending the process
+	if _, _, err := urls.ResolveURL(ctx, "zookeeper://payments"); err == nil {
+		t.Fatalf("Expected an error for an unsupported scheme")
+	}
+	if _, _, err := urls.ResolveURL(ctx, "static://unknown"); err == nil {
+		t.Fatalf("Expected an error for an unknown service")
+	}
+}
+
+// closingResolver records whether it was closed
+type closingResolver struct {
+	discovery.Resolver
+	closed bool
+}
+
+func (c *closingResolver) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestURLResolver_CloseClosesCreatedResolvers(t *testing.T) {
+	urls, err := discovery.NewURLResolver(nil)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	static, _ := discovery.NewStaticResolver(map[string][]string{"payments": {"10.0.0.1:8080"}})
+	created := &closingResolver{Resolver: static}
+	unused := &closingResolver{Resolver: static}
+	owned := &closingResolver{Resolver: static}
+	urls.HandleFunc("etcd", func() (discovery.Resolver, error) { return created, nil })
+	urls.HandleFunc("dns", func() (discovery.Resolver, error) { return unused, nil })
+	urls.Handle("static", owned)
+
+	if _, _, err := urls.ResolveURL(context.Background(), "etcd://payments/v1"); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := urls.Close(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if !created.closed || unused.closed || owned.closed {
+		t.Fatalf("Expected only the created resolver to be closed, but got created=%v unused=%v owned=%v",
+			created.closed, unused.closed, owned.closed)
+	}
+	if _, err := urls.Resolver("static"); err == nil {
+		t.Fatalf("Expected lookups to fail after Close")
+	}
+}
+
+func TestMicrocomms_SendGRPCResolvesServiceURLs(t *testing.T) {
+	cfg := microcomms.DefaultConfig()
+	cfg.DiscoveryBackend = microcomms.DiscoveryBackendStatic
+	cfg.StaticServices = map[string][]string{"billing": {"127.0.0.1:50051"}}
+	m := newTestMicrocomms(t, cfg)
+	defer m.Close()
+
+	for _, target := range []string{"static://billing/billing.Invoices/Create", "billing/billing.Invoices/Create"} {
+		resp, err := m.Send(context.Background(), microcomms.MessageRequest{Target: target}, microcomms.ProtocolGRPC)
+		if err != nil {
+			t.Fatalf("Expected no error for %s, but got: %v", target, err)
+		}
+		if resp.Payload != "Response from /billing.Invoices/Create" {
+			t.Fatalf("Expected the call to carry the method of %s, but got %v", target, resp.Payload)
+		}
+	}
+	if _, err := m.Send(context.Background(), microcomms.MessageRequest{Target: "bogus://billing/x.Y/Z"}, microcomms.ProtocolGRPC); err == nil {
+		t.Fatalf("Expected an error for an unsupported scheme")
+	}
+}
@@ -0,0 +1,232 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/pkg/microcomms"
+)
+
+// countingStore counts round trips and can be made to fail
+type countingStore struct {
+	microcomms.QuotaStore
+	calls int64
+	fail  atomic.Bool
+}
+
+func (s *countingStore) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	atomic.AddInt64(&s.calls, 1)
+	if s.fail.Load() {
+		return nil, 0, errors.New("store unavailable")
+	}
+	return s.QuotaStore.Get(ctx, key)
+}
+
+func TestDistributedLimiter_SharesLimitAcrossReplicas(t *testing.T) {
+	store := microcomms.NewMemoryQuotaStore()
+	config := microcomms.DistributedLimiterConfig{Key: "partner", Rate: 1, Burst: 10}
+	replicas := []*microcomms.DistributedLimiter{
+		microcomms.NewDistributedLimiter(store, config),
+		microcomms.NewDistributedLimiter(store, config),
+		microcomms.NewDistributedLimiter(store, config),
+	}
+
+	var allowed int64
+	var wg sync.WaitGroup
+	for _, d := range replicas {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(d *microcomms.DistributedLimiter) {
+				defer wg.Done()
+				if d.Allow(context.Background()) {
+					atomic.AddInt64(&allowed, 1)
+				}
+			}(d)
+		}
+	}
+	wg.Wait()
+	if allowed != 10 {
+		t.Fatalf("Expected the burst of 10 to be shared by every replica, but %d were allowed", allowed)
+	}
+}
+
+func TestDistributedLimiter_PrefetchesTokens(t *testing.T) {
+	store := &countingStore{QuotaStore: microcomms.NewMemoryQuotaStore()}
+	d := microcomms.NewDistributedLimiter(store, microcomms.DistributedLimiterConfig{
+		Key: "partner", Rate: 1, Burst: 20, Prefetch: 10,
+	})
+	for i := 0; i < 20; i++ {
+		if !d.Allow(context.Background()) {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+	}
+	if calls := atomic.LoadInt64(&store.calls); calls != 2 {
+		t.Fatalf("Expected 2 store round trips for 20 requests, but got %d", calls)
+	}
+	if d.Allow(context.Background()) {
+		t.Fatalf("Expected the shared limit to be used up")
+	}
+
+	// A replica cannot take tokens another one prefetched
+	other := microcomms.NewDistributedLimiter(store, microcomms.DistributedLimiterConfig{Key: "partner", Rate: 1, Burst: 20})
+	if other.Allow(context.Background()) {
+		t.Fatalf("Expected the other replica to be limited")
+	}
+}
+
+func TestDistributedLimiter_WaitReservesFromStore(t *testing.T) {
+	store := microcomms.NewMemoryQuotaStore()
+	d := microcomms.NewDistributedLimiter(store, microcomms.DistributedLimiterConfig{Key: "partner", Rate: 20, Burst: 1})
+	if err := d.Wait(context.Background()); err != nil {
+		t.Fatalf("Expected the first token at once, but got %v", err)
+	}
+	start := time.Now()
+	if err := d.Wait(context.Background()); err != nil {
+		t.Fatalf("Expected the second token after a wait, but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("Expected to wait about 50ms, but waited %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := d.Wait(ctx); !errors.Is(err, microcomms.ErrRateLimited) {
+		t.Fatalf("Expected ErrRateLimited for a wait beyond the deadline, but got %v", err)
+	}
+}
+
+func TestDistributedLimiter_DegradesToLocalLimit(t *testing.T) {
+	store := &countingStore{QuotaStore: microcomms.NewMemoryQuotaStore()}
+	store.fail.Store(true)
+	d := microcomms.NewDistributedLimiter(store, microcomms.DistributedLimiterConfig{
+		Key: "partner", Rate: 1, Burst: 12, Replicas: 3, RetryInterval: 50 * time.Millisecond,
+	})
+
+	// Each of the 3 replicas gets a third of the burst while the store is down
+	for i := 0; i < 4; i++ {
+		if !d.Allow(context.Background()) {
+			t.Fatalf("Expected request %d to be allowed by the local limit", i)
+		}
+	}
+	if d.Allow(context.Background()) || !d.Degraded() {
+		t.Fatalf("Expected the degraded limiter to enforce the local share")
+	}
+	if calls := atomic.LoadInt64(&store.calls); calls != 1 {
+		t.Fatalf("Expected the store not to be retried within the retry interval, but got %d calls", calls)
+	}
+
+	store.fail.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	if !d.Allow(context.Background()) || d.Degraded() {
+		t.Fatalf("Expected the limiter to use the store again")
+	}
+}
+
+// slowStore delays every read, like a remote store
+type slowStore struct {
+	microcomms.QuotaStore
+	delay time.Duration
+}
+
+func (s *slowStore) Get(ctx context.Context, key string) ([]byte, uint64, error) {
+	time.Sleep(s.delay)
+	return s.QuotaStore.Get(ctx, key)
+}
+
+// contendedStore loses every compare-and-swap, as if other replicas kept
+// updating the limit
+type contendedStore struct {
+	microcomms.QuotaStore
+}
+
+func (s *contendedStore) CompareAndSwap(ctx context.Context, key string, version uint64, value []byte) (bool, error) {
+	return false, nil
+}
+
+func TestDistributedLimiter_RefillsOutsideTheLock(t *testing.T) {
+	store := &slowStore{QuotaStore: microcomms.NewMemoryQuotaStore(), delay: 50 * time.Millisecond}
+	d := microcomms.NewDistributedLimiter(store, microcomms.DistributedLimiterConfig{Key: "partner", Rate: 1, Burst: 10})
+
+	start := time.Now()
+	var allowed int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if d.Allow(context.Background()) {
+				atomic.AddInt64(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed == 0 {
+		t.Fatalf("Expected requests to be allowed")
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("Expected concurrent requests not to queue behind each other's round trips, but took %v", elapsed)
+	}
+}
+
+func TestDistributedLimiter_SharesOneRefill(t *testing.T) {
+	store := &countingStore{QuotaStore: &slowStore{QuotaStore: microcomms.NewMemoryQuotaStore(), delay: 20 * time.Millisecond}}
+	d := microcomms.NewDistributedLimiter(store, microcomms.DistributedLimiterConfig{
+		Key: "partner", Rate: 1, Burst: 10, Prefetch: 10,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !d.Allow(context.Background()) {
+				t.Errorf("Expected the prefetched tokens to be shared")
+			}
+		}()
+	}
+	wg.Wait()
+	if calls := atomic.LoadInt64(&store.calls); calls != 1 {
+		t.Fatalf("Expected a single refill in flight, but got %d store round trips", calls)
+	}
+}
+
+func TestDistributedLimiter_RejectsBadRequestsWithoutDegrading(t *testing.T) {
+	store := &countingStore{QuotaStore: microcomms.NewMemoryQuotaStore()}
+	d := microcomms.NewDistributedLimiter(store, microcomms.DistributedLimiterConfig{Key: "partner", Rate: 1, Burst: 2})
+	if d.AllowN(context.Background(), 3) {
+		t.Fatalf("Expected a request beyond the burst to be denied")
+	}
+	if err := d.WaitN(context.Background(), 3); err == nil || errors.Is(err, microcomms.ErrRateLimited) {
+		t.Fatalf("Expected an error for a wait beyond the burst, but got %v", err)
+	}
+
+	stopped := microcomms.NewDistributedLimiter(store, microcomms.DistributedLimiterConfig{Key: "stopped", Burst: 1})
+	if stopped.Allow(context.Background()) {
+		t.Fatalf("Expected a zero rate to deny requests")
+	}
+	if err := stopped.Wait(context.Background()); !errors.Is(err, microcomms.ErrRateLimited) {
+		t.Fatalf("Expected ErrRateLimited for a zero rate, but got %v", err)
+	}
+
+	if d.Degraded() || stopped.Degraded() {
+		t.Fatalf("Expected bad requests not to degrade the limiter")
+	}
+	if calls := atomic.LoadInt64(&store.calls); calls != 0 {
+		t.Fatalf("Expected bad requests not to reach the store, but got %d calls", calls)
+	}
+}
+
+func TestDistributedLimiter_ContentionDoesNotDegrade(t *testing.T) {
+	store := &contendedStore{QuotaStore: microcomms.NewMemoryQuotaStore()}
+	d := microcomms.NewDistributedLimiter(store, microcomms.DistributedLimiterConfig{Key: "partner", Rate: 1, Burst: 10})
+	if d.Allow(context.Background()) {
+		t.Fatalf("Expected a request to be denied when the limit cannot be updated")
+	}
+	if d.Degraded() {
+		t.Fatalf("Expected contention not to be treated as a store outage")
+	}
+}
@@ -0,0 +1,87 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/pkg/microcomms"
+)
+
+func TestKeyedLimiter_RulesPerKey(t *testing.T) {
+	k := microcomms.NewKeyedLimiter(microcomms.KeyedLimiterConfig{
+		Rules: map[string]microcomms.RateLimitRule{
+			"tenant":         {Rate: 1, Burst: 2},
+			"tenant:premium": {Rate: 1, Burst: 5},
+			"apikey:test-*":  {Rate: 1, Burst: 1},
+		},
+	})
+
+	// Each tenant has its own bucket from the kind rule
+	for _, tenant := range []string{"tenant:acme", "tenant:globex"} {
+		if !k.Allow(tenant) || !k.Allow(tenant) || k.Allow(tenant) {
+			t.Fatalf("Expected a burst of 2 for %s", tenant)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if !k.Allow("tenant:premium") {
+			t.Fatalf("Expected a burst of 5 for the premium tenant")
+		}
+	}
+	if !k.Allow("apikey:test-1") || k.Allow("apikey:test-1") {
+		t.Fatalf("Expected the pattern rule for test API keys")
+	}
+	// Keys without a rule are unlimited and get no bucket
+	for i := 0; i < 100; i++ {
+		if !k.Allow("apikey:live-1") {
+			t.Fatalf("Expected keys without a rule to be unlimited")
+		}
+	}
+	if keys := k.Keys(); len(keys) != 4 {
+		t.Fatalf("Expected 4 buckets, but got %v", keys)
+	}
+}
+
+func TestKeyedLimiter_AllKeysOrNone(t *testing.T) {
+	k := microcomms.NewKeyedLimiter(microcomms.KeyedLimiterConfig{
+		Default: microcomms.RateLimitRule{Rate: 1, Burst: 1},
+	})
+	if !k.Allow("http:payments") {
+		t.Fatalf("Expected the first call to be allowed")
+	}
+	// The tenant's token is returned when the target's bucket is empty
+	if k.Allow("tenant:acme", "http:payments") {
+		t.Fatalf("Expected the empty target bucket to reject")
+	}
+	if !k.Allow("tenant:acme") {
+		t.Fatalf("Expected the tenant's token to be returned")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := k.Wait(ctx, "http:payments"); !errors.Is(err, microcomms.ErrRateLimited) {
+		t.Fatalf("Expected ErrRateLimited for a wait beyond the deadline, but got %v", err)
+	}
+}
+
+func TestKeyedLimiter_EvictsIdleFullBuckets(t *testing.T) {
+	k := microcomms.NewKeyedLimiter(microcomms.KeyedLimiterConfig{
+		Rules: map[string]microcomms.RateLimitRule{
+			"tenant:idle":  {Rate: 1000, Burst: 1},
+			"tenant:empty": {Rate: 0.001, Burst: 1},
+		},
+		Default:     microcomms.RateLimitRule{Rate: 1},
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	k.Allow("tenant:idle")
+	k.Allow("tenant:empty")
+
+	time.Sleep(80 * time.Millisecond)
+	k.Allow("tenant:active")
+
+	keys := k.Keys()
+	if len(keys) != 2 || keys[0] != "tenant:active" || keys[1] != "tenant:empty" {
+		t.Fatalf("Expected the refilled idle bucket to be evicted, but got %v", keys)
+	}
+}
@@ -0,0 +1,126 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/internal/mqclient"
+)
+
+func TestPublishBatch_ReportsPartialFailure(t *testing.T) {
+	queue := mqclient.NewMessageQueue(10)
+	err := queue.PublishBatch(context.Background(), []*mqclient.Message{
+		{Topic: "orders", Payload: []byte("a")},
+		{Payload: []byte("missing topic")},
+		{Topic: "orders", Payload: []byte("c")},
+	})
+
+	var batchErr *mqclient.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("Expected a BatchError, but got: %v", err)
+	}
+	if len(batchErr.Errors) != 1 || batchErr.Failed(1) == nil {
+		t.Fatalf("Expected only message 1 to fail, but got: %v", batchErr)
+	}
+}
+
+func TestSubscribeBatch_FlushesOnSizeAndWait(t *testing.T) {
+	queue := mqclient.NewMessageQueue(10)
+	batches := make(chan int, 10)
+	sub, err := queue.SubscribeBatch("orders", func(ctx context.Context, msgs []*mqclient.Message) error {
+		batches <- len(msgs)
+		return nil
+	}, mqclient.BatchOptions{MaxSize: 3, MaxWait: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	msgs := make([]*mqclient.Message, 4)
+	for i := range msgs {
+		msgs[i] = &mqclient.Message{Topic: "orders"}
+	}
+	if err := queue.PublishBatch(context.Background(), msgs); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	if size := <-batches; size != 3 {
+		t.Fatalf("Expected a full batch of 3, but got %d", size)
+	}
+	select {
+	case size := <-batches:
+		if size != 1 {
+			t.Fatalf("Expected a partial batch of 1, but got %d", size)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected partial batch to flush after MaxWait")
+	}
+}
+
+func TestSubscribeBatch_RedeliversOnlyFailedMessages(t *testing.T) {
+	queue := mqclient.NewMessageQueue(10)
+
+	var mutex sync.Mutex
+	deliveries := make(map[string]int)
+	done := make(chan struct{})
+	sub, err := queue.SubscribeBatch("orders", func(ctx context.Context, msgs []*mqclient.Message) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		batchErr := mqclient.NewBatchError()
+		for i, msg := range msgs {
+			deliveries[msg.ID]++
+			if msg.ID == "bad" && deliveries[msg.ID] < 2 {
+				batchErr.Add(i, errors.New("temporary failure"))
+			}
+		}
+		if deliveries["bad"] == 2 {
+			close(done)
+		}
+		if len(batchErr.Errors) > 0 {
+			return batchErr
+		}
+		return nil
+	}, mqclient.BatchOptions{MaxSize: 2, MaxWait: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	queue.PublishBatch(context.Background(), []*mqclient.Message{
+		{ID: "good", Topic: "orders"},
+		{ID: "bad", Topic: "orders"},
+	})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected failed message to be redelivered")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if deliveries["good"] != 1 {
+		t.Fatalf("Expected successful message to be delivered once, but got %d", deliveries["good"])
+	}
+}
+
+func TestDeduplicateBatch_UnwrapsBatchErrors(t *testing.T) {
+	handler := mqclient.DeduplicateBatch(func(ctx context.Context, msgs []*mqclient.Message) error {
+		batchErr := mqclient.NewBatchError()
+		batchErr.Add(1, errors.New("temporary failure"))
+		return fmt.Errorf("failed to process batch: %w", batchErr)
+	}, mqclient.DedupConfig{})
+
+	err := handler(context.Background(), []*mqclient.Message{{ID: "a"}, {ID: "b"}})
+	var batchErr *mqclient.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("Expected a BatchError, but got: %v", err)
+	}
+	if len(batchErr.Errors) != 1 || batchErr.Failed(1) == nil {
+		t.Fatalf("Expected only message 1 to fail, but got: %v", batchErr)
+	}
+}
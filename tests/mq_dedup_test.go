@@ -0,0 +1,179 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/internal/mqclient"
+)
+
+func TestDeduplicate_SkipsProcessedMessages(t *testing.T) {
+	var calls int32
+	handler := mqclient.Deduplicate(func(ctx context.Context, msg *mqclient.Message) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}, mqclient.DedupConfig{})
+
+	msg := &mqclient.Message{ID: "order-1", Topic: "orders"}
+	for i := 0; i < 3; i++ {
+		if err := handler(context.Background(), msg); err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("Expected handler to run once, but ran %d times", calls)
+	}
+}
+
+func TestDeduplicate_RetriesFailedMessages(t *testing.T) {
+	store := mqclient.NewMemoryDedupStore(10, time.Minute)
+	var calls int32
+	handler := mqclient.Deduplicate(func(ctx context.Context, msg *mqclient.Message) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	}, mqclient.DedupConfig{
+		Store:   store,
+		KeyFunc: func(msg *mqclient.Message) string { return msg.Headers["idempotency-key"] },
+	})
+
+	msg := &mqclient.Message{ID: "a", Headers: map[string]string{"idempotency-key": "k1"}}
+	if err := handler(context.Background(), msg); err == nil {
+		t.Fatalf("Expected first attempt to fail")
+	}
+	if err := handler(context.Background(), msg); err != nil {
+		t.Fatalf("Expected retry to succeed, but got: %v", err)
+	}
+	if err := handler(context.Background(), msg); err != nil {
+		t.Fatalf("Expected duplicate to be acked, but got: %v", err)
+	}
+
+	record, _ := store.Get("k1")
+	if calls != 2 || record == nil || record.Status != mqclient.DedupProcessed || record.Attempts != 2 {
+		t.Fatalf("Unexpected outcome: calls=%d record=%+v", calls, record)
+	}
+}
+
+func TestDeduplicate_SerializesWaitersAfterFailure(t *testing.T) {
+	started := make(chan int32, 3)
+	release := make(chan struct{})
+	var active, overlapped, calls int32
+	handler := mqclient.Deduplicate(func(ctx context.Context, msg *mqclient.Message) error {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		defer atomic.AddInt32(&active, -1)
+		call := atomic.AddInt32(&calls, 1)
+		started <- call
+		<-release
+		if call == 1 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	}, mqclient.DedupConfig{})
+
+	msg := &mqclient.Message{ID: "order-1"}
+	deliver := func(done chan<- error) {
+		go func() { done <- handler(context.Background(), msg) }()
+	}
+
+	// The first delivery fails while a second one waits for it
+	first, second, third := make(chan error, 1), make(chan error, 1), make(chan error, 1)
+	deliver(first)
+	<-started
+	deliver(second)
+	time.Sleep(20 * time.Millisecond)
+	release <- struct{}{}
+	if err := <-first; err == nil {
+		t.Fatalf("Expected the first delivery to fail")
+	}
+
+	// A third delivery arriving while the second runs must wait for it
+	<-started
+	deliver(third)
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if err := <-second; err != nil {
+		t.Fatalf("Expected the second delivery to succeed, but got: %v", err)
+	}
+	if err := <-third; err != nil {
+		t.Fatalf("Expected the third delivery to be acked, but got: %v", err)
+	}
+	if overlapped != 0 || calls != 2 {
+		t.Fatalf("Expected deliveries of a key to run one at a time, but got calls=%d overlapped=%d", calls, overlapped)
+	}
+}
+
+func TestMemoryDedupStore_EvictsAndExpires(t *testing.T) {
+	store := mqclient.NewMemoryDedupStore(2, 50*time.Millisecond)
+	now := time.Now()
+	store.Put("a", mqclient.DedupRecord{Status: mqclient.DedupProcessed, UpdatedAt: now})
+	store.Put("b", mqclient.DedupRecord{Status: mqclient.DedupProcessed, UpdatedAt: now})
+	store.Get("a")
+	store.Put("c", mqclient.DedupRecord{Status: mqclient.DedupProcessed, UpdatedAt: now})
+
+	if r, _ := store.Get("b"); r != nil {
+		t.Fatalf("Expected least recently used key to be evicted")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if r, _ := store.Get("a"); r != nil {
+		t.Fatalf("Expected key to expire")
+	}
+}
+
+func TestFileDedupStore_SurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.jsonl")
+	store, err := mqclient.NewFileDedupStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	store.Put("a", mqclient.DedupRecord{Status: mqclient.DedupProcessed, UpdatedAt: time.Now()})
+	store.Put("b", mqclient.DedupRecord{Status: mqclient.DedupFailed, UpdatedAt: time.Now()})
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	store.Close()
+
+	reopened, err := mqclient.NewFileDedupStore(path, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer reopened.Close()
+	if r, _ := reopened.Get("a"); r == nil || r.Status != mqclient.DedupProcessed {
+		t.Fatalf("Expected record to be reloaded, but got: %+v", r)
+	}
+}
+
+func TestSubscription_DeduplicatesRedeliveries(t *testing.T) {
+	queue := mqclient.NewMessageQueue(10)
+	processed := make(chan string, 10)
+	sub, err := queue.SubscribeWithOptions("orders", func(ctx context.Context, msg *mqclient.Message) error {
+		processed <- msg.ID
+		return nil
+	}, mqclient.SubscribeOptions{Dedup: &mqclient.DedupConfig{}})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	for i := 0; i < 2; i++ {
+		if err := queue.Publish(context.Background(), &mqclient.Message{ID: "m1", Topic: "orders"}); err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+	}
+	queue.Publish(context.Background(), &mqclient.Message{ID: "m2", Topic: "orders"})
+
+	if first, second := <-processed, <-processed; first != "m1" || second != "m2" {
+		t.Fatalf("Expected m1 then m2, but got %s then %s", first, second)
+	}
+	select {
+	case id := <-processed:
+		t.Fatalf("Expected duplicate to be skipped, but processed %s", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
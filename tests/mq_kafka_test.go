@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/internal/mqclient"
+	"github.com/pramithamj/microcomms/pkg/microcomms"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+func newKafkaCluster(t *testing.T) *kfake.Cluster {
+	t.Helper()
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(3, "orders"))
+	if err != nil {
+		t.Fatalf("Failed to start fake Kafka cluster: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+	return cluster
+}
+
+func newKafkaBroker(t *testing.T, cluster *kfake.Cluster, acks mqclient.KafkaAcks) *mqclient.KafkaBroker {
+	t.Helper()
+	broker, err := mqclient.NewKafkaBroker(mqclient.KafkaConfig{
+		Brokers:       cluster.ListenAddrs(),
+		Acks:          acks,
+		ConsumerGroup: "billing",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return broker
+}
+
+func TestKafkaBroker_ProducerAcks(t *testing.T) {
+	wireAcks := map[mqclient.KafkaAcks]int16{
+		mqclient.KafkaAcksNone:   0,
+		mqclient.KafkaAcksLeader: 1,
+		mqclient.KafkaAcksAll:    -1,
+	}
+	for acks, want := range wireAcks {
+		t.Run(fmt.Sprint(want), func(t *testing.T) {
+			cluster := newKafkaCluster(t)
+			seen := make(chan int16, 1)
+			cluster.ControlKey(int16(kmsg.Produce), func(req kmsg.Request) (kmsg.Response, error, bool) {
+				seen <- req.(*kmsg.ProduceRequest).Acks
+				return nil, nil, false
+			})
+
+			broker := newKafkaBroker(t, cluster, acks)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := broker.Publish(ctx, &mqclient.Message{Topic: "orders", Payload: []byte("x")}); err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+			// With acks=0 the publish returns before the broker has read the
+			// request, so wait for it to arrive
+			select {
+			case got := <-seen:
+				if got != want {
+					t.Fatalf("Expected produce with acks=%d, but got %d", want, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Expected the broker to receive a produce request")
+			}
+		})
+	}
+}
+
+func TestKafkaBroker_KeysHeadersAndCommittedOffsets(t *testing.T) {
+	cluster := newKafkaCluster(t)
+	broker := newKafkaBroker(t, cluster, mqclient.KafkaAcksAll)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	err := broker.PublishBatch(ctx, []*mqclient.Message{
+		{ID: "m1", Topic: "orders", Key: "order-1", Payload: []byte("created"), Headers: map[string]string{"tenant": "acme"}},
+		{ID: "m2", Topic: "orders", Key: "order-1", Payload: []byte("paid")},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	received := make(chan *mqclient.Message, 10)
+	sub, err := broker.SubscribeWithOptions("orders", func(ctx context.Context, msg *mqclient.Message) error {
+		received <- msg
+		return nil
+	}, mqclient.SubscribeOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	first, second := receiveMessage(t, received), receiveMessage(t, received)
+	if first.ID != "m1" || second.ID != "m2" {
+		t.Fatalf("Expected m1 then m2 for the same key, but got %s then %s", first.ID, second.ID)
+	}
+	if first.Key != "order-1" || first.Headers["tenant"] != "acme" || string(first.Payload) != "created" {
+		t.Fatalf("Expected key, headers and payload to round trip, but got %+v", first)
+	}
+
+	// Leave the group and publish again; the group should resume after the
+	// committed offsets and only see the new message
+	sub.Unsubscribe()
+	if err := broker.Publish(ctx, &mqclient.Message{ID: "m3", Topic: "orders", Key: "order-1"}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	sub, err = broker.SubscribeWithOptions("orders", func(ctx context.Context, msg *mqclient.Message) error {
+		received <- msg
+		return nil
+	}, mqclient.SubscribeOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	if msg := receiveMessage(t, received); msg.ID != "m3" {
+		t.Fatalf("Expected to resume at m3, but got %s", msg.ID)
+	}
+}
+
+func receiveMessage(t *testing.T, ch <-chan *mqclient.Message) *mqclient.Message {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(15 * time.Second):
+		t.Fatalf("Timed out waiting for message")
+		return nil
+	}
+}
+
+func TestMicrocomms_CloseClosesKafkaBroker(t *testing.T) {
+	cluster := newKafkaCluster(t)
+	left := make(chan struct{}, 1)
+	cluster.ControlKey(int16(kmsg.LeaveGroup), func(req kmsg.Request) (kmsg.Response, error, bool) {
+		left <- struct{}{}
+		return nil, nil, false
+	})
+
+	cfg := microcomms.DefaultConfig()
+	cfg.ServiceDiscovery = false
+	cfg.MQBackend = microcomms.MQBackendKafka
+	cfg.Kafka = microcomms.KafkaConfig{Brokers: cluster.ListenAddrs(), ConsumerGroup: "billing"}
+	m := newTestMicrocomms(t, cfg)
+
+	received := make(chan *mqclient.Message, 1)
+	_, err := m.MQClient.Subscribe("orders", func(ctx context.Context, msg *mqclient.Message) error {
+		received <- msg
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.MQClient.Publish(ctx, &mqclient.Message{Topic: "orders", Payload: []byte("x")}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	receiveMessage(t, received)
+
+	if err := m.Close(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	select {
+	case <-left:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Close to leave the consumer group")
+	}
+}
@@ -0,0 +1,248 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/pramithamj/microcomms/internal/mqclient"
+	"github.com/pramithamj/microcomms/pkg/microcomms"
+)
+
+func startNATSServer(t *testing.T, port int, storeDir string) *server.Server {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      port,
+		JetStream: true,
+		StoreDir:  storeDir,
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("NATS server did not start")
+	}
+	return ns
+}
+
+func TestNATSBroker_CoreWildcardsAndReconnect(t *testing.T) {
+	storeDir := t.TempDir()
+	ns := startNATSServer(t, -1, storeDir)
+
+	broker, err := mqclient.NewNATSBroker(mqclient.NATSConfig{
+		URL:           ns.ClientURL(),
+		MaxReconnects: -1,
+		ReconnectWait: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer broker.Close()
+
+	received := make(chan *mqclient.Message, 10)
+	sub, err := broker.SubscribeWithOptions("orders.>", func(ctx context.Context, msg *mqclient.Message) error {
+		received <- msg
+		return nil
+	}, mqclient.SubscribeOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	ctx := context.Background()
+	err = broker.Publish(ctx, &mqclient.Message{ID: "m1", Topic: "orders.eu.created", Key: "order-1", Headers: map[string]string{"tenant": "acme"}})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	msg := receiveMessage(t, received)
+	if msg.ID != "m1" || msg.Topic != "orders.eu.created" || msg.Key != "order-1" || msg.Headers["tenant"] != "acme" {
+		t.Fatalf("Expected message to round trip with its concrete subject, but got %+v", msg)
+	}
+
+	// Restart the server on the same port; the subscription should be
+	// restored once the client reconnects
+	port := ns.Addr().(*net.TCPAddr).Port
+	ns.Shutdown()
+	ns.WaitForShutdown()
+	ns = startNATSServer(t, port, storeDir)
+	defer ns.Shutdown()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		broker.Publish(ctx, &mqclient.Message{ID: "m2", Topic: "orders.us.created"})
+		select {
+		case msg := <-received:
+			if msg.ID != "m2" {
+				t.Fatalf("Expected m2 after reconnect, but got %s", msg.ID)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected delivery to resume after reconnect")
+		}
+	}
+}
+
+func TestNATSBroker_JetStreamAckNack(t *testing.T) {
+	ns := startNATSServer(t, -1, t.TempDir())
+	defer ns.Shutdown()
+
+	broker, err := mqclient.NewNATSBroker(mqclient.NATSConfig{
+		URL:            ns.ClientURL(),
+		JetStream:      true,
+		Stream:         "ORDERS",
+		StreamSubjects: []string{"orders.>"},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer broker.Close()
+
+	ctx := context.Background()
+	if err := broker.PublishBatch(ctx, []*mqclient.Message{
+		{ID: "ok", Topic: "orders.created"},
+		{ID: "flaky", Topic: "orders.created"},
+		{ID: "poison", Topic: "orders.created"},
+	}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+
+	type delivery struct {
+		id    string
+		count int
+	}
+	deliveries := make(chan delivery, 20)
+	sub, err := broker.SubscribeWithOptions("orders.*", func(ctx context.Context, msg *mqclient.Message) error {
+		deliveries <- delivery{msg.ID, msg.Deliveries}
+		if msg.ID == "poison" || (msg.ID == "flaky" && msg.Deliveries == 1) {
+			return errors.New("nack")
+		}
+		return nil
+	}, mqclient.SubscribeOptions{Group: "billing", MaxDeliveries: 2})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	counts := make(map[string]int)
+	timeout := time.After(5 * time.Second)
+	for len(counts) < 3 || counts["flaky"] < 2 || counts["poison"] < 2 {
+		select {
+		case d := <-deliveries:
+			counts[d.id]++
+			if d.count != counts[d.id] {
+				t.Fatalf("Expected delivery count %d for %s, but got %d", counts[d.id], d.id, d.count)
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for redeliveries, got %v", counts)
+		}
+	}
+
+	// Acked and terminated messages must not come back
+	select {
+	case d := <-deliveries:
+		t.Fatalf("Expected no further deliveries, but got %s (%d)", d.id, d.count)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if counts["ok"] != 1 {
+		t.Fatalf("Expected acked message to be delivered once, but got %d", counts["ok"])
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	cases := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.eu.created", false},
+		{"orders.>", "orders.eu.created", true},
+		{"orders.>", "orders", false},
+		{"*.created", "payments.created", true},
+	}
+	for _, c := range cases {
+		if got := mqclient.TopicMatches(c.pattern, c.topic); got != c.want {
+			t.Errorf("TopicMatches(%q, %q) = %v, want %v", c.pattern, c.topic, got, c.want)
+		}
+	}
+}
+
+func TestNATSBroker_DropsMessagesWhenQueueStaysFull(t *testing.T) {
+	ns := startNATSServer(t, -1, t.TempDir())
+	defer ns.Shutdown()
+
+	broker, err := mqclient.NewNATSBroker(mqclient.NATSConfig{
+		URL:            ns.ClientURL(),
+		QueueSize:      1,
+		EnqueueTimeout: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer broker.Close()
+
+	release := make(chan struct{})
+	received := make(chan *mqclient.Message, 10)
+	sub, err := broker.SubscribeWithOptions("orders", func(ctx context.Context, msg *mqclient.Message) error {
+		<-release
+		received <- msg
+		return nil
+	}, mqclient.SubscribeOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	// One message is handled and one is queued; the rest time out
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		if err := broker.Publish(ctx, &mqclient.Message{Topic: "orders"}); err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+
+	receiveMessage(t, received)
+	receiveMessage(t, received)
+	select {
+	case <-received:
+		t.Fatalf("Expected messages beyond the full queue to be dropped")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMicrocomms_CloseClosesNATSBroker(t *testing.T) {
+	ns := startNATSServer(t, -1, t.TempDir())
+	defer ns.Shutdown()
+
+	cfg := microcomms.DefaultConfig()
+	cfg.ServiceDiscovery = false
+	cfg.MQBackend = microcomms.MQBackendNATS
+	cfg.NATS = microcomms.NATSConfig{URL: ns.ClientURL()}
+	m := newTestMicrocomms(t, cfg)
+
+	ctx := context.Background()
+	if err := m.MQClient.Publish(ctx, &mqclient.Message{Topic: "orders"}); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for ns.NumClients() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected Close to close the NATS connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/internal/mqclient"
+)
+
+func TestOrderedLanes_PreservePerKeyOrder(t *testing.T) {
+	queue := mqclient.NewMessageQueue(100)
+
+	var mutex sync.Mutex
+	seen := make(map[string][]int)
+	var wg sync.WaitGroup
+	wg.Add(40)
+
+	sub, err := queue.SubscribeWithOptions("orders", func(ctx context.Context, msg *mqclient.Message) error {
+		defer wg.Done()
+		var seq int
+		fmt.Sscanf(string(msg.Payload), "%d", &seq)
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		seen[msg.Key] = append(seen[msg.Key], seq)
+		mutex.Unlock()
+		return nil
+	}, mqclient.SubscribeOptions{OrderedLanes: 4})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	for seq := 0; seq < 10; seq++ {
+		for _, key := range []string{"order-1", "order-2", "order-3", "order-4"} {
+			msg := &mqclient.Message{Topic: "orders", Key: key, Payload: []byte(fmt.Sprint(seq))}
+			if err := queue.Publish(context.Background(), msg); err != nil {
+				t.Fatalf("Expected no error, but got: %v", err)
+			}
+		}
+	}
+	wg.Wait()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for key, seqs := range seen {
+		for i, seq := range seqs {
+			if seq != i {
+				t.Fatalf("Expected %s messages in order, but got %v", key, seqs)
+			}
+		}
+	}
+}
+
+func TestLaneFor_IsStable(t *testing.T) {
+	if mqclient.LaneFor("order-42", 8) != mqclient.LaneFor("order-42", 8) {
+		t.Fatalf("Expected the same key to map to the same lane")
+	}
+	if lane := mqclient.LaneFor("order-42", 1); lane != 0 {
+		t.Fatalf("Expected lane 0 for a single lane, but got %d", lane)
+	}
+}
@@ -0,0 +1,219 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/internal/discovery"
+	"github.com/pramithamj/microcomms/pkg/microcomms"
+	"google.golang.org/grpc"
+)
+
+func outlierInstances(n int) []discovery.Instance {
+	instances := make([]discovery.Instance, n)
+	for i := range instances {
+		instances[i] = discovery.Instance{ID: string(rune('a' + i)), Service: "payments", Address: "10.0.0.1", Port: 8080 + i}
+	}
+	return instances
+}
+
+func TestOutlierDetector_ConsecutiveErrorsEjectWithBackoff(t *testing.T) {
+	d, err := discovery.NewOutlierDetector(discovery.OutlierConfig{
+		Consecutive5xx:     3,
+		BaseEjectionTime:   100 * time.Millisecond,
+		MaxEjectionPercent: 100,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	instances := outlierInstances(3)
+	a := instances[0]
+
+	// A success in between resets the count
+	d.Report(a, discovery.Outcome{StatusCode: 500})
+	d.Report(a, discovery.Outcome{StatusCode: 500})
+	d.Report(a, discovery.Outcome{StatusCode: 200})
+	d.Report(a, discovery.Outcome{StatusCode: 500})
+	if d.Ejected(a.ID) {
+		t.Fatalf("Expected no ejection after interrupted failures")
+	}
+	d.Report(a, discovery.Outcome{StatusCode: 500})
+	d.Report(a, discovery.Outcome{StatusCode: 500})
+	if !d.Ejected(a.ID) {
+		t.Fatalf("Expected ejection after 3 consecutive 5xx")
+	}
+	if filtered := d.Filter(instances); len(filtered) != 2 || filtered[0].ID != "b" {
+		t.Fatalf("Expected a to be filtered out, but got %+v", filtered)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if d.Ejected(a.ID) {
+		t.Fatalf("Expected a to return after the base ejection time")
+	}
+
+	// The second ejection lasts twice as long
+	for i := 0; i < 3; i++ {
+		d.Report(a, discovery.Outcome{StatusCode: 500})
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !d.Ejected(a.ID) {
+		t.Fatalf("Expected the second ejection to last longer than the first")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if d.Ejected(a.ID) {
+		t.Fatalf("Expected a to return after twice the base ejection time")
+	}
+}
+
+func TestOutlierDetector_GatewayErrorsAndMaxPercent(t *testing.T) {
+	d, err := discovery.NewOutlierDetector(discovery.OutlierConfig{ConsecutiveGatewayErrors: 2})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	instances := outlierInstances(2)
+
+	d.Report(instances[0], discovery.Outcome{Err: errors.New("connection refused")})
+	d.Report(instances[0], discovery.Outcome{StatusCode: http.StatusBadGateway})
+	if !d.Ejected("a") {
+		t.Fatalf("Expected ejection after consecutive gateway errors")
+	}
+	time.Sleep(time.Millisecond)
+	d.Report(instances[1], discovery.Outcome{StatusCode: http.StatusServiceUnavailable})
+	d.Report(instances[1], discovery.Outcome{StatusCode: http.StatusGatewayTimeout})
+	if !d.Ejected("b") {
+		t.Fatalf("Expected ejection after consecutive gateway errors")
+	}
+
+	// Only half of the instances may be left out; the earliest ejected one
+	// goes back into the set
+	filtered := d.Filter(instances)
+	if len(filtered) != 1 || filtered[0].ID != "a" {
+		t.Fatalf("Expected only b to be filtered out, but got %+v", filtered)
+	}
+}
+
+func TestOutlierDetector_LatencyOutlier(t *testing.T) {
+	d, err := discovery.NewOutlierDetector(discovery.OutlierConfig{LatencyMinRequests: 5})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	instances := outlierInstances(4)
+	for i := 0; i < 5; i++ {
+		for _, instance := range instances[:3] {
+			d.Report(instance, discovery.Outcome{StatusCode: 200, Latency: 10 * time.Millisecond})
+		}
+		d.Report(instances[3], discovery.Outcome{StatusCode: 200, Latency: 100 * time.Millisecond})
+	}
+	if !d.Ejected("d") {
+		t.Fatalf("Expected the slow instance to be ejected")
+	}
+	for _, instance := range instances[:3] {
+		if d.Ejected(instance.ID) {
+			t.Fatalf("Expected %s to stay in the set", instance.ID)
+		}
+	}
+}
+
+var grpcStubOnce sync.Once
+
+// newTestMicrocomms creates a Microcomms instance, serving the gRPC address
+// it dials on creation so that the dial does not block
+func newTestMicrocomms(t *testing.T, cfg microcomms.MicrocommsConfig) *microcomms.Microcomms {
+	t.Helper()
+	grpcStubOnce.Do(func() {
+		lis, err := net.Listen("tcp", "localhost:50051")
+		if err != nil {
+			t.Skipf("Cannot serve the gRPC address: %v", err)
+		}
+		go grpc.NewServer().Serve(lis)
+	})
+	return microcomms.NewMicrocommsWithConfig(cfg)
+}
+
+func TestMicrocomms_GetReportsStatusCodesToOutlierDetection(t *testing.T) {
+	var bad, good int64
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&bad, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&good, 1)
+	}))
+	defer healthy.Close()
+
+	cfg := microcomms.DefaultConfig()
+	cfg.DiscoveryBackend = microcomms.DiscoveryBackendStatic
+	cfg.StaticServices = map[string][]string{
+		"payments": {strings.TrimPrefix(failing.URL, "http://"), strings.TrimPrefix(healthy.URL, "http://")},
+	}
+	cfg.HTTPRetryAttempts = 2
+	// Only the 5xx counter can eject, and only if status codes are reported
+	cfg.Outliers = microcomms.OutlierConfig{Consecutive5xx: 2, ConsecutiveGatewayErrors: 100, MaxEjectionPercent: 50}
+	cfg.CircuitBreakers = map[string]microcomms.CircuitBreakerConfig{"http": {FailureThreshold: 100}}
+	m := newTestMicrocomms(t, cfg)
+
+	for i := 0; i < 4; i++ {
+		resp, err := m.Get(context.Background(), "payments", "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	if n := atomic.LoadInt64(&bad); n != 2 {
+		t.Fatalf("Expected the failing instance to be ejected after one request of 2 attempts, but it got %d", n)
+	}
+	for i := 0; i < 4; i++ {
+		resp, err := m.Get(context.Background(), "payments", "/")
+		if err != nil {
+			t.Fatalf("Expected requests to reach the healthy instance, but got %v", err)
+		}
+		resp.Body.Close()
+	}
+	if n := atomic.LoadInt64(&bad); n != 2 {
+		t.Fatalf("Expected no more requests to the ejected instance, but it got %d", n)
+	}
+}
+
+func TestMicrocomms_GetStopsWhenContextIsCancelled(t *testing.T) {
+	var requests int64
+	aborted := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		<-r.Context().Done()
+		aborted <- struct{}{}
+	}))
+	defer server.Close()
+
+	cfg := microcomms.DefaultConfig()
+	cfg.DiscoveryBackend = microcomms.DiscoveryBackendStatic
+	cfg.StaticServices = map[string][]string{"payments": {strings.TrimPrefix(server.URL, "http://")}}
+	cfg.HTTPRetryAttempts = 3
+	m := newTestMicrocomms(t, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := m.Get(ctx, "payments", "/"); err == nil {
+		t.Fatalf("Expected the cancelled request to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected Get to return when ctx is done, but it took %v", elapsed)
+	}
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the request in flight to be aborted")
+	}
+	time.Sleep(600 * time.Millisecond)
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Fatalf("Expected no retries after ctx was done, but the server got %d requests", n)
+	}
+}
@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pramithamj/microcomms/pkg/microcomms"
+)
+
+func TestRateLimiter_AllowN(t *testing.T) {
+	rl := microcomms.NewRateLimiter(10, 5)
+	now := time.Now()
+	if !rl.AllowN(now, 3) || !rl.AllowN(now, 2) {
+		t.Fatalf("Expected the full burst to be allowed")
+	}
+	if rl.AllowN(now, 1) {
+		t.Fatalf("Expected an empty bucket to reject")
+	}
+	if !rl.AllowN(now.Add(100*time.Millisecond), 1) {
+		t.Fatalf("Expected a token to be refilled after 100ms")
+	}
+	if rl.AllowN(now.Add(time.Hour), 6) {
+		t.Fatalf("Expected more tokens than the burst to be rejected")
+	}
+}
+
+func TestRateLimiter_ReserveQueuesInOrder(t *testing.T) {
+	rl := microcomms.NewRateLimiter(10, 1)
+	now := time.Now()
+	first := rl.ReserveN(now, 1)
+	second := rl.ReserveN(now, 1)
+	third := rl.ReserveN(now, 1)
+	if first.DelayFrom(now) != 0 {
+		t.Fatalf("Expected the first reservation to be immediate, but got %v", first.DelayFrom(now))
+	}
+	if d := second.DelayFrom(now); d != 100*time.Millisecond {
+		t.Fatalf("Expected the second reservation to wait 100ms, but got %v", d)
+	}
+	if d := third.DelayFrom(now); d != 200*time.Millisecond {
+		t.Fatalf("Expected the third reservation to wait 200ms, but got %v", d)
+	}
+	if r := rl.ReserveN(now, 2); r.OK() {
+		t.Fatalf("Expected a reservation above the burst not to be OK")
+	}
+}
+
+func TestRateLimiter_WaitHonorsContext(t *testing.T) {
+	rl := microcomms.NewRateLimiter(1, 1)
+	if err := rl.Wait(context.Background()); err != nil {
+		t.Fatalf("Expected the first token at once, but got %v", err)
+	}
+
+	// The next token is a second away, beyond the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := rl.Wait(ctx); !errors.Is(err, microcomms.ErrRateLimited) {
+		t.Fatalf("Expected ErrRateLimited, but got %v", err)
+	}
+	if time.Since(start) > 20*time.Millisecond {
+		t.Fatalf("Expected Wait to fail without waiting for the deadline")
+	}
+
+	// A cancelled wait returns its token
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if err := rl.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, but got %v", err)
+	}
+	if d := rl.Reserve().Delay(); d > time.Second {
+		t.Fatalf("Expected the cancelled token to be returned, but the next wait is %v", d)
+	}
+
+	if err := rl.WaitN(context.Background(), 2); err == nil {
+		t.Fatalf("Expected waiting for more tokens than the burst to fail")
+	}
+}
+
+func TestRateLimiter_WaitThrottlesConcurrentCallers(t *testing.T) {
+	rl := microcomms.NewRateLimiter(100, 1)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := rl.Wait(context.Background()); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("Expected 10 calls at 100/s to take about 90ms, but took %v", elapsed)
+	}
+}
+
+func TestRateLimiter_SetRateAndBurst(t *testing.T) {
+	rl := microcomms.NewRateLimiter(1, 1)
+	now := time.Now()
+	rl.AllowN(now, 1)
+	rl.SetRate(1000)
+	if d := rl.Reserve().Delay(); d > 10*time.Millisecond {
+		t.Fatalf("Expected the higher rate to apply, but the wait is %v", d)
+	}
+	if rl.Rate() != 1000 {
+		t.Fatalf("Expected rate 1000, but got %v", rl.Rate())
+	}
+
+	rl.SetBurst(5)
+	time.Sleep(10 * time.Millisecond)
+	if !rl.AllowN(time.Now(), 5) {
+		t.Fatalf("Expected the larger burst to be allowed")
+	}
+	rl.SetBurst(2)
+	if rl.Burst() != 2 || rl.AllowN(time.Now(), 3) {
+		t.Fatalf("Expected the smaller burst to apply")
+	}
+}
+
+func TestRateLimiter_WaitAndAllowBlocksUntilGrantable(t *testing.T) {
+	rl := microcomms.NewRateLimiter(0, 0)
+	done := make(chan struct{})
+	go func() {
+		rl.WaitAndAllow()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Expected WaitAndAllow to block while no token can be granted")
+	case <-time.After(30 * time.Millisecond):
+	}
+	rl.SetBurst(1)
+	rl.SetRate(100)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected WaitAndAllow to proceed once the limiter can grant a token")
+	}
+}
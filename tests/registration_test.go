@@ -0,0 +1,210 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/pramithamj/microcomms/internal/discovery"
+)
+
+// fakeAgent records the calls made to the Consul agent API
+type fakeAgent struct {
+	mutex        sync.Mutex
+	registered   []api.AgentServiceRegistration
+	ttlUpdates   map[string][]string // Check ID to statuses
+	deregistered []string
+}
+
+func newFakeAgent() *fakeAgent {
+	return &fakeAgent{ttlUpdates: make(map[string][]string)}
+}
+
+func (f *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch {
+	case r.URL.Path == "/v1/agent/service/register":
+		var registration api.AgentServiceRegistration
+		json.NewDecoder(r.Body).Decode(&registration)
+		f.registered = append(f.registered, registration)
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/check/update/"):
+		var update struct{ Status string }
+		json.NewDecoder(r.Body).Decode(&update)
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/update/")
+		f.ttlUpdates[id] = append(f.ttlUpdates[id], update.Status)
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		f.deregistered = append(f.deregistered, strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeAgent) statuses(checkID string) []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.ttlUpdates[checkID]...)
+}
+
+func (f *fakeAgent) deregisteredIDs() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.deregistered...)
+}
+
+func newAgentDiscovery(t *testing.T) (*fakeAgent, *discovery.ConsulDiscovery) {
+	t.Helper()
+	agent := newFakeAgent()
+	server := httptest.NewServer(agent)
+	t.Cleanup(server.Close)
+	d, err := discovery.NewConsulDiscovery(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	t.Cleanup(func() { d.Close() })
+	return agent, d
+}
+
+func waitDeregistered(t *testing.T, r *discovery.Registration) {
+	t.Helper()
+	select {
+	case <-r.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for deregistration")
+	}
+}
+
+func TestRegister_CheckTypes(t *testing.T) {
+	agent, d := newAgentDiscovery(t)
+	ctx := context.Background()
+	instance := discovery.Instance{
+		ID: "payments-1", Service: "payments", Address: "10.0.0.1", Port: 8081,
+		Tags: []string{"v2"}, Meta: map[string]string{"zone": "a"},
+	}
+
+	checks := []discovery.HealthCheck{
+		{Type: discovery.CheckHTTP, DeregisterCriticalAfter: time.Minute},
+		{Type: discovery.CheckGRPC, Interval: 5 * time.Second},
+		{Type: discovery.CheckTCP, Target: "10.0.0.1:9000"},
+	}
+	for _, check := range checks {
+		r, err := discovery.Register(ctx, d, instance, discovery.RegistrationOptions{Check: check})
+		if err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+		if err := r.Deregister(ctx); err != nil {
+			t.Fatalf("Expected no error, but got: %v", err)
+		}
+	}
+
+	agent.mutex.Lock()
+	defer agent.mutex.Unlock()
+	if len(agent.registered) != 3 {
+		t.Fatalf("Expected 3 registrations, but got %d", len(agent.registered))
+	}
+	httpReg, grpcReg, tcpReg := agent.registered[0], agent.registered[1], agent.registered[2]
+	if len(httpReg.Tags) != 1 || httpReg.Tags[0] != "v2" || httpReg.Meta["zone"] != "a" {
+		t.Fatalf("Expected tags and meta to be registered, but got %+v", httpReg)
+	}
+	if httpReg.Check.HTTP != "http://10.0.0.1:8081/health" || httpReg.Check.DeregisterCriticalServiceAfter != "1m0s" {
+		t.Fatalf("Unexpected HTTP check: %+v", httpReg.Check)
+	}
+	if httpReg.Check.CheckID != discovery.CheckID("payments-1") {
+		t.Fatalf("Expected check ID %s, but got %s", discovery.CheckID("payments-1"), httpReg.Check.CheckID)
+	}
+	if grpcReg.Check.GRPC != "10.0.0.1:8081" || grpcReg.Check.Interval != "5s" {
+		t.Fatalf("Unexpected gRPC check: %+v", grpcReg.Check)
+	}
+	if tcpReg.Check.TCP != "10.0.0.1:9000" || tcpReg.Check.Timeout != "1s" {
+		t.Fatalf("Unexpected TCP check: %+v", tcpReg.Check)
+	}
+	if len(agent.deregistered) != 3 || agent.deregistered[0] != "payments-1" {
+		t.Fatalf("Expected 3 deregistrations, but got %v", agent.deregistered)
+	}
+}
+
+func TestRegister_TTLHeartbeatsAndDeregisterOnCancel(t *testing.T) {
+	agent, d := newAgentDiscovery(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r, err := discovery.Register(ctx, d,
+		discovery.Instance{ID: "orders-1", Service: "orders", Address: "10.0.0.2", Port: 8080},
+		discovery.RegistrationOptions{Check: discovery.HealthCheck{Type: discovery.CheckTTL, TTL: 150 * time.Millisecond}})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	checkID := discovery.CheckID("orders-1")
+
+	// The check passes right away and is kept passing every third of the TTL
+	time.Sleep(200 * time.Millisecond)
+	statuses := agent.statuses(checkID)
+	if len(statuses) < 3 || statuses[0] != api.HealthPassing {
+		t.Fatalf("Expected passing heartbeats, but got %v", statuses)
+	}
+
+	r.SetHealth(false, "draining")
+	statuses = agent.statuses(checkID)
+	if statuses[len(statuses)-1] != api.HealthCritical {
+		t.Fatalf("Expected a critical status after SetHealth, but got %v", statuses)
+	}
+
+	cancel()
+	waitDeregistered(t, r)
+	if ids := agent.deregisteredIDs(); len(ids) != 1 || ids[0] != "orders-1" {
+		t.Fatalf("Expected orders-1 to be deregistered once, but got %v", ids)
+	}
+
+	// Heartbeats stop with the registration
+	count := len(agent.statuses(checkID))
+	time.Sleep(150 * time.Millisecond)
+	if len(agent.statuses(checkID)) != count {
+		t.Fatalf("Expected no heartbeats after deregistration")
+	}
+	if err := r.Deregister(context.Background()); err != nil {
+		t.Fatalf("Expected a second Deregister to be a no-op, but got: %v", err)
+	}
+	if ids := agent.deregisteredIDs(); len(ids) != 1 {
+		t.Fatalf("Expected a single deregistration, but got %v", ids)
+	}
+}
+
+func TestRegister_DeregisterOnSIGTERM(t *testing.T) {
+	agent, d := newAgentDiscovery(t)
+
+	// Keep the re-raised signal from terminating the test binary
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	r, err := discovery.Register(context.Background(), d,
+		discovery.Instance{Service: "search", Address: "10.0.0.3", Port: 8080},
+		discovery.RegistrationOptions{DeregisterOnSignal: true})
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	waitDeregistered(t, r)
+	if ids := agent.deregisteredIDs(); len(ids) != 1 || ids[0] != "search-10.0.0.3-8080" {
+		t.Fatalf("Expected search-10.0.0.3-8080 to be deregistered, but got %v", ids)
+	}
+	// Both the original and the re-raised signal arrive before Stop
+	for i := 0; i < 2; i++ {
+		select {
+		case <-signals:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the SIGTERM to be raised again")
+		}
+	}
+}